@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || dragonfly || windows)
+
+package main
+
+// diskFreeSpace на этой платформе не поддерживается: -min-free недоступен
+func diskFreeSpace(dir string) (int64, error) {
+	return 0, errDiskSpaceUnsupported
+}
@@ -2,9 +2,25 @@ module yandex.music.exporter
 
 go 1.21
 
-require github.com/joho/godotenv v1.5.1
+require (
+	github.com/bogem/id3v2 v1.2.0
+	github.com/joho/godotenv v1.5.1
+	github.com/zalando/go-keyring v0.2.5
+	golang.org/x/sys v0.22.0
+	golang.org/x/text v0.3.2
+	modernc.org/sqlite v1.34.5
+)
 
 require (
-	github.com/bogem/id3v2 v1.2.0 // indirect
-	golang.org/x/text v0.3.2 // indirect
+	github.com/alessio/shellescape v1.4.1 // indirect
+	github.com/danieljoos/wincred v1.2.0 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/godbus/dbus/v5 v5.1.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
 )
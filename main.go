@@ -22,20 +22,52 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/bogem/id3v2"
 	"github.com/joho/godotenv"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/unicode/norm"
+	_ "modernc.org/sqlite"
 )
 
 const (
@@ -43,10 +75,124 @@ const (
 	accountStatusPath     = "/account/status"
 	userPlaylistsListPath = "/users/%s/playlists/list"
 	userLikesTracksPath   = "/users/%s/likes/tracks"
+	userLikesAlbumsPath   = "/users/%s/likes/albums"
+	userDislikesPath      = "/users/%s/dislikes/tracks"
 	trackPath             = "/tracks/%s"
+	stationTracksPath     = "/rotor/station/%s/tracks"
+	stationFeedbackPath   = "/rotor/station/%s/feedback"
+	tracksPath            = "/tracks"
 	trackDownloadInfoPath = "/tracks/%s/download-info"
 	albumTracksPath       = "/albums/%s/with-tracks"
+	albumPath             = "/albums/%s"
+	artistBriefInfoPath   = "/artists/%s/brief-info"
 	userPlaylistPath      = "/users/%s/playlists/%d"
+	artistTracksPath      = "/artists/%s/tracks"
+	artistAlbumsPath      = "/artists/%s/direct-albums"
+	musicHistoryPath      = "/music-history"
+	trackSupplementPath   = "/tracks/%s/supplement"
+)
+
+// artistTopTracksCount — сколько популярных треков исполнителя скачивается по умолчанию
+const artistTopTracksCount = 20
+
+// artistAlbumsPageSize — размер страницы при получении альбомов исполнителя
+const artistAlbumsPageSize = 50
+
+// likesPlaylistTitle — название плейлиста с лайками в интерфейсе Яндекс.Музыки
+const likesPlaylistTitle = "Мне нравится"
+
+// myWaveStation — персональная станция «Моя волна»
+const myWaveStation = "user:onyourwave"
+
+// waveTitle — название «Моей волны» для комментариев и сопутствующих файлов
+const waveTitle = "Моя волна"
+
+// confirmTrackThreshold — с какого числа треков к скачиванию в терминале спрашивается подтверждение
+const confirmTrackThreshold = 200
+
+// pruneTrashDir — папка внутри папки назначения, куда -prune переносит лишние файлы
+const pruneTrashDir = ".trash"
+
+// exportStateFileName — имя файла состояния выгрузки в папке назначения
+const exportStateFileName = ".export-state.json"
+
+// Стратегии при совпадении имён файлов разных треков
+const (
+	collisionSkip      = "skip"
+	collisionOverwrite = "overwrite"
+	collisionSuffix    = "suffix"
+)
+
+// Что делать, если содержимое скачанного файла не совпадает с расширением .mp3
+const (
+	mismatchRename = "rename"
+	mismatchWarn   = "warn"
+)
+
+// catalogBatchSize — сколько треков записывается в SQLite-каталог одной транзакцией
+const catalogBatchSize = 100
+
+// ciHeartbeatInterval — как часто печатается сводка прогресса в режиме CI
+const ciHeartbeatInterval = 30 * time.Second
+
+// Раскладки файлов в папке назначения
+const (
+	layoutFlat        = "flat"         // {исполнитель}-{название}.mp3 в одной папке
+	layoutMediaServer = "media-server" // {исполнитель}/{альбом}/{NN} - {название}.mp3 и folder.jpg, как ждут Plex и Jellyfin
+)
+
+// folderCoverFileName — имя файла обложки альбома в раскладке media-server
+const folderCoverFileName = "folder.jpg"
+
+// Режимы обложек для -cover-mode. Без флага обложка встраивается во все треки,
+// только если задан -cover-file, а folder.jpg пишется в раскладке media-server
+const (
+	coverModeEmbedAll   = "embed-all"   // Встраивать обложку в каждый трек
+	coverModeEmbedFirst = "embed-first" // Встраивать только в первый трек альбома, рядом — folder.jpg
+	coverModeFolderOnly = "folder-only" // Не встраивать, только folder.jpg в папке альбома
+)
+
+// Размеры обложек, подставляемые в шаблон coverUri
+const (
+	folderCoverSize = "1000x1000" // Для folder.jpg
+	tagCoverSize    = "1000x1000" // Для ссылки на обложку в ID3-теге
+	albumCoverSize  = "1000x1000" // По умолчанию для команды covers (-cover-size)
+)
+
+// coverSizePattern находит размер, уже подставленный в конец URI обложки (например, /200x200 или /orig)
+var coverSizePattern = regexp.MustCompile(`/(\d+x\d+|orig)$`)
+
+// Запись токена в системном хранилище учётных данных (Keychain, Credential Manager, Secret Service)
+const (
+	keyringService = "yandex.music.exporter"
+	keyringUser    = "ACCESS_TOKEN"
+)
+
+// version — версия утилиты; при сборке релиза задаётся через -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// manifestSchemaVersion — версия схемы манифеста выгрузки; увеличивается при несовместимых изменениях
+const manifestSchemaVersion = 1
+
+// Коды завершения программы, чтобы скрипты могли различать причины неудачи
+const (
+	exitOK       = 0 // Успех
+	exitFailure  = 1 // Прочие ошибки, включая неверные флаги и полностью неудачное скачивание
+	exitAuth     = 2 // Нет токена или API отклонил его (401, 403)
+	exitNotFound = 3 // Плейлист, трек или исполнитель не найден (404)
+	exitNetwork  = 4 // Сетевая ошибка: нет соединения, таймаут, DNS
+	exitPartial  = 5 // Скачивание прошло, но часть треков не скачалась
+)
+
+// Статусы треков в файле состояния выгрузки
+const (
+	trackStatePending = "pending"
+	trackStateDone    = "done"
+	trackStateFailed  = "failed"
+	trackStateRemoved = "removed" // Трек удалён из каталога, повторно не скачивается
+
+	// Трек не скачался больше -max-retries запусков подряд, повторно не скачивается
+	trackStatePermanentlyFailed = "permanently-failed"
 )
 
 // Track представляет трек из плейлиста
@@ -60,24 +206,164 @@ type Track struct {
 	Genre       string      `json:"genre"`       // Жанр
 	CoverUri    string      `json:"coverUri"`    // URI обложки альбома
 	OgImage     string      `json:"ogImage"`     // Альтернативный URI обложки
+	ISRC        string      `json:"isrc"`        // Международный код записи (есть не во всех ответах)
+	BPM         float64     `json:"bpm"`         // Темп в ударах в минуту (есть не во всех ответах)
+	Available   *bool       `json:"available"`   // Доступен ли трек в регионе (nil — API не сообщил)
 	Artists     []struct {
 		ID   interface{} `json:"id"`   // Может быть строкой или числом
 		Name string      `json:"name"` // Имя исполнителя
 	} `json:"artists"`
-	Albums []struct {
-		ID         interface{} `json:"id"`         // Может быть строкой или числом
-		Title      string      `json:"title"`      // Название альбома
-		Year       int         `json:"year"`       // Год альбома
-		Genre      string      `json:"genre"`      // Жанр альбома
-		CoverUri   string      `json:"coverUri"`   // URI обложки альбома
-		TrackCount int         `json:"trackCount"` // Количество треков в альбоме
-	} `json:"albums"`
+	Albums []Album `json:"albums"`
+}
+
+// Album представляет альбом
+type Album struct {
+	ID         interface{} `json:"id"`         // Может быть строкой или числом
+	Title      string      `json:"title"`      // Название альбома
+	Year       int         `json:"year"`       // Год альбома
+	Genre      string      `json:"genre"`      // Жанр альбома
+	CoverUri   string      `json:"coverUri"`   // URI обложки альбома
+	TrackCount int         `json:"trackCount"` // Количество треков в альбоме
+
+	// ReleaseDate — полная дата выхода в формате RFC 3339; есть не у всех альбомов
+	ReleaseDate string `json:"releaseDate,omitempty"`
+
+	// TrackPosition — диск и номер трека в этом альбоме; есть только у альбомов внутри трека
+	TrackPosition *TrackPosition `json:"trackPosition,omitempty"`
+
+	Artists []struct {
+		Name string `json:"name"` // Имя исполнителя
+	} `json:"artists"` // Исполнители альбома (есть не во всех ответах)
+}
+
+// TrackPosition представляет положение трека в альбоме
+type TrackPosition struct {
+	Volume int `json:"volume"` // Номер диска, с 1
+	Index  int `json:"index"`  // Номер трека на диске, с 1
+}
+
+// DisplayArtists возвращает исполнителей трека через запятую для вывода и имён файлов.
+// Если maxArtists > 0 и исполнителей больше, показываются первые maxArtists и «и др.»
+func (t Track) DisplayArtists(maxArtists int) string {
+	artistNames := []string{}
+	for _, artist := range t.Artists {
+		artistNames = append(artistNames, artist.Name)
+	}
+	if len(artistNames) == 0 {
+		return "Неизвестный исполнитель"
+	}
+	if maxArtists > 0 && len(artistNames) > maxArtists {
+		return strings.Join(artistNames[:maxArtists], ", ") + " и др."
+	}
+	return strings.Join(artistNames, ", ")
+}
+
+// IsAvailable сообщает, доступен ли трек для прослушивания в регионе. Если API
+// не вернул поле available, трек считается доступным
+func (t Track) IsAvailable() bool {
+	return t.Available == nil || *t.Available
+}
+
+// TrackID возвращает идентификатор трека для запросов к API: RealID, если он есть,
+// иначе ID. ID трека из плейлиста бывает локальным, и запросы по нему возвращают 404
+func (t Track) TrackID() string {
+	if t.RealID != "" {
+		return t.RealID
+	}
+	return formatID(t.ID)
 }
 
 // TrackShort представляет короткую информацию о треке в плейлисте
 type TrackShort struct {
-	ID    int   `json:"id"`
-	Track Track `json:"track"`
+	ID        int    `json:"id"`
+	Track     Track  `json:"track"`
+	Timestamp string `json:"timestamp,omitempty"` // Когда трек добавлен в плейлист или лайки
+}
+
+// addedAtLayouts — форматы, в которых API передаёт время добавления трека.
+// Обычно это RFC 3339, но встречается и смещение без двоеточия (+0000)
+var addedAtLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05",
+}
+
+// AddedAt возвращает время добавления трека; false — времени нет или его не удалось разобрать
+func (t TrackShort) AddedAt() (time.Time, bool) {
+	value := strings.TrimSpace(t.Timestamp)
+	if value == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range addedAtLayouts {
+		if added, err := time.Parse(layout, value); err == nil {
+			return added, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// filterAddedSince оставляет треки, добавленные не раньше since, и упорядочивает их
+// по времени добавления, от старых к новым. Треки без времени добавления не проходят:
+// их количество возвращается отдельно, чтобы о них можно было предупредить
+func filterAddedSince(tracks []TrackShort, since time.Time) (kept []TrackShort, undated int) {
+	type dated struct {
+		track TrackShort
+		added time.Time
+	}
+	var recent []dated
+	for _, trackShort := range tracks {
+		added, ok := trackShort.AddedAt()
+		if !ok {
+			undated++
+			continue
+		}
+		if !added.Before(since) {
+			recent = append(recent, dated{trackShort, added})
+		}
+	}
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].added.Before(recent[j].added)
+	})
+	kept = make([]TrackShort, 0, len(recent))
+	for _, d := range recent {
+		kept = append(kept, d.track)
+	}
+	return kept, undated
+}
+
+// shuffleTracks возвращает треки в случайном порядке, который полностью определяется seed:
+// один и тот же seed для одного и того же списка всегда даёт тот же порядок
+func shuffleTracks(tracks []TrackShort, seed int64) []TrackShort {
+	shuffled := append([]TrackShort(nil), tracks...)
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// parseAddedSince разбирает значение -added-since: дату YYYY-MM-DD (полночь по местному
+// времени) или дату и время в RFC 3339
+func parseAddedSince(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if since, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return since, nil
+	}
+	if since, err := time.Parse(time.RFC3339, value); err == nil {
+		return since, nil
+	}
+	return time.Time{}, fmt.Errorf("ожидается дата YYYY-MM-DD или дата и время RFC 3339, например 2024-05-01T18:00:00+03:00")
+}
+
+// applyAddedSince применяет -added-since к трекам плейлиста и сообщает в stderr,
+// сколько треков осталось и сколько пропущено без времени добавления
+func applyAddedSince(tracks []TrackShort, since time.Time) []TrackShort {
+	kept, undated := filterAddedSince(tracks, since)
+	log.Printf("Добавлено с %s: %d из %d треков\n", since.Format("2006-01-02 15:04"), len(kept), len(tracks))
+	if undated > 0 {
+		log.Printf("Предупреждение: пропущено треков без времени добавления: %d\n", undated)
+	}
+	return kept
 }
 
 // Playlist представляет плейлист
@@ -101,6 +387,40 @@ type Playlist struct {
 	Visibility string `json:"visibility"`
 	Collective bool   `json:"collective"`
 	Created    string `json:"created"`
+
+	Description string        `json:"description"`
+	Cover       PlaylistCover `json:"cover"`
+	OgImage     string        `json:"ogImage"`
+}
+
+// PlaylistCover представляет обложку плейлиста: своя картинка (pic) или мозаика
+// из обложек треков (mosaic), для которой заполнен только itemsUri
+type PlaylistCover struct {
+	Type     string   `json:"type"`
+	URI      string   `json:"uri"`
+	ItemsURI []string `json:"itemsUri"`
+}
+
+// CoverURI возвращает URI обложки плейлиста: своей, первой из мозаики, затем альтернативной
+func (p Playlist) CoverURI() string {
+	if p.Cover.URI != "" {
+		return p.Cover.URI
+	}
+	if len(p.Cover.ItemsURI) > 0 {
+		return p.Cover.ItemsURI[0]
+	}
+	return p.OgImage
+}
+
+// CommandID возвращает ID плейлиста для флага -id: UUID, если он есть, иначе kind
+func (p Playlist) CommandID() string {
+	if p.PlaylistUuid != "" {
+		return p.PlaylistUuid
+	}
+	if p.Kind != 0 {
+		return strconv.Itoa(p.Kind)
+	}
+	return ""
 }
 
 // PlaylistResponse представляет ответ API для плейлиста
@@ -108,725 +428,9262 @@ type PlaylistResponse struct {
 	Result []Playlist `json:"result"`
 }
 
-// AccountInfo представляет информацию об аккаунте
-type AccountInfo struct {
-	UserID      int64  `json:"uid"`
-	Login       string `json:"login"`
-	Name        string `json:"name"`
-	DisplayName string `json:"display_name"`
+// DownloadOptions содержит параметры скачивания треков
+type DownloadOptions struct {
+	OnCollision        string        // Стратегия при совпадении имён файлов: skip, overwrite, suffix
+	Catalog            *Catalog      // SQLite-каталог для записи метаданных (nil — не используется)
+	CommentTemplate    string        // Шаблон комментария (COMM) с плейсхолдерами; пусто — не записывается
+	ExportDate         string        // Значение {date}: время начала запуска в формате -date-format
+	ExportDateTime     string        // Значение {datetime}: то же время с часами, минутами и секундами
+	Source             string        // Источник треков: playlist или likes (заполняется командой)
+	PlaylistTitle      string        // Название плейлиста-источника (заполняется командой)
+	TagISRC            bool          // Записывать ISRC в теги
+	TagBPM             bool          // Записывать BPM в теги
+	ID3Version         byte          // Версия ID3v2 тегов: 3 или 4
+	NoTags             bool          // Не записывать ID3 теги: файлы остаются в том виде, в каком скачаны
+	CI                 bool          // Режим для логов CI: без возврата каретки, с периодической сводкой
+	Quiet              bool          // Выводить только ошибки (в stderr)
+	Filter             TrackFilter   // Условия отбора треков
+	Layout             string        // Раскладка файлов: flat или media-server
+	Shuffle            bool          // Перемешать треки перед скачиванием (порядок M3U и номеров -prepend-index)
+	ShuffleSeed        int64         // Seed для -shuffle: одинаковый seed даёт одинаковый порядок
+	NormalizeCase      string        // Регистр исполнителей и названий в тегах и именах файлов: title или пусто — как в API
+	CompleteAlbums     int           // Докачивать альбомы, из которых лайкнуто не меньше этого процента треков (0 — нет)
+	Destination        Destination   // Куда попадают готовые файлы; nil — остаются в папке -to
+	Covers             *CoverSource  // Обложки для встраивания (-cover-file или из API по -cover-mode); nil — не встраиваются
+	CoverMode          string        // Куда класть обложки: embed-all, embed-first, folder-only (пусто — как без -cover-mode)
+	AddedSince         time.Time     // Только треки, добавленные в плейлист не раньше (нулевое — все)
+	Prune              bool          // Убирать файлы треков, которых больше нет в источнике
+	PruneHard          bool          // Удалять лишние файлы насовсем, а не переносить в .trash
+	AssumeYes          bool          // Не спрашивать подтверждение перед большим скачиванием (-yes)
+	MaxTitleLength     int           // Максимальная длина названия трека в имени файла (0 — без ограничения)
+	NameTemplate       string        // Шаблон имени файла (-name-template) с уже подставленными {date} и {datetime}; пусто — имя по раскладке
+	MaxArtists         int           // Сколько исполнителей писать в имя файла и вывод, остальные — «и др.» (0 — всех)
+	PrependIndex       bool          // Начинать имя файла с позиции трека в списке источника (001 - ...)
+	ExtensionMismatch  string        // Если файл оказался не MP3: rename — исправить расширение, warn — только предупредить
+	PlaylistMeta       bool          // Сохранять обложку и описание плейлиста в playlist.jpg и playlist.json
+	FailFast           bool          // Прекращать скачивание после первого трека с ошибкой
+	MinFree            int64         // Сколько байт должно оставаться свободными на диске (-min-free); 0 — не проверяется
+	IncludeUnavailable bool          // Пытаться скачивать треки, помеченные недоступными в регионе
+	RecheckRemoved     bool          // Снова запрашивать треки, отмеченные в состоянии как удалённые из каталога
+	MaxRetries         int           // Сколько запусков подряд повторять упавший трек, прежде чем отметить ошибку постоянной (0 — без ограничения)
+	RetryPermanent     bool          // Снова скачивать треки с постоянной ошибкой
+	Concurrency        int           // Сколько треков скачивать одновременно
+	Bitrate            int           // Запрошенный битрейт в кбит/с для отчёта о качестве
+	BitrateReport      string        // Путь к JSON-файлу отчёта о битрейтах (пусто — не записывается)
+	Dedup              *DedupIndex   // Общий индекс файлов треков нескольких папок (-dedup-index); nil — не используется
+	DedupLink          string        // Как использовать файл из другой папки: hard, symlink, copy или skip
+	Events             *EventWriter  // Поток событий выгрузки в формате JSON Lines (-events); nil — не пишется
+	EventsInterval     time.Duration // Как часто писать событие progress
+	Cue                bool          // Писать CUE-файл в папку каждого альбома (download-artist -all-albums)
+
+	// positions — позиции треков по ID для -prepend-index, если скачивается не весь список
+	// источника (sync-playlist скачивает только новые треки). nil — позиция по порядку в tracks
+	positions map[string]int
 }
 
-// GetUserID возвращает UserID как строку
-func (a AccountInfo) GetUserID() string {
-	return fmt.Sprintf("%d", a.UserID)
+// DownloadSummary содержит итоговые счетчики запуска скачивания
+type DownloadSummary struct {
+	Downloaded  int // Скачано треков
+	Skipped     int // Пропущено треков
+	Failed      int // Треков с ошибками
+	NotDirect   int // Треков, недоступных для прямого скачивания
+	Unavailable int // Треков, пропущенных как недоступные в регионе
+	Removed     int // Треков, удалённых из каталога (404 или 410)
+	Permanent   int // Треков, пропущенных из-за постоянной ошибки (-max-retries)
+
+	Results []TrackResult // Результаты по каждому треку в порядке обработки
 }
 
-// AccountStatus представляет информацию об аккаунте
-type AccountStatus struct {
-	Result struct {
-		Account AccountInfo `json:"account"`
-	} `json:"result"`
+// Add прибавляет счетчики и результаты другого запуска
+func (s *DownloadSummary) Add(other DownloadSummary) {
+	s.Downloaded += other.Downloaded
+	s.Skipped += other.Skipped
+	s.Failed += other.Failed
+	s.NotDirect += other.NotDirect
+	s.Unavailable += other.Unavailable
+	s.Removed += other.Removed
+	s.Permanent += other.Permanent
+	s.Results = append(s.Results, other.Results...)
 }
 
-// YandexMusicClient представляет клиент для работы с API Яндекс.Музыки
-type YandexMusicClient struct {
-	token  string
-	client *http.Client
+// Итоговые статусы треков в результатах скачивания
+const (
+	resultDownloaded  = "downloaded"
+	resultSkipped     = "skipped"
+	resultFailed      = "failed"
+	resultNotDirect   = "not-direct"
+	resultUnavailable = "unavailable"
+	resultRemoved     = "removed"
+	resultPermanent   = "permanently-failed"
+)
+
+// TrackResult представляет итог обработки одного трека командой скачивания;
+// из этих данных строятся сопутствующие файлы -csv, -m3u и -json
+type TrackResult struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Artist     string `json:"artist"`
+	Album      string `json:"album,omitempty"`
+	AlbumID    string `json:"albumId,omitempty"`
+	DurationMs int    `json:"durationMs"`
+	Status     string `json:"status"`          // downloaded, skipped, failed, not-direct, unavailable, removed или permanently-failed
+	Path       string `json:"path,omitempty"`  // Путь к файлу трека
+	Codec      string `json:"codec,omitempty"` // Кодек скачанного файла
+	Bitrate    int    `json:"bitrate,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Трек помечен недоступным в регионе, но скачивался из-за -include-unavailable
+	Unavailable bool `json:"unavailable,omitempty"`
+	// Скачан только фрагмент-превью: полной версии среди вариантов не нашлось
+	Preview bool `json:"preview,omitempty"`
 }
 
-// NewClient создает новый клиент Яндекс.Музыки
-func NewClient(token string) *YandexMusicClient {
-	return &YandexMusicClient{
-		token:  token,
-		client: &http.Client{},
-	}
+// HasFile сообщает, есть ли у трека файл на диске после запуска
+func (r TrackResult) HasFile() bool {
+	return r.Status == resultDownloaded || (r.Status == resultSkipped && r.Path != "")
 }
 
-// makeRequest выполняет HTTP запрос к API
-func (c *YandexMusicClient) makeRequest(method, url string) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка создания запроса: %w", err)
-	}
+// CompanionOutputs содержит пути сопутствующих файлов, которые строятся по результатам скачивания
+type CompanionOutputs struct {
+	CSV  string // Путь к CSV-индексу
+	M3U  string // Путь к плейлисту M3U
+	JSON string // Путь к JSON-файлу
 
-	c.setHeaders(req)
-	req.Header.Set("Content-Type", "application/json")
+	BOM bool // Начинать CSV-индекс с метки порядка байтов UTF-8 (-output-encoding=utf-8-bom)
+}
 
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка выполнения запроса: %w", err)
-	}
+// Enabled сообщает, запрошен ли хотя бы один сопутствующий файл
+func (c CompanionOutputs) Enabled() bool {
+	return c.CSV != "" || c.M3U != "" || c.JSON != ""
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		return nil, fmt.Errorf("ошибка API: статус %d, ответ: %s", resp.StatusCode, string(body))
+// Write записывает все запрошенные сопутствующие файлы по результатам скачивания
+func (c CompanionOutputs) Write(results []TrackResult) error {
+	if c.CSV != "" {
+		if err := writeResultsCSV(c.CSV, results, c.BOM); err != nil {
+			return fmt.Errorf("ошибка записи CSV %s: %w", c.CSV, err)
+		}
+	}
+	if c.M3U != "" {
+		if err := writeResultsM3U(c.M3U, results); err != nil {
+			return fmt.Errorf("ошибка записи M3U %s: %w", c.M3U, err)
+		}
+	}
+	if c.JSON != "" {
+		if err := writeResultsJSON(c.JSON, results); err != nil {
+			return fmt.Errorf("ошибка записи JSON %s: %w", c.JSON, err)
+		}
 	}
+	return nil
+}
 
-	return resp, nil
+// normalizeTrack возвращает трек с исполнителями и названием, приведёнными к регистру
+// -normalize-case; без флага трек возвращается как есть
+func (o DownloadOptions) normalizeTrack(track Track) Track {
+	if o.NormalizeCase != caseTitle {
+		return track
+	}
+	track.Title = titleCase(track.Title)
+	// Исполнители копируются: исходный срез общий с кэшем треков
+	artists := track.Artists
+	track.Artists = append(track.Artists[:0:0], artists...)
+	for i := range track.Artists {
+		track.Artists[i].Name = titleCase(track.Artists[i].Name)
+	}
+	return track
 }
 
-// setHeaders устанавливает стандартные заголовки для запросов
-func (c *YandexMusicClient) setHeaders(req *http.Request) {
-	req.Header.Set("Authorization", "OAuth "+c.token)
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+// normalizeTracks применяет normalizeTrack к каждому треку списка, не меняя исходный список
+func (o DownloadOptions) normalizeTracks(tracks []TrackShort) []TrackShort {
+	if o.NormalizeCase != caseTitle {
+		return tracks
+	}
+	normalized := make([]TrackShort, len(tracks))
+	for i, trackShort := range tracks {
+		trackShort.Track = o.normalizeTrack(trackShort.Track)
+		normalized[i] = trackShort
+	}
+	return normalized
 }
 
-// GetAccountStatus получает информацию о текущем пользователе
-func (c *YandexMusicClient) GetAccountStatus() (*AccountStatus, error) {
-	url := baseURL + accountStatusPath
-	resp, err := c.makeRequest("GET", url)
-	if err != nil {
-		return nil, err
+// destination возвращает назначение готовых файлов: заданное или локальную папку
+func (o DownloadOptions) destination() Destination {
+	if o.Destination == nil {
+		return localDestination{}
 	}
-	defer resp.Body.Close()
+	return o.Destination
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+// infof выводит сообщение о ходе скачивания; в режиме -quiet подавляется
+func (o DownloadOptions) infof(format string, args ...interface{}) {
+	if !o.Quiet {
+		fmt.Printf(format, args...)
 	}
+}
 
-	var status AccountStatus
-	if err := json.Unmarshal(body, &status); err != nil {
-		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+// errorf выводит сообщение об ошибке трека: вместе с прогрессом в stdout,
+// а в режиме -quiet — в stderr
+func (o DownloadOptions) errorf(format string, args ...interface{}) {
+	if o.Quiet {
+		fmt.Fprintf(os.Stderr, format, args...)
+		return
 	}
+	fmt.Printf(format, args...)
+}
 
-	return &status, nil
+// TagOptions содержит дополнительные параметры записи ID3 тегов
+type TagOptions struct {
+	Comment string // Текст комментария (COMM); пусто — не записывается
+	ISRC    bool   // Записывать ISRC (TSRC), если он есть в ответе API
+	BPM     bool   // Записывать темп (TBPM), если он есть в ответе API
+	Version byte   // Версия ID3v2: 3 или 4 (0 — defaultID3Version)
+
+	Cover *CoverImage // Обложка для фрейма APIC; nil — не встраивается
 }
 
-// GetUserPlaylists получает список плейлистов пользователя
-func (c *YandexMusicClient) GetUserPlaylists(userID string) ([]Playlist, error) {
-	// Если userID пустой или "me", получаем userId из account/status
-	if userID == "" || userID == "me" {
-		account, err := c.GetAccountStatus()
-		if err != nil {
-			return nil, fmt.Errorf("не удалось получить userId пользователя: %w", err)
-		}
-		userID = account.Result.Account.GetUserID()
-		if userID == "" {
-			return nil, fmt.Errorf("userId пользователя пустой")
-		}
-	}
-	url := baseURL + fmt.Sprintf(userPlaylistsListPath, userID)
-	resp, err := c.makeRequest("GET", url)
+// trackIDFrameDescription — описание фрейма TXXX, в который записывается ID трека
+const trackIDFrameDescription = "YANDEX_TRACK_ID"
+
+// readEmbeddedTrackID читает ID трека из фрейма TXXX YANDEX_TRACK_ID; если фрейма нет,
+// возвращает пустую строку
+func readEmbeddedTrackID(filePath string) (string, error) {
+	tag, err := id3v2.Open(filePath, id3v2.Options{Parse: true, ParseFrames: []string{"TXXX"}})
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("ошибка чтения тегов: %w", err)
 	}
-	defer resp.Body.Close()
+	defer tag.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	for _, frame := range tag.GetFrames("TXXX") {
+		udtf, ok := frame.(id3v2.UserDefinedTextFrame)
+		if ok && udtf.Description == trackIDFrameDescription {
+			return strings.TrimSpace(strings.TrimRight(udtf.Value, "\x00")), nil
+		}
 	}
+	return "", nil
+}
 
-	var response struct {
-		Result []Playlist `json:"result"`
+// albumReleaseDate возвращает дату выхода альбома в виде YYYY-MM-DD или пустую
+// строку, если даты нет или её не удалось разобрать
+func albumReleaseDate(album Album) string {
+	if album.ReleaseDate == "" {
+		return ""
 	}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	if t, err := time.Parse(time.RFC3339, album.ReleaseDate); err == nil {
+		return t.Format("2006-01-02")
 	}
+	if t, err := time.Parse("2006-01-02", album.ReleaseDate); err == nil {
+		return t.Format("2006-01-02")
+	}
+	return ""
+}
 
-	return response.Result, nil
+// CoverImage представляет изображение обложки для встраивания в ID3-теги
+type CoverImage struct {
+	MimeType string // image/jpeg или image/png
+	Data     []byte
 }
 
-// GetLikedTracks получает список избранных треков (лайков) пользователя
-func (c *YandexMusicClient) GetLikedTracks(userID string) ([]TrackShort, error) {
-	// Если userID пустой или "me", получаем userId из account/status
-	if userID == "" || userID == "me" {
-		account, err := c.GetAccountStatus()
-		if err != nil {
-			return nil, fmt.Errorf("не удалось получить userId пользователя: %w", err)
-		}
-		userID = account.Result.Account.GetUserID()
-		if userID == "" {
-			return nil, fmt.Errorf("userId пользователя пустой")
-		}
+// loadCoverImage читает изображение обложки и проверяет, что это JPEG или PNG —
+// другие форматы плееры во фрейме APIC не понимают
+func loadCoverImage(path string) (*CoverImage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения обложки: %w", err)
 	}
+	mimeType := http.DetectContentType(data)
+	if mimeType != "image/jpeg" && mimeType != "image/png" {
+		return nil, fmt.Errorf("файл %s не является изображением JPEG или PNG (определён как %s)", path, mimeType)
+	}
+	return &CoverImage{MimeType: mimeType, Data: data}, nil
+}
 
-	url := baseURL + fmt.Sprintf(userLikesTracksPath, userID)
-	resp, err := c.makeRequest("GET", url)
+// CoverSource выдаёт локальные обложки для -cover-file: один файл на все треки запуска
+// или папку с файлами {id альбома}.jpg. Источник из newAPICoverSource скачивает
+// обложки альбомов из API
+type CoverSource struct {
+	path   string
+	single *CoverImage        // Обложка для всех треков, если path — файл
+	client *YandexMusicClient // Клиент для обложек из API; nil — локальный источник
+
+	mu    sync.Mutex
+	cache map[string]*CoverImage // Обложки по ID альбома; nil — файла для альбома нет
+}
+
+// OpenCoverSource открывает файл или папку с обложками. Одиночный файл читается
+// и проверяется сразу, чтобы ошибка обнаружилась до начала скачивания
+func OpenCoverSource(path string) (*CoverSource, error) {
+	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	source := &CoverSource{path: path, cache: make(map[string]*CoverImage)}
+	if !info.IsDir() {
+		if source.single, err = loadCoverImage(path); err != nil {
+			return nil, err
+		}
 	}
+	return source, nil
+}
 
-	var response struct {
-		Result struct {
-			Library struct {
-				Tracks []struct {
-					ID      string `json:"id"`
-					AlbumID string `json:"albumId"`
-				} `json:"tracks"`
-			} `json:"library"`
-		} `json:"result"`
+// newAPICoverSource создаёт источник обложек альбомов из API. Каждая обложка
+// скачивается один раз на альбом
+func newAPICoverSource(client *YandexMusicClient) *CoverSource {
+	return &CoverSource{client: client, cache: make(map[string]*CoverImage)}
+}
+
+// ForTrack возвращает обложку для трека. Для папки ищется файл {id альбома}.jpg;
+// если его нет, возвращается nil без ошибки
+func (s *CoverSource) ForTrack(track Track) (*CoverImage, error) {
+	if s.single != nil {
+		return s.single, nil
 	}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	if len(track.Albums) == 0 {
+		return nil, nil
+	}
+	albumID := formatID(track.Albums[0].ID)
+	if albumID == "" {
+		return nil, nil
 	}
 
-	tracks := make([]TrackShort, 0, len(response.Result.Library.Tracks))
-	for _, trackRef := range response.Result.Library.Tracks {
-		// Получаем полную информацию о треке
-		track, err := c.getTrackByID(trackRef.ID)
-		if err != nil {
-			log.Printf("Ошибка получения трека %s: %v\n", trackRef.ID, err)
-			continue
-		}
-		tracks = append(tracks, TrackShort{
-			ID:    0, // Будет заполнено из track
-			Track: *track,
-		})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cover, ok := s.cache[albumID]; ok {
+		return cover, nil
 	}
 
-	return tracks, nil
-}
+	if s.client != nil {
+		return s.fetchAlbumCover(albumID, track)
+	}
 
-// getTrackByID получает полную информацию о треке по ID
-func (c *YandexMusicClient) getTrackByID(trackID string) (*Track, error) {
-	url := baseURL + fmt.Sprintf(trackPath, trackID)
-	resp, err := c.makeRequest("GET", url)
+	coverPath := filepath.Join(s.path, albumID+".jpg")
+	if _, err := os.Stat(coverPath); os.IsNotExist(err) {
+		s.cache[albumID] = nil
+		return nil, nil
+	}
+	cover, err := loadCoverImage(coverPath)
 	if err != nil {
+		// Запоминаем отсутствие обложки, чтобы не повторять ошибку на каждом треке альбома
+		s.cache[albumID] = nil
 		return nil, err
 	}
-	defer resp.Body.Close()
+	s.cache[albumID] = cover
+	return cover, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// fetchAlbumCover скачивает обложку альбома из API; вызывается под s.mu
+func (s *CoverSource) fetchAlbumCover(albumID string, track Track) (*CoverImage, error) {
+	url := coverURL(trackCoverURI(track), tagCoverSize)
+	if url == "" {
+		s.cache[albumID] = nil
+		return nil, nil
+	}
+	data, err := s.client.fetchCover(url)
 	if err != nil {
-		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+		s.cache[albumID] = nil
+		return nil, err
 	}
+	mimeType := http.DetectContentType(data)
+	if mimeType != "image/jpeg" && mimeType != "image/png" {
+		s.cache[albumID] = nil
+		return nil, fmt.Errorf("обложка не является изображением JPEG или PNG (определена как %s)", mimeType)
+	}
+	cover := &CoverImage{MimeType: mimeType, Data: data}
+	s.cache[albumID] = cover
+	return cover, nil
+}
 
-	var response struct {
-		Result []Track `json:"result"`
+// ListOptions содержит параметры команд просмотра треков
+type ListOptions struct {
+	Catalog     *Catalog    // SQLite-каталог для записи метаданных (nil — не используется)
+	Concurrency int         // Сколько ссылок на MP3 получать параллельно
+	Filter      TrackFilter // Условия отбора треков
+	MaxArtists  int         // Сколько исполнителей показывать, остальные — «и др.» (0 — всех)
+
+	OnlyDownloadable bool // Не выводить треки без ссылки на полный трек (ошибка или только превью)
+
+	AddedSince time.Time // Только треки, добавленные в плейлист не раньше (нулевое — все)
+
+	JSONProfile string // Форма объектов в -out=json: simple, detailed или array-artists
+
+	Shuffle     bool  // Перемешать треки перед выводом
+	ShuffleSeed int64 // Seed для -shuffle
+}
+
+// TrackFilter содержит условия отбора треков для команд просмотра и скачивания
+type TrackFilter struct {
+	MinDuration time.Duration // Минимальная длительность (0 — без ограничения)
+	MaxDuration time.Duration // Максимальная длительность (0 — без ограничения)
+
+	ExcludeIDs map[string]bool // ID треков, которые исключаются всегда (например, дизлайки)
+
+	KnownArtists *KnownArtists // Оставлять только треки этих исполнителей (nil — всех)
+}
+
+// Apply возвращает треки, прошедшие фильтр, и количество исключённых.
+// Треки с неизвестной длительностью по длительности не исключаются
+func (f TrackFilter) Apply(tracks []TrackShort) ([]TrackShort, int) {
+	if f.MinDuration == 0 && f.MaxDuration == 0 && len(f.ExcludeIDs) == 0 && f.KnownArtists == nil {
+		return tracks, 0
+	}
+
+	kept := make([]TrackShort, 0, len(tracks))
+	for _, trackShort := range tracks {
+		if f.ExcludeIDs[trackShort.Track.TrackID()] || f.ExcludeIDs[formatID(trackShort.Track.ID)] {
+			continue
+		}
+		if f.KnownArtists != nil && !f.KnownArtists.Matches(trackShort.Track) {
+			continue
+		}
+		duration := time.Duration(trackShort.Track.DurationMs) * time.Millisecond
+		if duration > 0 {
+			if f.MinDuration > 0 && duration < f.MinDuration {
+				continue
+			}
+			if f.MaxDuration > 0 && duration > f.MaxDuration {
+				continue
+			}
+		}
+		kept = append(kept, trackShort)
+	}
+	return kept, len(tracks) - len(kept)
+}
+
+// KnownArtists — список исполнителей из файла -known-artists: трек проходит фильтр,
+// если среди его исполнителей есть хотя бы один из списка
+type KnownArtists struct {
+	names map[string]bool // Имена, приведённые normalizeArtistName
+	ids   map[string]bool // ID исполнителей из ссылок вида music.yandex.ru/artist/{id}
+}
+
+// loadKnownArtists читает список исполнителей: по одному на строку, имя или ссылка на
+// страницу исполнителя. Пустые строки и строки, начинающиеся с #, пропускаются
+func loadKnownArtists(path string) (*KnownArtists, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	known := &KnownArtists{names: make(map[string]bool), ids: make(map[string]bool)}
+	for i, line := range strings.Split(strings.TrimPrefix(string(data), utf8BOM), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "/") {
+			ref, err := parseEntityRef(line)
+			if err == nil && ref.Type != entityArtist {
+				err = fmt.Errorf("ожидается ссылка на исполнителя")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("строка %d: %w", i+1, err)
+			}
+			known.ids[ref.ID] = true
+			continue
+		}
+		known.names[normalizeArtistName(line)] = true
+	}
+	if len(known.names)+len(known.ids) == 0 {
+		return nil, fmt.Errorf("в файле %s нет ни одного исполнителя", path)
+	}
+	return known, nil
+}
+
+// Matches сообщает, есть ли среди исполнителей трека хотя бы один из списка
+func (k *KnownArtists) Matches(track Track) bool {
+	for _, artist := range track.Artists {
+		if k.ids[formatID(artist.ID)] || k.names[normalizeArtistName(artist.Name)] {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeArtistName приводит имя исполнителя к виду для сравнения: без учёта регистра,
+// лишних пробелов и различия «ё» и «е»
+func normalizeArtistName(name string) string {
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	return strings.ReplaceAll(name, "ё", "е")
+}
+
+// AccountInfo представляет информацию об аккаунте
+type AccountInfo struct {
+	UserID      int64  `json:"uid"`
+	Login       string `json:"login"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// GetUserID возвращает UserID как строку
+func (a AccountInfo) GetUserID() string {
+	return fmt.Sprintf("%d", a.UserID)
+}
+
+// AccountStatus представляет информацию об аккаунте
+type AccountStatus struct {
+	Result struct {
+		Account AccountInfo `json:"account"`
+		Plus    struct {
+			HasPlus bool `json:"hasPlus"` // Есть ли активная подписка Плюс
+		} `json:"plus"`
+	} `json:"result"`
+}
+
+// freeAccountMaxBitrate — битрейт, выше которого -quality=max не выбирает варианты
+// для аккаунтов без подписки: более качественные им, как правило, недоступны
+const freeAccountMaxBitrate = 192
+
+// ClientOptions содержит параметры клиента API
+type ClientOptions struct {
+	Lang    string // Язык ответов API (например, ru или en)
+	Region  string // Регион локали (например, RU или KZ), дополняет язык
+	Bitrate int    // Предпочитаемый битрейт в кбит/с (0 — первый вариант из ответа API)
+
+	// MaxQuality выбирает лучший вариант, доступный аккаунту (-quality=max), вместо Bitrate;
+	// MaxBitrate ограничивает его для аккаунтов без подписки (0 — без ограничения).
+	// Заполняются через EnableMaxQuality
+	MaxQuality bool
+	MaxBitrate int
+
+	QueryParams map[string]string // Дополнительные query-параметры для всех запросов к API
+
+	// Заголовки запросов к API и к CDN с аудио задаются раздельно: CDN иногда
+	// отвечает 403 или ограничивает скорость по User-Agent, подходящему для API
+	UserAgent         string            // User-Agent запросов к API; пусто — defaultUserAgent
+	Headers           map[string]string // Заголовки всех запросов: к API и к CDN (-header)
+	APIHeaders        map[string]string // Дополнительные заголовки запросов к API
+	DownloadUserAgent string            // User-Agent скачивания аудио с CDN; пусто — defaultDownloadUserAgent
+	DownloadHeaders   map[string]string // Дополнительные заголовки скачивания аудио
+	RichTracks        bool              // Запрашивать полные данные треков (rich-tracks) в лайках; плейлисты запрашиваются с ними всегда
+
+	// TokenProvider вызывается, когда API отвечает 401, чтобы получить свежий токен;
+	// запрос повторяется один раз с новым токеном. nil — токен не обновляется
+	TokenProvider func() (string, error)
+
+	// DumpDir — папка, куда сохраняются сырые ответы API до разбора (для отладки).
+	// Пустая строка — ответы не сохраняются
+	DumpDir string
+
+	// Debug включает отладочный вывод в stderr: например, начало неожиданных ответов,
+	// которые не удалось разобрать
+	Debug bool
+
+	// Clock — источник времени для меток, которые ставит клиент, и для пауз перед
+	// повторами запросов. nil — системные часы
+	Clock Clock
+
+	// AllowPartial включает мягкий режим: элементы ответа, которые не удалось разобрать
+	// (например, отдельные треки плейлиста), пропускаются с предупреждением, а не
+	// прерывают всю команду
+	AllowPartial bool
+
+	// TLSConfig задаёт проверку TLS-сертификатов для всех запросов клиента
+	// (-insecure, -cacert). nil — стандартная проверка по системным корневым сертификатам
+	TLSConfig *tls.Config
+
+	// APIHosts — адреса API в порядке предпочтения: основной и запасные (-api-hosts).
+	// При ошибке соединения или ответе 5xx запрос повторяется на следующем адресе.
+	// Пусто — только baseURL
+	APIHosts []string
+
+	// Таймауты соединений. ConnectTimeout — установка TCP-соединения, TLSHandshakeTimeout —
+	// TLS-рукопожатие, ResponseHeaderTimeout — ожидание заголовков ответа после отправки
+	// запроса, Timeout — весь запрос вместе с чтением тела, включая скачивание аудио.
+	// 0 — без ограничения
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	Timeout               time.Duration
+
+	// PerHostConcurrency ограничивает число одновременных скачиваний аудио с одного
+	// хоста CDN, даже если общая параллельность выше. 0 — без ограничения
+	PerHostConcurrency int
+
+	// LikesConcurrency — сколько пачек треков лайков запрашивать одновременно при получении
+	// полных данных (0 — defaultLikesConcurrency)
+	LikesConcurrency int
+}
+
+// parseAPIHosts разбирает список адресов API через запятую, проверяя, что каждый —
+// абсолютный http(s) URL без query; завершающий слэш отбрасывается
+func parseAPIHosts(value string) ([]string, error) {
+	var hosts []string
+	for _, part := range strings.Split(value, ",") {
+		host := strings.TrimRight(strings.TrimSpace(part), "/")
+		if host == "" {
+			continue
+		}
+		u, err := url.Parse(host)
+		if err != nil {
+			return nil, fmt.Errorf("неверный адрес %q: %w", host, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("неверный адрес %q: ожидается вида https://api.music.yandex.net", host)
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("список адресов пуст")
+	}
+	return hosts, nil
+}
+
+// newTLSConfig собирает настройки TLS из флагов -insecure и -cacert.
+// Возвращает nil, если ни один из них не задан
+func newTLSConfig(insecure bool, caCertFile string) (*tls.Config, error) {
+	if !insecure && caCertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caCertFile != "" {
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения файла сертификатов: %w", err)
+		}
+		// Свой CA добавляется к системным, чтобы остальные сайты продолжали проверяться
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("в файле %s не найдено сертификатов в формате PEM", caCertFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// Clock абстрагирует время для клиента: через него берутся метки времени, которые клиент
+// ставит сам (имена файлов -dump-responses, время в обратной связи «Моей волны»,
+// отсчёт Retry-After), и выдерживаются паузы перед повторами запросов, чтобы их можно
+// было проверять с управляемыми часами, не засыпая по-настоящему. Таймауты соединений
+// задаёт http.Transport, а время в состоянии выгрузки и отчётах — системные часы
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// systemClock — реализация Clock на системных часах
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// User-Agent по умолчанию для запросов к API и для скачивания аудио с CDN
+const (
+	defaultUserAgent         = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36"
+	defaultDownloadUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+)
+
+// Таймауты соединений по умолчанию: соединение должно устанавливаться быстро, а общий
+// таймаут не задан, чтобы не обрывать скачивание больших файлов на медленном канале
+const (
+	defaultConnectTimeout        = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 60 * time.Second
+)
+
+// defaultPerHostConcurrency — сколько файлов по умолчанию скачивается одновременно
+// с одного хоста CDN
+const defaultPerHostConcurrency = 3
+
+// trackBatchSize — сколько треков запрашивается одним запросом /tracks
+const trackBatchSize = 100
+
+// defaultLikesConcurrency — сколько пачек треков лайков по умолчанию запрашивается одновременно
+const defaultLikesConcurrency = 4
+
+// hostLimiter ограничивает число одновременных соединений с каждым хостом
+type hostLimiter struct {
+	limit int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+// Acquire ждёт свободного места для хоста и возвращает функцию его освобождения.
+// Без ограничения (limit <= 0) сразу возвращает пустую функцию
+func (l *hostLimiter) Acquire(host string) func() {
+	if l == nil || l.limit <= 0 {
+		return func() {}
+	}
+	l.mu.Lock()
+	slot, ok := l.slots[host]
+	if !ok {
+		slot = make(chan struct{}, l.limit)
+		l.slots[host] = slot
+	}
+	l.mu.Unlock()
+
+	slot <- struct{}{}
+	return func() { <-slot }
+}
+
+// YandexMusicClient представляет клиент для работы с API Яндекс.Музыки
+type YandexMusicClient struct {
+	tokenMu sync.RWMutex
+	token   string
+	client  *http.Client
+	opts    ClientOptions
+	clock   Clock
+
+	trackCacheMu sync.Mutex
+	trackCache   map[string]*Track // Треки, уже полученные по ID в этом запуске
+	cacheStats   TrackCacheStats
+
+	dislikesMu sync.Mutex
+	dislikes   []string // ID дизлайкнутых треков; запрашиваются один раз за запуск
+
+	dumpSeq atomic.Int64 // Порядковый номер сохранённого ответа для имён файлов
+
+	hostIndex atomic.Int32 // Индекс адреса API из APIHosts, с которого начинаются запросы
+
+	throttle throttleCounters // События ограничения запросов для -stats
+
+	hosts *hostLimiter // Ограничение одновременных скачиваний с одного хоста CDN
+
+	transferred atomic.Int64 // Байт аудио, скачанных за запуск (для событий -events)
+
+	// Треков источника (лайков, плейлиста), пропущенных из-за ошибки получения или разбора.
+	// Такой трек по-прежнему в источнике, поэтому -prune при ненулевом счётчике не работает
+	droppedTracks atomic.Int64
+}
+
+// DroppedTracks возвращает, сколько треков источника пропущено за запуск из-за ошибки
+// получения данных или разбора ответа
+func (c *YandexMusicClient) DroppedTracks() int64 {
+	return c.droppedTracks.Load()
+}
+
+// throttleCounters считает события ограничения запросов и повторы; обновляется
+// из параллельных запросов, поэтому счётчики атомарные
+type throttleCounters struct {
+	throttled        atomic.Int64
+	captchas         atomic.Int64
+	retries          atomic.Int64
+	retriesSucceeded atomic.Int64
+	retriesGaveUp    atomic.Int64
+}
+
+// ThrottleStats содержит статистику ограничений запросов к API за запуск
+type ThrottleStats struct {
+	Throttled        int64 // Ответов 429 Too Many Requests
+	Captchas         int64 // Ответов с требованием пройти капчу
+	Retries          int64 // Повторных запросов: на другой адрес API, с обновлённым токеном, после 429/5xx, за свежей ссылкой на аудио
+	RetriesSucceeded int64 // Запросов, которые удались после повтора
+	RetriesGaveUp    int64 // Запросов, которые не удались и после всех повторов
+}
+
+// ThrottleStats возвращает статистику ограничений запросов за текущий запуск
+func (c *YandexMusicClient) ThrottleStats() ThrottleStats {
+	return ThrottleStats{
+		Throttled:        c.throttle.throttled.Load(),
+		Captchas:         c.throttle.captchas.Load(),
+		Retries:          c.throttle.retries.Load(),
+		RetriesSucceeded: c.throttle.retriesSucceeded.Load(),
+		RetriesGaveUp:    c.throttle.retriesGaveUp.Load(),
+	}
+}
+
+// recordRetryOutcome учитывает итог запроса, для которого понадобились повторы
+func (c *YandexMusicClient) recordRetryOutcome(retried bool, ok bool) {
+	if !retried {
+		return
+	}
+	if ok {
+		c.throttle.retriesSucceeded.Add(1)
+	} else {
+		c.throttle.retriesGaveUp.Add(1)
+	}
+}
+
+// NewClient создает новый клиент Яндекс.Музыки
+func NewClient(token string, opts ClientOptions) *YandexMusicClient {
+	clock := opts.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   opts.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	if opts.TLSConfig != nil {
+		transport.TLSClientConfig = opts.TLSConfig
+	}
+	httpClient := &http.Client{Transport: transport, Timeout: opts.Timeout}
+	return &YandexMusicClient{
+		token:  token,
+		client: httpClient,
+		opts:   opts,
+		clock:  clock,
+
+		trackCache: make(map[string]*Track),
+		hosts:      newHostLimiter(opts.PerHostConcurrency),
+	}
+}
+
+// TransferredBytes возвращает, сколько байт аудио скачано за запуск, включая недокачанные файлы
+func (c *YandexMusicClient) TransferredBytes() int64 {
+	return c.transferred.Load()
+}
+
+// TrackCacheStats содержит статистику кэша треков клиента
+type TrackCacheStats struct {
+	Hits   int // Треки, взятые из кэша
+	Misses int // Треки, загруженные из API
+}
+
+// TrackCacheStats возвращает статистику кэша треков за текущий запуск
+func (c *YandexMusicClient) TrackCacheStats() TrackCacheStats {
+	c.trackCacheMu.Lock()
+	defer c.trackCacheMu.Unlock()
+	return c.cacheStats
+}
+
+// makeRequest выполняет HTTP запрос к API
+func (c *YandexMusicClient) makeRequest(method, url string) (*http.Response, error) {
+	return c.makeRequestWithParams(method, url, nil)
+}
+
+// makeRequestWithParams выполняет HTTP запрос к API с дополнительными query-параметрами.
+// Параметры из ClientOptions.QueryParams добавляются ко всем запросам и имеют приоритет
+//
+// Ошибки содержат метод и путь запроса (без query-параметров и токена), чтобы было
+// видно, какой из нескольких запросов команды не удался
+func (c *YandexMusicClient) makeRequestWithParams(method, rawURL string, params map[string]string) (*http.Response, error) {
+	return c.makeRequestWithBody(method, rawURL, params, nil)
+}
+
+// postJSON выполняет POST-запрос к API с телом payload в формате JSON
+func (c *YandexMusicClient) postJSON(rawURL string, params map[string]string, payload interface{}) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка формирования запроса: %w", err)
+	}
+	return c.makeRequestWithBody("POST", rawURL, params, body)
+}
+
+// makeRequestWithBody выполняет запрос к API как makeRequestWithParams, с телом body
+// (nil — без тела). Тело передаётся срезом, чтобы его можно было отправить повторно
+// при обновлении токена и переключении адреса API
+func (c *YandexMusicClient) makeRequestWithBody(method, rawURL string, params map[string]string, body []byte) (*http.Response, error) {
+	endpoint := requestEndpoint(method, rawURL)
+	if len(params) > 0 || len(c.opts.QueryParams) > 0 {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка разбора URL: %w", err)
+		}
+		query := u.Query()
+		for key, value := range params {
+			query.Set(key, value)
+		}
+		for key, value := range c.opts.QueryParams {
+			query.Set(key, value)
+		}
+		u.RawQuery = query.Encode()
+		rawURL = u.String()
+	}
+
+	resp, err := c.doRequestWithFailover(method, rawURL, body)
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			apiErr.Endpoint = endpoint
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %w", endpoint, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if isCaptchaResponse(resp.StatusCode, body) {
+			c.throttle.captchas.Add(1)
+		}
+		return nil, &APIError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+			Endpoint:   endpoint,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), c.clock.Now()),
+		}
+	}
+
+	return resp, nil
+}
+
+// apiErrorResponse — тело ответа API с ошибкой. Поле error бывает строкой или объектом
+// с именем ошибки; ответ с капчей может указывать её в поле type
+type apiErrorResponse struct {
+	Type  string          `json:"type"`
+	Error json.RawMessage `json:"error"`
+}
+
+// isCaptchaResponse сообщает, требует ли ответ с кодом statusCode пройти капчу. Капчу
+// API возвращает только с кодами 403 и 429, а её признак — имя ошибки или тип ответа
+// "captcha" в JSON; слово "captcha" в других местах ответа (например, в названии трека
+// или в тексте ошибки) капчей не считается
+func isCaptchaResponse(statusCode int, body []byte) bool {
+	if statusCode != http.StatusForbidden && statusCode != http.StatusTooManyRequests {
+		return false
 	}
+	var response apiErrorResponse
 	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+		return false
+	}
+	if strings.EqualFold(response.Type, "captcha") {
+		return true
+	}
+	var name string
+	if err := json.Unmarshal(response.Error, &name); err != nil {
+		var object struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(response.Error, &object); err != nil {
+			return false
+		}
+		name = object.Name
 	}
+	return strings.EqualFold(name, "captcha")
+}
 
-	if len(response.Result) == 0 {
-		return nil, fmt.Errorf("трек не найден")
+// parseRetryAfter разбирает заголовок Retry-After: число секунд или HTTP-дату.
+// Пустое или неразборчивое значение и дата в прошлом дают 0
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
 	}
+	return 0
+}
 
-	return &response.Result[0], nil
+// Повторы запроса пачки треков, когда API ограничивает частоту (429) или перегружен (5xx)
+const (
+	batchRetryAttempts = 3                // Сколько раз повторять запрос пачки
+	batchRetryBase     = 2 * time.Second  // Задержка перед первым повтором без Retry-After, дальше удваивается
+	batchRetryMaxDelay = 60 * time.Second // Если сервер просит ждать дольше, пачка не повторяется
+)
+
+// throttleRetryDelay сообщает, стоит ли повторить запрос после ошибки err, и через сколько.
+// Повторяются только ответы 429 и 5xx: задержка берётся из Retry-After, а без него
+// растёт вдвое с каждой попыткой
+func throttleRetryDelay(err error, attempt int) (time.Duration, bool) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	if apiErr.StatusCode != http.StatusTooManyRequests && apiErr.StatusCode < http.StatusInternalServerError {
+		return 0, false
+	}
+	delay := apiErr.RetryAfter
+	if delay == 0 {
+		delay = batchRetryBase << attempt
+	}
+	if delay > batchRetryMaxDelay {
+		return 0, false
+	}
+	return delay, true
 }
 
-// GetAlbumTracks получает список треков альбома
-func (c *YandexMusicClient) GetAlbumTracks(playlistID string) ([]Track, error) {
-	url := baseURL + fmt.Sprintf(albumTracksPath, playlistID)
-	resp, err := c.makeRequest("GET", url)
+// requestEndpoint возвращает метод и путь запроса для сообщений об ошибках, например
+// "GET /users/123/playlists/3". Хост и query-параметры отбрасываются
+func requestEndpoint(method, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return method
+	}
+	return method + " " + u.Path
+}
+
+// apiHosts возвращает адреса API в порядке предпочтения
+func (c *YandexMusicClient) apiHosts() []string {
+	if len(c.opts.APIHosts) == 0 {
+		return []string{baseURL}
+	}
+	return c.opts.APIHosts
+}
+
+// doRequestWithFailover выполняет запрос к API, переходя к следующему адресу из APIHosts
+// при ошибке соединения или ответе 5xx. Адрес, который ответил, запоминается, и
+// следующие запросы начинаются с него, чтобы не тратить время на недоступный хост.
+// URL, построенные не от baseURL, запрашиваются как есть
+func (c *YandexMusicClient) doRequestWithFailover(method, rawURL string, body []byte) (*http.Response, error) {
+	hosts := c.apiHosts()
+	if !strings.HasPrefix(rawURL, baseURL) || len(hosts) == 1 && hosts[0] == baseURL {
+		return c.doRequestWithRefresh(method, rawURL, body)
+	}
+	path := strings.TrimPrefix(rawURL, baseURL)
+
+	start := int(c.hostIndex.Load())
+	var resp *http.Response
+	var err error
+	for n := 0; n < len(hosts); n++ {
+		index := (start + n) % len(hosts)
+		if n > 0 {
+			c.throttle.retries.Add(1)
+		}
+		resp, err = c.doRequestWithRefresh(method, hosts[index]+path, body)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			c.hostIndex.Store(int32(index))
+			c.recordRetryOutcome(n > 0, true)
+			return resp, nil
+		}
+		if n == len(hosts)-1 {
+			c.recordRetryOutcome(n > 0, false)
+			break
+		}
+
+		next := hosts[(index+1)%len(hosts)]
+		if err != nil {
+			log.Printf("Предупреждение: адрес API %s недоступен (%v), пробуем %s", hosts[index], err, next)
+		} else {
+			log.Printf("Предупреждение: адрес API %s ответил %s, пробуем %s", hosts[index], resp.Status, next)
+			resp.Body.Close()
+		}
+	}
+	return resp, err
+}
+
+// doRequestWithRefresh выполняет запрос к API; если токен истёк (401), получает
+// свежий через TokenProvider и повторяет запрос один раз
+func (c *YandexMusicClient) doRequestWithRefresh(method, rawURL string, body []byte) (*http.Response, error) {
+	resp, err := c.doRequest(method, rawURL, body)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized && c.opts.TokenProvider != nil {
+		resp.Body.Close()
+		if err := c.refreshToken(); err != nil {
+			return nil, fmt.Errorf("%w: %w", &APIError{StatusCode: http.StatusUnauthorized}, err)
+		}
+		c.throttle.retries.Add(1)
+		resp, err = c.doRequest(method, rawURL, body)
+		c.recordRetryOutcome(true, err == nil && resp.StatusCode == http.StatusOK)
+		return resp, err
+	}
+	return resp, nil
+}
+
+// doRequest создает и выполняет запрос к API со стандартными заголовками
+func (c *YandexMusicClient) doRequest(method, rawURL string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, reader)
 	if err != nil {
-		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+		return nil, fmt.Errorf("ошибка создания запроса: %w", err)
+	}
+
+	c.setHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка выполнения запроса: %w", err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.throttle.throttled.Add(1)
+	}
+	if err := c.dumpResponse(req, resp); err != nil {
+		log.Printf("Предупреждение: не удалось сохранить ответ API: %v", err)
+	}
+	return resp, nil
+}
+
+// dumpResponse сохраняет сырое тело ответа API в папку DumpDir, не меняя его для дальнейшего разбора.
+// Рядом с телом ({имя}.json или {имя}.xml) пишется {имя}.meta с запросом, статусом и заголовками,
+// в которых значение Authorization скрыто
+func (c *YandexMusicClient) dumpResponse(req *http.Request, resp *http.Response) error {
+	if c.opts.DumpDir == "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// Возвращаем прочитанное тело в ответ, чтобы вызывающий код разобрал его как обычно
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	if err := os.MkdirAll(c.opts.DumpDir, 0755); err != nil {
+		return fmt.Errorf("ошибка создания папки: %w", err)
+	}
+
+	// Имя: {время}-{номер}-{путь запроса}, например 20240131-150405.123-0001-users_123_playlists_list
+	name := strings.Trim(strings.ReplaceAll(req.URL.Path, "/", "_"), "_")
+	name = fmt.Sprintf("%s-%04d-%s", c.clock.Now().Format("20060102-150405.000"), c.dumpSeq.Add(1), sanitizeFileName(name))
+	ext := ".json"
+	if strings.Contains(resp.Header.Get("Content-Type"), "xml") {
+		ext = ".xml"
+	}
+
+	var meta strings.Builder
+	fmt.Fprintf(&meta, "%s %s\n", req.Method, req.URL.String())
+	for _, key := range sortedHeaderKeys(req.Header) {
+		value := strings.Join(req.Header[key], ", ")
+		if strings.EqualFold(key, "Authorization") {
+			value = "[скрыто]"
+		}
+		fmt.Fprintf(&meta, "%s: %s\n", key, value)
+	}
+	fmt.Fprintf(&meta, "\n%s\n", resp.Status)
+	for _, key := range sortedHeaderKeys(resp.Header) {
+		fmt.Fprintf(&meta, "%s: %s\n", key, strings.Join(resp.Header[key], ", "))
+	}
+
+	if err := os.WriteFile(filepath.Join(c.opts.DumpDir, name+ext), body, 0644); err != nil {
+		return fmt.Errorf("ошибка записи файла: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(c.opts.DumpDir, name+".meta"), []byte(meta.String()), 0644); err != nil {
+		return fmt.Errorf("ошибка записи файла: %w", err)
+	}
+	return nil
+}
+
+// sortedHeaderKeys возвращает имена заголовков в алфавитном порядке
+func sortedHeaderKeys(header http.Header) []string {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// currentToken возвращает текущий токен доступа
+func (c *YandexMusicClient) currentToken() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.token
+}
+
+// refreshToken получает свежий токен через TokenProvider
+func (c *YandexMusicClient) refreshToken() error {
+	token, err := c.opts.TokenProvider()
+	if err != nil {
+		return fmt.Errorf("ошибка обновления токена: %w", err)
+	}
+	if token == "" {
+		return fmt.Errorf("ошибка обновления токена: получен пустой токен")
+	}
+
+	c.tokenMu.Lock()
+	c.token = token
+	c.tokenMu.Unlock()
+	return nil
+}
+
+// setHeaders устанавливает стандартные заголовки для запросов
+func (c *YandexMusicClient) setHeaders(req *http.Request) {
+	req.Header.Set("Authorization", "OAuth "+c.currentToken())
+	userAgent := c.opts.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if locale := c.locale(); locale != "" {
+		req.Header.Set("Accept-Language", locale)
+	}
+	for key, value := range c.opts.Headers {
+		req.Header.Set(key, value)
+	}
+	for key, value := range c.opts.APIHeaders {
+		req.Header.Set(key, value)
+	}
+}
+
+// debugf выводит отладочное сообщение в stderr, если включён режим -debug
+func (c *YandexMusicClient) debugf(format string, args ...interface{}) {
+	if c.opts.Debug {
+		log.Printf("[debug] "+format, args...)
+	}
+}
+
+// debugSnippetLength — сколько байт тела ответа показывается в отладочном выводе
+const debugSnippetLength = 512
+
+// bodySnippet возвращает начало тела ответа для отладочного вывода
+func bodySnippet(body []byte) string {
+	if len(body) > debugSnippetLength {
+		return string(body[:debugSnippetLength]) + "…"
+	}
+	return string(body)
+}
+
+// downloadHeaders возвращает заголовки для скачивания аудио с CDN
+func (c *YandexMusicClient) downloadHeaders() http.Header {
+	header := http.Header{}
+	header.Set("Authorization", "OAuth "+c.currentToken())
+	userAgent := c.opts.DownloadUserAgent
+	if userAgent == "" {
+		userAgent = defaultDownloadUserAgent
+	}
+	header.Set("User-Agent", userAgent)
+	for key, value := range c.opts.Headers {
+		header.Set(key, value)
+	}
+	for key, value := range c.opts.DownloadHeaders {
+		header.Set(key, value)
+	}
+	return header
+}
+
+// locale возвращает локаль для заголовка Accept-Language в виде язык-РЕГИОН
+func (c *YandexMusicClient) locale() string {
+	lang := strings.ToLower(c.opts.Lang)
+	region := strings.ToUpper(c.opts.Region)
+	switch {
+	case lang != "" && region != "":
+		return lang + "-" + region
+	case lang != "":
+		return lang
+	case region != "":
+		// Без явного языка используем русский, как у приложения по умолчанию
+		return "ru-" + region
+	}
+	return ""
+}
+
+// GetAccountStatus получает информацию о текущем пользователе
+func (c *YandexMusicClient) GetAccountStatus() (*AccountStatus, error) {
+	url := baseURL + accountStatusPath
+	resp, err := c.makeRequest("GET", url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var status AccountStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	return &status, nil
+}
+
+// GetUserPlaylists получает список плейлистов пользователя
+func (c *YandexMusicClient) GetUserPlaylists(userID string) ([]Playlist, error) {
+	// Если userID пустой или "me", получаем userId из account/status
+	if userID == "" || userID == "me" {
+		account, err := c.GetAccountStatus()
+		if err != nil {
+			return nil, fmt.Errorf("не удалось получить userId пользователя: %w", err)
+		}
+		userID = account.Result.Account.GetUserID()
+		if userID == "" {
+			return nil, fmt.Errorf("userId пользователя пустой")
+		}
+	}
+	url := baseURL + fmt.Sprintf(userPlaylistsListPath, userID)
+	resp, err := c.makeRequest("GET", url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	// Плейлисты разбираются по одному: один проблемный плейлист не должен
+	// ломать весь список (и поиск плейлиста по UUID)
+	var response struct {
+		Result []json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	return decodeEach[Playlist](response.Result, "плейлист", true)
+}
+
+// decodeEach разбирает элементы JSON-массива по одному. Если элемент не разбирается,
+// при skipBroken он пропускается с предупреждением, иначе возвращается ошибка
+func decodeEach[T any](items []json.RawMessage, what string, skipBroken bool) ([]T, error) {
+	result := make([]T, 0, len(items))
+	for i, raw := range items {
+		var item T
+		if err := json.Unmarshal(raw, &item); err != nil {
+			if !skipBroken {
+				return nil, fmt.Errorf("ошибка декодирования элемента %d (%s): %w", i+1, what, err)
+			}
+			log.Printf("Предупреждение: пропущен %s №%d, который не удалось разобрать: %v\n", what, i+1, err)
+			continue
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// likedTrackIDs получает ID лайкнутых треков пользователя
+func (c *YandexMusicClient) likedTrackIDs(userID string) ([]string, error) {
+	ids, _, err := c.likedTrackIDsWithRevision(userID)
+	return ids, err
+}
+
+// likedTrackIDsWithRevision возвращает ID лайкнутых треков и ревизию списка лайков
+func (c *YandexMusicClient) likedTrackIDsWithRevision(userID string) ([]string, int, error) {
+	// Если userID пустой или "me", получаем userId из account/status
+	if userID == "" || userID == "me" {
+		account, err := c.GetAccountStatus()
+		if err != nil {
+			return nil, 0, fmt.Errorf("не удалось получить userId пользователя: %w", err)
+		}
+		userID = account.Result.Account.GetUserID()
+		if userID == "" {
+			return nil, 0, fmt.Errorf("userId пользователя пустой")
+		}
+	}
+
+	url := baseURL + fmt.Sprintf(userLikesTracksPath, userID)
+	resp, err := c.makeRequestWithParams("GET", url, c.richTracksParams())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result struct {
+			Library struct {
+				Revision int `json:"revision"`
+				Tracks   []struct {
+					ID      string `json:"id"`
+					AlbumID string `json:"albumId"`
+				} `json:"tracks"`
+			} `json:"library"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, 0, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	ids := make([]string, 0, len(response.Result.Library.Tracks))
+	for _, trackRef := range response.Result.Library.Tracks {
+		ids = append(ids, trackRef.ID)
+	}
+	return ids, response.Result.Library.Revision, nil
+}
+
+// GetLikedTracks получает список избранных треков (лайков) пользователя
+func (c *YandexMusicClient) GetLikedTracks(userID string) ([]TrackShort, error) {
+	tracks := []TrackShort{}
+	err := c.walkLikedTracks(userID, func(track Track) error {
+		tracks = append(tracks, TrackShort{
+			ID:    0, // Будет заполнено из track
+			Track: track,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tracks, nil
+}
+
+// ErrStopWalk можно вернуть из функции обхода WalkLikedTracks и WalkPlaylistTracks,
+// чтобы остановить обход без ошибки
+var ErrStopWalk = errors.New("обход остановлен")
+
+// WalkLikedTracks передаёт лайкнутые треки текущего пользователя в fn по одному,
+// по мере получения полных данных, не собирая их в срез. Если fn возвращает ошибку,
+// обход останавливается и ошибка возвращается (ErrStopWalk — останавливает без ошибки)
+func (c *YandexMusicClient) WalkLikedTracks(fn func(Track) error) error {
+	return c.walkLikedTracks("", fn)
+}
+
+func (c *YandexMusicClient) walkLikedTracks(userID string, fn func(Track) error) error {
+	ids, err := c.likedTrackIDs(userID)
+	if err != nil {
+		return err
+	}
+	return c.walkTrackIDs(ids, fn)
+}
+
+// walkTrackIDs получает полные данные треков по ids и передаёт их в fn в порядке ids
+func (c *YandexMusicClient) walkTrackIDs(ids []string, fn func(Track) error) error {
+	// Полные данные запрашиваются пачками по trackBatchSize, до LikesConcurrency пачек
+	// одновременно. Пачки обрабатываются окнами, чтобы треки передавались в fn в порядке
+	// лайков и остановка обхода не запрашивала лишнего
+	workers := c.opts.LikesConcurrency
+	if workers < 1 {
+		workers = defaultLikesConcurrency
+	}
+	var batches [][]string
+	for start := 0; start < len(ids); start += trackBatchSize {
+		batches = append(batches, ids[start:min(start+trackBatchSize, len(ids))])
+	}
+	for start := 0; start < len(batches); start += workers {
+		window := batches[start:min(start+workers, len(batches))]
+		resolved := make([][]*Track, len(window))
+		errs := make([]error, len(window))
+		forEachConcurrently(len(window), workers, func(i int) {
+			resolved[i], errs[i] = c.resolveTrackBatch(window[i])
+		})
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+		for _, tracks := range resolved {
+			for _, track := range tracks {
+				if err := fn(*track); err != nil {
+					if errors.Is(err, ErrStopWalk) {
+						return nil
+					}
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// resolveTrackBatch получает полные данные треков пачки в порядке ids. Треки, которых
+// нет в ответе, и все треки пачки, если ответ не разобрался, запрашиваются по одному;
+// ненайденные треки пропускаются с сообщением. Когда API ограничивает частоту (429) или
+// перегружен (5xx), запрос пачки повторяется с задержкой (см. throttleRetryDelay), а не
+// заменяется сотней одиночных запросов; если повторы не помогли, возвращается ошибка
+func (c *YandexMusicClient) resolveTrackBatch(ids []string) ([]*Track, error) {
+	tracks, err := c.getTracksByIDs(ids)
+	attempt := 0
+	for ; err != nil && attempt < batchRetryAttempts; attempt++ {
+		delay, ok := throttleRetryDelay(err, attempt)
+		if !ok {
+			break
+		}
+		log.Printf("Предупреждение: запрос пачки из %d треков не удался (%v), повтор через %s\n", len(ids), err, delay)
+		c.clock.Sleep(delay)
+		c.throttle.retries.Add(1)
+		tracks, err = c.getTracksByIDs(ids)
+	}
+	c.recordRetryOutcome(attempt > 0, err == nil)
+	if err != nil {
+		if !errors.Is(err, ErrResponseDecode) {
+			return nil, fmt.Errorf("не удалось получить пачку из %d треков: %w", len(ids), err)
+		}
+		log.Printf("Ошибка разбора пачки из %d треков, треки будут запрошены по одному: %v\n", len(ids), err)
+		tracks = nil
+	}
+	result := make([]*Track, 0, len(ids))
+	for i, id := range ids {
+		if tracks != nil && tracks[i] != nil {
+			result = append(result, tracks[i])
+			continue
+		}
+		track, err := c.getTrackByID(id)
+		if err != nil {
+			log.Printf("Ошибка получения трека %s: %v\n", id, err)
+			c.droppedTracks.Add(1)
+			continue
+		}
+		result = append(result, track)
+	}
+	return result, nil
+}
+
+// ErrResponseDecode оборачивает ошибку разбора ответа API, после которой имеет смысл
+// запросить те же данные по частям
+var ErrResponseDecode = errors.New("ошибка декодирования ответа")
+
+// getTracksByIDs получает полные данные нескольких треков одним запросом. Результат идёт
+// в порядке ids; треков, которых нет в ответе, на их месте nil. Треки из кэша не запрашиваются
+func (c *YandexMusicClient) getTracksByIDs(ids []string) ([]*Track, error) {
+	result := make([]*Track, len(ids))
+	var missing []string
+	c.trackCacheMu.Lock()
+	for i, id := range ids {
+		if track, ok := c.trackCache[id]; ok {
+			c.cacheStats.Hits++
+			copied := *track
+			result[i] = &copied
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	c.trackCacheMu.Unlock()
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	url := baseURL + tracksPath
+	resp, err := c.makeRequestWithParams("GET", url, map[string]string{"track-ids": strings.Join(missing, ",")})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result []Track `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrResponseDecode, err)
+	}
+
+	// Лайки могут ссылаться на трек в виде "id:albumId", а API возвращает только id
+	byID := make(map[string]*Track, len(response.Result))
+	for i := range response.Result {
+		track := &response.Result[i]
+		byID[formatID(track.ID)] = track
+	}
+	c.trackCacheMu.Lock()
+	defer c.trackCacheMu.Unlock()
+	for i, id := range ids {
+		if result[i] != nil {
+			continue
+		}
+		track, ok := byID[id]
+		if !ok {
+			track, ok = byID[strings.SplitN(id, ":", 2)[0]]
+		}
+		if !ok {
+			continue
+		}
+		c.trackCache[id] = track
+		c.cacheStats.Misses++
+		copied := *track
+		result[i] = &copied
+	}
+	return result, nil
+}
+
+// WalkPlaylistTracks передаёт треки плейлиста в fn по одному. Плейлист запрашивается
+// одним запросом с полными данными треков; остановка обхода — как в WalkLikedTracks
+func (c *YandexMusicClient) WalkPlaylistTracks(playlistID string, fn func(Track) error) error {
+	playlist, err := c.GetPlaylist(playlistID)
+	if err != nil {
+		return err
+	}
+	for _, trackShort := range playlist.Tracks {
+		if err := fn(trackShort.Track); err != nil {
+			if errors.Is(err, ErrStopWalk) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// StationBatch представляет очередную порцию треков радиостанции
+type StationBatch struct {
+	BatchID string  // ID порции, передаётся в обратную связь по её трекам
+	Tracks  []Track // Треки в порядке воспроизведения
+}
+
+// GetStationTracks получает следующую порцию треков станции. queue — ID последнего
+// полученного трека (пусто для первой порции): по нему станция продолжает последовательность
+func (c *YandexMusicClient) GetStationTracks(station string, queue string) (*StationBatch, error) {
+	params := map[string]string{"settings2": "true"}
+	if queue != "" {
+		params["queue"] = queue
+	}
+	url := baseURL + fmt.Sprintf(stationTracksPath, station)
+	resp, err := c.makeRequestWithParams("GET", url, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result struct {
+			BatchID  string `json:"batchId"`
+			Sequence []struct {
+				Track *Track `json:"track"`
+			} `json:"sequence"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	batch := &StationBatch{BatchID: response.Result.BatchID}
+	for _, item := range response.Result.Sequence {
+		if item.Track != nil {
+			batch.Tracks = append(batch.Tracks, *item.Track)
+		}
+	}
+	return batch, nil
+}
+
+// StationFeedback представляет событие обратной связи станции: radioStarted, trackStarted,
+// trackFinished или skip. По нему станция понимает, что порция прослушана, и выдаёт следующую
+type StationFeedback struct {
+	Type               string  `json:"type"`
+	Timestamp          float64 `json:"timestamp"` // Время события в секундах Unix
+	From               string  `json:"from,omitempty"`
+	TrackID            string  `json:"trackId,omitempty"` // В виде "{id трека}:{id альбома}"
+	TotalPlayedSeconds float64 `json:"totalPlayedSeconds,omitempty"`
+}
+
+// SendStationFeedback отправляет станции событие обратной связи по порции batchID
+func (c *YandexMusicClient) SendStationFeedback(station string, batchID string, feedback StationFeedback) error {
+	if feedback.Timestamp == 0 {
+		feedback.Timestamp = float64(c.clock.Now().UnixMilli()) / 1000
+	}
+	var params map[string]string
+	if batchID != "" {
+		params = map[string]string{"batch-id": batchID}
+	}
+	url := baseURL + fmt.Sprintf(stationFeedbackPath, station)
+	resp, err := c.postJSON(url, params, feedback)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// stationTrackID возвращает ID трека для обратной связи станции: "{id трека}:{id альбома}"
+func stationTrackID(track Track) string {
+	if len(track.Albums) == 0 {
+		return track.TrackID()
+	}
+	return track.TrackID() + ":" + formatID(track.Albums[0].ID)
+}
+
+// GetWaveTracks получает следующие count треков «Моей волны». Станция выдаёт треки
+// порциями и переходит к следующей, только получив обратную связь, поэтому по каждому
+// треку отправляются события trackStarted и trackFinished — как если бы он был прослушан
+// целиком. Повторы пропускаются; если станция перестала выдавать новые треки, возвращается
+// столько, сколько набралось
+func (c *YandexMusicClient) GetWaveTracks(count int) ([]Track, error) {
+	var tracks []Track
+	seen := make(map[string]bool)
+	queue := ""
+	started := false
+	for len(tracks) < count {
+		batch, err := c.GetStationTracks(myWaveStation, queue)
+		if err != nil {
+			return tracks, err
+		}
+		if !started {
+			if err := c.SendStationFeedback(myWaveStation, batch.BatchID, StationFeedback{Type: "radioStarted", From: "desktop_win-home-playlist_of_the_day-playlist-default"}); err != nil {
+				return tracks, fmt.Errorf("ошибка запуска станции: %w", err)
+			}
+			started = true
+		}
+
+		added := 0
+		for _, track := range batch.Tracks {
+			if len(tracks) >= count {
+				break
+			}
+			id := track.TrackID()
+			queue = id
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			tracks = append(tracks, track)
+			added++
+
+			trackID := stationTrackID(track)
+			if err := c.SendStationFeedback(myWaveStation, batch.BatchID, StationFeedback{Type: "trackStarted", TrackID: trackID}); err != nil {
+				return tracks, fmt.Errorf("ошибка обратной связи станции: %w", err)
+			}
+			played := float64(track.DurationMs) / 1000
+			if err := c.SendStationFeedback(myWaveStation, batch.BatchID, StationFeedback{Type: "trackFinished", TrackID: trackID, TotalPlayedSeconds: played}); err != nil {
+				return tracks, fmt.Errorf("ошибка обратной связи станции: %w", err)
+			}
+		}
+		if added == 0 {
+			break
+		}
+	}
+	return tracks, nil
+}
+
+// HistoryEntry представляет прослушанный трек из истории
+type HistoryEntry struct {
+	PlayedOn string `json:"playedOn"`          // День прослушивания (YYYY-MM-DD) — API группирует историю по дням
+	Context  string `json:"context,omitempty"` // Откуда слушали: тип и ID контекста, например "playlist:1000"
+	Track    Track  `json:"track"`
+}
+
+// GetPlayHistory получает историю прослушиваний, от новых к старым. API отдаёт её целиком,
+// сгруппированной по дням, без постраничной выдачи; limit ограничивает число треков
+// (0 — все). Полные данные треков, которых нет в ответе, запрашиваются пачками
+func (c *YandexMusicClient) GetPlayHistory(limit int) ([]HistoryEntry, error) {
+	var params map[string]string
+	if limit > 0 {
+		params = map[string]string{"fullModelsCount": strconv.Itoa(limit)}
+	}
+	url := baseURL + musicHistoryPath
+	resp, err := c.makeRequestWithParams("GET", url, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result struct {
+			HistoryTabs []struct {
+				Date  string `json:"date"`
+				Items []struct {
+					Context struct {
+						Type string      `json:"type"`
+						ID   interface{} `json:"id"`
+					} `json:"context"`
+					Tracks []struct {
+						Type string `json:"type"`
+						Data struct {
+							ItemID struct {
+								TrackID string `json:"trackId"`
+								AlbumID string `json:"albumId"`
+							} `json:"itemId"`
+							FullModel *Track `json:"fullModel"`
+						} `json:"data"`
+					} `json:"tracks"`
+				} `json:"items"`
+			} `json:"historyTabs"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	// Треки без fullModel пока остаются пустыми: их ID собираются в missing и
+	// запрашиваются пачками после разбора всей истории
+	entries := []HistoryEntry{}
+	missing := make(map[int]string)
+	var missingIDs []string
+collect:
+	for _, tab := range response.Result.HistoryTabs {
+		for _, item := range tab.Items {
+			context := ""
+			if item.Context.Type != "" {
+				context = item.Context.Type
+				if id := formatID(item.Context.ID); id != "" {
+					context += ":" + id
+				}
+			}
+			for _, historyTrack := range item.Tracks {
+				if limit > 0 && len(entries) >= limit {
+					break collect
+				}
+				if historyTrack.Type != "" && historyTrack.Type != "track" {
+					continue
+				}
+				entry := HistoryEntry{PlayedOn: tab.Date, Context: context}
+				if track := historyTrack.Data.FullModel; track != nil {
+					entry.Track = *track
+				} else {
+					trackID := historyTrack.Data.ItemID.TrackID
+					if trackID == "" {
+						continue
+					}
+					missing[len(entries)] = trackID
+					missingIDs = append(missingIDs, trackID)
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return entries, nil
+	}
+
+	resolved := make(map[string]*Track, len(missingIDs))
+	for start := 0; start < len(missingIDs); start += trackBatchSize {
+		tracks, err := c.resolveTrackBatch(missingIDs[start:min(start+trackBatchSize, len(missingIDs))])
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range tracks {
+			resolved[formatID(track.ID)] = track
+		}
+	}
+	kept := entries[:0]
+	for i, entry := range entries {
+		if trackID, ok := missing[i]; ok {
+			// История может ссылаться на трек в виде "id:albumId", а API возвращает только id
+			track := resolved[trackID]
+			if track == nil {
+				track = resolved[strings.SplitN(trackID, ":", 2)[0]]
+			}
+			if track == nil {
+				if !c.opts.AllowPartial {
+					return nil, fmt.Errorf("ошибка получения трека %s из истории", trackID)
+				}
+				log.Printf("Предупреждение: трек %s из истории пропущен\n", trackID)
+				continue
+			}
+			entry.Track = *track
+		}
+		kept = append(kept, entry)
+	}
+	return kept, nil
+}
+
+// GetDislikedTracks получает ID треков, отмеченных пользователем как «не нравится».
+// Список запрашивается один раз за запуск, повторные вызовы берут его из кэша
+func (c *YandexMusicClient) GetDislikedTracks() ([]string, error) {
+	c.dislikesMu.Lock()
+	defer c.dislikesMu.Unlock()
+	if c.dislikes != nil {
+		return c.dislikes, nil
+	}
+
+	account, err := c.GetAccountStatus()
+	if err != nil {
+		return nil, fmt.Errorf("не удалось получить userId пользователя: %w", err)
+	}
+	userID := account.Result.Account.GetUserID()
+	if userID == "" {
+		return nil, fmt.Errorf("userId пользователя пустой")
+	}
+
+	url := baseURL + fmt.Sprintf(userDislikesPath, userID)
+	resp, err := c.makeRequest("GET", url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result struct {
+			Library struct {
+				Tracks []struct {
+					ID string `json:"id"`
+				} `json:"tracks"`
+			} `json:"library"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	ids := make([]string, 0, len(response.Result.Library.Tracks))
+	for _, trackRef := range response.Result.Library.Tracks {
+		ids = append(ids, trackRef.ID)
+	}
+	c.dislikes = ids
+	return ids, nil
+}
+
+// richTracksParams возвращает параметры запроса полных данных треков, если они включены
+func (c *YandexMusicClient) richTracksParams() map[string]string {
+	if !c.opts.RichTracks {
+		return nil
+	}
+	return map[string]string{"rich-tracks": "true"}
+}
+
+// getTrackByID получает полную информацию о треке по ID. Треки кэшируются на время
+// запуска, поэтому трек, встречающийся в нескольких плейлистах, запрашивается один раз
+func (c *YandexMusicClient) getTrackByID(trackID string) (*Track, error) {
+	c.trackCacheMu.Lock()
+	if track, ok := c.trackCache[trackID]; ok {
+		c.cacheStats.Hits++
+		c.trackCacheMu.Unlock()
+		copied := *track
+		return &copied, nil
+	}
+	c.trackCacheMu.Unlock()
+
+	track, err := c.fetchTrackByID(trackID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.trackCacheMu.Lock()
+	c.trackCache[trackID] = track
+	c.cacheStats.Misses++
+	c.trackCacheMu.Unlock()
+
+	copied := *track
+	return &copied, nil
+}
+
+// fetchTrackByID запрашивает полную информацию о треке по ID у API
+func (c *YandexMusicClient) fetchTrackByID(trackID string) (*Track, error) {
+	url := baseURL + fmt.Sprintf(trackPath, trackID)
+	resp, err := c.makeRequest("GET", url)
+	if err != nil {
+		return nil, trackRemovedError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result []Track `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	if len(response.Result) == 0 {
+		return nil, ErrTrackRemoved
+	}
+
+	return &response.Result[0], nil
+}
+
+// GetAlbumTracks получает список треков альбома
+func (c *YandexMusicClient) GetAlbumTracks(playlistID string) ([]Track, error) {
+	url := baseURL + fmt.Sprintf(albumTracksPath, playlistID)
+	resp, err := c.makeRequest("GET", url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result struct {
+			ReleaseDate string    `json:"releaseDate"`
+			Volumes     [][]Track `json:"volumes"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	var tracks []Track
+	for volumeIndex, volume := range response.Result.Volumes {
+		// Номер диска берётся из положения тома, если API не указал его у трека
+		for i := range volume {
+			for j := range volume[i].Albums {
+				album := &volume[i].Albums[j]
+				if formatID(album.ID) == playlistID && album.TrackPosition == nil {
+					album.TrackPosition = &TrackPosition{Volume: volumeIndex + 1, Index: i + 1}
+				}
+			}
+		}
+		tracks = append(tracks, volume...)
+	}
+
+	// В альбомах внутри треков даты выхода обычно нет — берём её из самого альбома
+	if response.Result.ReleaseDate != "" {
+		for i := range tracks {
+			for j := range tracks[i].Albums {
+				if formatID(tracks[i].Albums[j].ID) == playlistID && tracks[i].Albums[j].ReleaseDate == "" {
+					tracks[i].Albums[j].ReleaseDate = response.Result.ReleaseDate
+				}
+			}
+		}
+	}
+
+	return tracks, nil
+}
+
+// GetAlbum получает данные альбома без треков
+func (c *YandexMusicClient) GetAlbum(albumID string) (*Album, error) {
+	url := baseURL + fmt.Sprintf(albumPath, albumID)
+	resp, err := c.makeRequest("GET", url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Result Album `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+	return &response.Result, nil
+}
+
+// ArtistInfo представляет краткие данные исполнителя
+type ArtistInfo struct {
+	ID     interface{} `json:"id"`
+	Name   string      `json:"name"`
+	Genres []string    `json:"genres"`
+	Counts struct {
+		Tracks       int `json:"tracks"`
+		DirectAlbums int `json:"directAlbums"`
+	} `json:"counts"`
+}
+
+// GetArtist получает краткие данные исполнителя
+func (c *YandexMusicClient) GetArtist(artistID string) (*ArtistInfo, error) {
+	url := baseURL + fmt.Sprintf(artistBriefInfoPath, artistID)
+	resp, err := c.makeRequest("GET", url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Result struct {
+			Artist ArtistInfo `json:"artist"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+	return &response.Result.Artist, nil
+}
+
+// GetArtistTracks получает популярные треки исполнителя (первые limit треков по рейтингу)
+func (c *YandexMusicClient) GetArtistTracks(artistID string, limit int) ([]Track, error) {
+	url := baseURL + fmt.Sprintf(artistTracksPath, artistID)
+	resp, err := c.makeRequestWithParams("GET", url, map[string]string{
+		"page":      "0",
+		"page-size": strconv.Itoa(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result struct {
+			Tracks []Track `json:"tracks"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	tracks := response.Result.Tracks
+	if len(tracks) > limit {
+		tracks = tracks[:limit]
+	}
+	return tracks, nil
+}
+
+// GetArtistAlbums получает все альбомы исполнителя, постранично
+func (c *YandexMusicClient) GetArtistAlbums(artistID string) ([]Album, error) {
+	url := baseURL + fmt.Sprintf(artistAlbumsPath, artistID)
+
+	var albums []Album
+	for page := 0; ; page++ {
+		resp, err := c.makeRequestWithParams("GET", url, map[string]string{
+			"page":      strconv.Itoa(page),
+			"page-size": strconv.Itoa(artistAlbumsPageSize),
+			"sort-by":   "year",
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+		}
+
+		var response struct {
+			Result struct {
+				Albums []Album `json:"albums"`
+				Pager  struct {
+					Page    int `json:"page"`
+					PerPage int `json:"perPage"`
+					Total   int `json:"total"`
+				} `json:"pager"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+		}
+
+		albums = append(albums, response.Result.Albums...)
+		if len(response.Result.Albums) == 0 || len(albums) >= response.Result.Pager.Total {
+			break
+		}
+	}
+
+	return albums, nil
+}
+
+// GetPlaylistTracks получает список треков плейлиста по ID
+func (c *YandexMusicClient) GetPlaylistTracks(playlistID string) ([]TrackShort, error) {
+	playlist, err := c.GetPlaylist(playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return playlist.Tracks, nil
+}
+
+// Особые kind плейлистов: это автоматические списки, которые API отдаёт не как обычные
+// плейлисты, а по своим адресам (лайки и дизлайки)
+const (
+	likedPlaylistKind    = 3   // «Мне нравится»
+	dislikedPlaylistKind = -13 // «Не нравится»
+)
+
+// dislikesPlaylistTitle — название списка дизлайков в интерфейсе Яндекс.Музыки
+const dislikesPlaylistTitle = "Не нравится"
+
+// playlistAliases — имена, которые можно указать в -id вместо особых kind
+var playlistAliases = map[string]int{
+	"liked":    likedPlaylistKind,
+	"likes":    likedPlaylistKind,
+	"disliked": dislikedPlaylistKind,
+	"dislikes": dislikedPlaylistKind,
+}
+
+// specialPlaylistKind сообщает, указывает ли playlistID на особый плейлист — по имени
+// из playlistAliases или по kind
+func specialPlaylistKind(playlistID string) (int, bool) {
+	if kind, ok := playlistAliases[strings.ToLower(playlistID)]; ok {
+		return kind, true
+	}
+	if kind, err := strconv.Atoi(playlistID); err == nil && (kind == likedPlaylistKind || kind == dislikedPlaylistKind) {
+		return kind, true
+	}
+	return 0, false
+}
+
+// getSpecialPlaylist собирает особый плейлист из лайков или дизлайков текущего пользователя.
+// У лайков ревизия берётся из ответа API; у дизлайков её нет, и она остаётся нулевой
+func (c *YandexMusicClient) getSpecialPlaylist(kind int) (*Playlist, error) {
+	playlist := &Playlist{Kind: kind}
+	var ids []string
+	var err error
+	if kind == likedPlaylistKind {
+		playlist.Title = likesPlaylistTitle
+		ids, playlist.Revision, err = c.likedTrackIDsWithRevision("")
+	} else {
+		playlist.Title = dislikesPlaylistTitle
+		ids, err = c.GetDislikedTracks()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Треки запрашиваются пачками, как лайки в walkLikedTracks, а не по одному на трек
+	err = c.walkTrackIDs(ids, func(track Track) error {
+		playlist.Tracks = append(playlist.Tracks, TrackShort{Track: track})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	playlist.TrackCount = len(playlist.Tracks)
+	return playlist, nil
+}
+
+// GetPlaylist получает плейлист вместе с треками по ID (kind или UUID). Особые kind
+// и их имена (см. playlistAliases) ведут к лайкам и дизлайкам
+func (c *YandexMusicClient) GetPlaylist(playlistID string) (*Playlist, error) {
+	if kind, ok := specialPlaylistKind(playlistID); ok {
+		return c.getSpecialPlaylist(kind)
+	}
+
+	// Получаем userId
+	account, err := c.GetAccountStatus()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при получении userId: %w", err)
+	}
+	userID := account.Result.Account.GetUserID()
+	if userID == "" {
+		return nil, fmt.Errorf("userId пользователя пустой")
+	}
+
+	// Парсим playlistID - может быть kind (число) или UUID
+	var kind int
+	if k, err := strconv.Atoi(playlistID); err == nil {
+		kind = k
+	} else {
+		// Если не число, ищем плейлист по UUID
+		playlists, err := c.GetUserPlaylists(userID)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка при получении списка плейлистов: %w", err)
+		}
+		found := false
+		for _, p := range playlists {
+			if p.PlaylistUuid == playlistID || p.PlaylistID == playlistID {
+				kind = p.Kind
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("плейлист с ID %s не найден", playlistID)
+		}
+	}
+
+	return c.getUserPlaylist(userID, kind)
+}
+
+// ErrPlaylistPrivate возвращается, когда плейлист другого пользователя приватный
+// и недоступен с текущим токеном
+var ErrPlaylistPrivate = errors.New("плейлист приватный и недоступен с вашим токеном")
+
+// GetOwnerPlaylist получает плейлист другого пользователя по логину или uid владельца и kind.
+// Если по списку плейлистов владельца видно, что плейлист приватный, запрос к нему не
+// выполняется; ответ 403 на сам плейлист тоже означает приватный плейлист. В обоих
+// случаях ошибка оборачивает ErrPlaylistPrivate
+func (c *YandexMusicClient) GetOwnerPlaylist(owner string, kind int) (*Playlist, error) {
+	// Список чужих плейлистов может быть недоступен — тогда просто пробуем получить плейлист
+	if playlists, err := c.GetUserPlaylists(owner); err == nil {
+		for _, p := range playlists {
+			if p.Kind == kind && p.Visibility == "private" {
+				return nil, ErrPlaylistPrivate
+			}
+		}
+	}
+
+	playlist, err := c.getUserPlaylist(owner, kind)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: %w", ErrPlaylistPrivate, err)
+	}
+	return playlist, err
+}
+
+// GetPlaylistByRef получает плейлист по разобранной ссылке: плейлист другого пользователя
+// (/users/{владелец}/playlists/{kind}) — через GetOwnerPlaylist с проверкой приватности,
+// остальные — через GetPlaylist
+func (c *YandexMusicClient) GetPlaylistByRef(ref EntityRef) (*Playlist, error) {
+	if kind, err := strconv.Atoi(ref.ID); err == nil && ref.Owner != "" {
+		return c.GetOwnerPlaylist(ref.Owner, kind)
+	}
+	return c.GetPlaylist(ref.ID)
+}
+
+// getUserPlaylist получает плейлист пользователя userID (uid или логин) по kind сразу
+// с полными данными треков (rich-tracks), чтобы не запрашивать каждый трек отдельно
+func (c *YandexMusicClient) getUserPlaylist(userID string, kind int) (*Playlist, error) {
+	url := baseURL + fmt.Sprintf(userPlaylistPath, userID, kind)
+	resp, err := c.makeRequestWithParams("GET", url, map[string]string{"rich-tracks": "true"})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при получении плейлиста: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	// Треки разбираются отдельно, чтобы в режиме AllowPartial пропускать проблемные
+	var response struct {
+		Result struct {
+			Playlist
+			Tracks []json.RawMessage `json:"tracks"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	playlist := response.Result.Playlist
+	playlist.Tracks, err = decodeEach[TrackShort](response.Result.Tracks, "трек плейлиста", c.opts.AllowPartial)
+	if err != nil {
+		return nil, err
+	}
+	c.droppedTracks.Add(int64(len(response.Result.Tracks) - len(playlist.Tracks)))
+	c.resolveSparseTracks(playlist.Tracks)
+	return &playlist, nil
+}
+
+// resolveSparseTracks дозапрашивает по ID треки, которые пришли без полных данных
+// (без названия или исполнителей). Если дозапросить трек не удалось, он остаётся как есть
+func (c *YandexMusicClient) resolveSparseTracks(tracks []TrackShort) {
+	for i := range tracks {
+		track := &tracks[i].Track
+		if track.Title != "" && len(track.Artists) > 0 {
+			continue
+		}
+		trackID := track.TrackID()
+		if trackID == "" && tracks[i].ID != 0 {
+			trackID = strconv.Itoa(tracks[i].ID)
+		}
+		if trackID == "" {
+			continue
+		}
+		full, err := c.getTrackByID(trackID)
+		if err != nil {
+			log.Printf("Предупреждение: не удалось получить полные данные трека %s: %v\n", trackID, err)
+			continue
+		}
+		*track = *full
+	}
+}
+
+// Podcast представляет подкаст, на который подписан пользователь (лайкнутый альбом-подкаст)
+type Podcast struct {
+	ID          interface{} `json:"id"`
+	Title       string      `json:"title"`
+	Type        string      `json:"type"`
+	MetaType    string      `json:"metaType"`
+	Description string      `json:"description"`
+	CoverUri    string      `json:"coverUri"`
+	Artists     []struct {
+		Name string `json:"name"`
+	} `json:"artists"`
+}
+
+// URL возвращает ссылку на страницу подкаста в Яндекс Музыке
+func (p Podcast) URL() string {
+	return "https://music.yandex.ru/album/" + formatID(p.ID)
+}
+
+// GetLikedPodcasts получает подкасты, на которые подписан пользователь. Подписки
+// хранятся среди лайкнутых альбомов и отличаются типом podcast
+func (c *YandexMusicClient) GetLikedPodcasts(userID string) ([]Podcast, error) {
+	if userID == "" || userID == "me" {
+		account, err := c.GetAccountStatus()
+		if err != nil {
+			return nil, fmt.Errorf("не удалось получить userId пользователя: %w", err)
+		}
+		userID = account.Result.Account.GetUserID()
+		if userID == "" {
+			return nil, fmt.Errorf("userId пользователя пустой")
+		}
+	}
+
+	url := baseURL + fmt.Sprintf(userLikesAlbumsPath, userID)
+	resp, err := c.makeRequestWithParams("GET", url, map[string]string{"rich": "true"})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result []struct {
+			Album Podcast `json:"album"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	var podcasts []Podcast
+	for _, like := range response.Result {
+		if like.Album.Type == "podcast" || like.Album.MetaType == "podcast" {
+			podcasts = append(podcasts, like.Album)
+		}
+	}
+	return podcasts, nil
+}
+
+// ErrNotDirectlyDownloadable возвращается, когда вариант скачивания не ведёт к файлу
+// (например, поток отдаётся по частям в виде HLS-плейлиста) и собрать ссылку на MP3 нельзя
+var ErrNotDirectlyDownloadable = errors.New("трек недоступен для прямого скачивания")
+
+// ErrLowDiskSpace возвращается, когда после скачивания файла свободного места на диске
+// осталось бы меньше порога -min-free; скачивание при этом прекращается
+var ErrLowDiskSpace = errors.New("недостаточно места на диске")
+
+// errDiskSpaceUnsupported возвращается diskFreeSpace на платформах, где свободное место не определяется
+var errDiskSpaceUnsupported = errors.New("свободное место на диске не определяется на этой платформе")
+
+// ErrTrackRemoved возвращается, когда API отвечает на запрос трека 404 или 410: трек
+// удалён из каталога насовсем, и повторять попытки бессмысленно
+var ErrTrackRemoved = errors.New("трек удалён из каталога")
+
+// trackRemovedError помечает ошибку запроса трека как ErrTrackRemoved, если API ответил 404 или 410
+func trackRemovedError(err error) error {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusGone) {
+		return fmt.Errorf("%w: %w", ErrTrackRemoved, err)
+	}
+	return err
+}
+
+// ErrStaleDownloadURL возвращается, когда CDN отвечает 403 на скачивание аудио: подписанная
+// ссылка get-mp3 действует недолго и могла устареть, пока трек ждал очереди
+var ErrStaleDownloadURL = errors.New("ссылка на аудио отклонена, вероятно, устарела")
+
+// ErrInvalidDownloadInfo возвращается, когда вместо XML download-info пришло что-то другое —
+// обычно HTML-страница ошибки при недействительном токене или сбое сервера
+var ErrInvalidDownloadInfo = errors.New("ответ download-info не является корректным XML")
+
+// ErrTrackUnavailable записывается в состояние для треков, пропущенных как недоступные в регионе
+var ErrTrackUnavailable = errors.New("трек недоступен в регионе")
+
+// DownloadInfo представляет один вариант скачивания трека из ответа download-info
+type DownloadInfo struct {
+	Codec           string `json:"codec"`
+	Bitrate         int    `json:"bitrate"`
+	Gain            bool   `json:"gain"`
+	Preview         bool   `json:"preview"`
+	DownloadInfoURL string `json:"downloadInfoUrl"`
+	Direct          bool   `json:"direct"`
+	Barcode         string `json:"barcode"`
+	// Частота дискретизации в Гц и число каналов; API передаёт их не для всех вариантов
+	SampleRate int `json:"sampleRate,omitempty"`
+	Channels   int `json:"channels,omitempty"`
+}
+
+// GetTrackDownloadInfo получает список вариантов скачивания трека, упорядоченный
+// по -bitrate или -quality=max
+func (c *YandexMusicClient) GetTrackDownloadInfo(trackID string) ([]DownloadInfo, error) {
+	infos, err := c.GetTrackDownloadOptions(trackID)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.opts.MaxQuality {
+		sortByMaxQuality(infos, c.opts.MaxBitrate)
+	} else if c.opts.Bitrate > 0 {
+		sortByPreferredBitrate(infos, c.opts.Bitrate)
+	}
+
+	return infos, nil
+}
+
+// GetTrackLyrics получает текст песни из дополнительных данных трека. Если текста нет
+// или на него нет прав, возвращает пустую строку без ошибки
+func (c *YandexMusicClient) GetTrackLyrics(trackID string) (string, error) {
+	url := baseURL + fmt.Sprintf(trackSupplementPath, trackID)
+	resp, err := c.makeRequest("GET", url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Result struct {
+			Lyrics *struct {
+				FullLyrics string `json:"fullLyrics"`
+				HasRights  *bool  `json:"hasRights"`
+			} `json:"lyrics"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	lyrics := response.Result.Lyrics
+	if lyrics == nil || (lyrics.HasRights != nil && !*lyrics.HasRights) {
+		return "", nil
+	}
+	return strings.TrimSpace(lyrics.FullLyrics), nil
+}
+
+// GetTrackDownloadOptions получает все варианты скачивания трека в порядке ответа API
+func (c *YandexMusicClient) GetTrackDownloadOptions(trackID string) ([]DownloadInfo, error) {
+	url := baseURL + fmt.Sprintf(trackDownloadInfoPath, trackID)
+	resp, err := c.makeRequest("GET", url)
+	if err != nil {
+		return nil, trackRemovedError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	var response struct {
+		Result []DownloadInfo `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+
+	if len(response.Result) == 0 {
+		return nil, fmt.Errorf("нет доступных ссылок для скачивания")
+	}
+
+	return response.Result, nil
+}
+
+// sortByMaxQuality упорядочивает варианты скачивания для -quality=max: сначала полные
+// треки (не превью) с битрейтом не выше maxBitrate (0 — без ограничения) по убыванию
+// битрейта, затем остальные как запасные
+func sortByMaxQuality(infos []DownloadInfo, maxBitrate int) {
+	allowed := func(info DownloadInfo) bool {
+		return !info.Preview && (maxBitrate == 0 || info.Bitrate <= maxBitrate)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		iAllowed, jAllowed := allowed(infos[i]), allowed(infos[j])
+		if iAllowed != jAllowed {
+			return iAllowed
+		}
+		return infos[i].Bitrate > infos[j].Bitrate
+	})
+}
+
+// EnableMaxQuality включает выбор лучшего качества, доступного аккаунту (-quality=max):
+// по статусу аккаунта определяет, есть ли подписка, и ограничивает битрейт для
+// аккаунтов без неё. Возвращает описание выбора для вывода пользователю
+func (c *YandexMusicClient) EnableMaxQuality() (string, error) {
+	account, err := c.GetAccountStatus()
+	if err != nil {
+		return "", fmt.Errorf("ошибка получения статуса аккаунта: %w", err)
+	}
+	c.opts.MaxQuality = true
+	if account.Result.Plus.HasPlus {
+		c.opts.MaxBitrate = 0
+		return "максимальное для аккаунта: подписка Плюс, лучший вариант каждого трека", nil
+	}
+	c.opts.MaxBitrate = freeAccountMaxBitrate
+	return fmt.Sprintf("максимальное для аккаунта: без подписки, не выше %d кбит/с", freeAccountMaxBitrate), nil
+}
+
+// sortByPreferredBitrate упорядочивает варианты скачивания: сначала вариант с нужным
+// битрейтом, затем остальные по убыванию битрейта
+func sortByPreferredBitrate(infos []DownloadInfo, bitrate int) {
+	sort.SliceStable(infos, func(i, j int) bool {
+		iMatch := infos[i].Bitrate == bitrate
+		jMatch := infos[j].Bitrate == bitrate
+		if iMatch != jMatch {
+			return iMatch
+		}
+		return infos[i].Bitrate > infos[j].Bitrate
+	})
+}
+
+// GetTrackDownloadURL получает ссылку на MP3 для скачивания трека
+func (c *YandexMusicClient) GetTrackDownloadURL(trackID string) (string, error) {
+	mp3URL, _, err := c.getTrackDownloadLink(trackID)
+	return mp3URL, err
+}
+
+// getTrackDownloadLink получает ссылку на MP3 и сообщает, ведёт ли она только на превью
+func (c *YandexMusicClient) getTrackDownloadLink(trackID string) (string, bool, error) {
+	infos, err := c.GetTrackDownloadInfo(trackID)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Берем первую ссылку, которую удалось получить (первая обычно лучшего качества)
+	var errs []error
+	for _, info := range infos {
+		mp3URL, err := c.resolveDownloadURL(info)
+		if err == nil {
+			return mp3URL, info.Preview, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return "", false, combineDownloadErrors(errs)
+}
+
+// combineDownloadErrors сводит ошибки перебора вариантов скачивания в одну. Если ни один
+// вариант не ведёт к файлу, возвращается ErrNotDirectlyDownloadable, иначе последняя ошибка
+func combineDownloadErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	notDirect := 0
+	for _, err := range errs {
+		if errors.Is(err, ErrNotDirectlyDownloadable) {
+			notDirect++
+		}
+	}
+	if notDirect == len(errs) {
+		return ErrNotDirectlyDownloadable
+	}
+
+	lastErr := errs[len(errs)-1]
+	if len(errs) > 1 {
+		return fmt.Errorf("все %d вариантов скачивания недоступны, последняя ошибка: %w", len(errs), lastErr)
+	}
+	return lastErr
+}
+
+// resolveDownloadURL получает прямую ссылку на MP3 для варианта из download-info
+func (c *YandexMusicClient) resolveDownloadURL(info DownloadInfo) (string, error) {
+	downloadInfoURL := info.DownloadInfoURL
+	if downloadInfoURL == "" {
+		return "", fmt.Errorf("ссылка на скачивание не найдена")
+	}
+
+	// Получаем прямую ссылку на MP3 с авторизацией; download-info отдаёт хранилище
+	// аудио, поэтому запрос идёт с заголовками скачивания, а не API
+	downloadReq, err := http.NewRequest("GET", downloadInfoURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("ошибка создания запроса: %w", err)
+	}
+	downloadReq.Header = c.downloadHeaders()
+
+	downloadResp, err := c.client.Do(downloadReq)
+	if err != nil {
+		return "", fmt.Errorf("ошибка получения ссылки на скачивание: %w", err)
+	}
+	if err := c.dumpResponse(downloadReq, downloadResp); err != nil {
+		log.Printf("Предупреждение: не удалось сохранить ответ API: %v", err)
+	}
+	defer downloadResp.Body.Close()
+
+	downloadBody, err := io.ReadAll(downloadResp.Body)
+	if err != nil {
+		return "", fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+	contentType := downloadResp.Header.Get("Content-Type")
+	if downloadResp.StatusCode < 200 || downloadResp.StatusCode >= 300 {
+		c.debugf("download-info: статус %d, Content-Type %q, ответ: %s\n", downloadResp.StatusCode, contentType, bodySnippet(downloadBody))
+		return "", &APIError{StatusCode: downloadResp.StatusCode, Endpoint: "GET download-info"}
+	}
+
+	var downloadInfo struct {
+		XMLName xml.Name `xml:"download-info"`
+		Host    string   `xml:"host"`
+		Path    string   `xml:"path"`
+		S       string   `xml:"s"`
+		Ts      string   `xml:"ts"`
+	}
+	// Вместо download-info может прийти HLS-плейлист: такой поток по ссылке get-mp3 не скачать
+	if bytes.HasPrefix(bytes.TrimSpace(downloadBody), []byte("#EXTM3U")) {
+		return "", ErrNotDirectlyDownloadable
+	}
+	// HTML-страница ошибки иногда приходит и со статусом 200; xml.Unmarshal на ней
+	// выдаёт невнятную ошибку, поэтому такой ответ распознаётся заранее
+	if isHTMLResponse(contentType, downloadBody) {
+		c.debugf("download-info: Content-Type %q, ответ: %s\n", contentType, bodySnippet(downloadBody))
+		return "", fmt.Errorf("%w: сервер вернул HTML-страницу (Content-Type %q) — проверьте токен; начало ответа покажет -debug", ErrInvalidDownloadInfo, contentType)
+	}
+	// Ответ, который не разбирается как download-info, ссылку на файл не даёт: вариант
+	// считается недоступным для прямого скачивания, а не скачивается как есть
+	if err := xml.Unmarshal(downloadBody, &downloadInfo); err != nil {
+		c.debugf("download-info: Content-Type %q, ответ: %s\n", contentType, bodySnippet(downloadBody))
+		return "", fmt.Errorf("%w: %w (Content-Type %q): %v", ErrNotDirectlyDownloadable, ErrInvalidDownloadInfo, contentType, err)
+	}
+	if downloadInfo.Host == "" || downloadInfo.Path == "" {
+		return "", ErrNotDirectlyDownloadable
+	}
+
+	// Формируем прямую ссылку на MP3
+	mp3URL := fmt.Sprintf("https://%s/get-mp3/%s/%s/%s", downloadInfo.Host, downloadInfo.S, downloadInfo.Ts, downloadInfo.Path)
+	return mp3URL, nil
+}
+
+// isHTMLResponse сообщает, похож ли ответ на HTML-страницу: по Content-Type или по началу тела
+func isHTMLResponse(contentType string, body []byte) bool {
+	if strings.Contains(strings.ToLower(contentType), "html") {
+		return true
+	}
+	start := bytes.ToLower(bytes.TrimSpace(body))
+	return bytes.HasPrefix(start, []byte("<!doctype html")) || bytes.HasPrefix(start, []byte("<html"))
+}
+
+// downloadTrackWithFallback скачивает трек, по очереди перебирая варианты из download-info:
+// если хост CDN из первого варианта недоступен, пробуется следующий.
+// Возвращает вариант, который удалось скачать
+func (c *YandexMusicClient) downloadTrackWithFallback(trackID string, infos []DownloadInfo, filePath string, minFree int64, progressCallback func(float64)) (DownloadInfo, error) {
+	var errs []error
+	refreshed := false
+	for _, info := range infos {
+		mp3URL, err := c.resolveDownloadURL(info)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		release := c.acquireDownloadHost(mp3URL)
+		err = downloadFileWithProgress(c.client, mp3URL, filePath, c.downloadHeaders(), minFree, progressCallback, &c.transferred)
+		release()
+		// Ссылка могла устареть, пока трек ждал свободного хоста или очереди скачиваний:
+		// один раз на трек получаем download-info заново и повторяем тот же вариант
+		if errors.Is(err, ErrStaleDownloadURL) && !refreshed {
+			refreshed = true
+			c.throttle.retries.Add(1)
+			var fresh DownloadInfo
+			if fresh, err = c.refreshDownloadInfo(trackID, info); err == nil {
+				if mp3URL, err = c.resolveDownloadURL(fresh); err == nil {
+					info = fresh
+					release := c.acquireDownloadHost(mp3URL)
+					err = downloadFileWithProgress(c.client, mp3URL, filePath, c.downloadHeaders(), minFree, progressCallback, &c.transferred)
+					release()
+				}
+			}
+			c.recordRetryOutcome(true, err == nil)
+		}
+		if errors.Is(err, ErrLowDiskSpace) {
+			// Другой вариант места не прибавит
+			return DownloadInfo{}, err
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return info, nil
+	}
+
+	return DownloadInfo{}, combineDownloadErrors(errs)
+}
+
+// refreshDownloadInfo заново получает варианты скачивания трека и возвращает вариант
+// с теми же кодеком, битрейтом и признаком превью, что stale, а если его нет — первый
+func (c *YandexMusicClient) refreshDownloadInfo(trackID string, stale DownloadInfo) (DownloadInfo, error) {
+	infos, err := c.GetTrackDownloadInfo(trackID)
+	if err != nil {
+		return DownloadInfo{}, fmt.Errorf("ошибка повторного получения download-info: %w", err)
+	}
+	for _, info := range infos {
+		if info.Codec == stale.Codec && info.Bitrate == stale.Bitrate && info.Preview == stale.Preview {
+			return info, nil
+		}
+	}
+	return infos[0], nil
+}
+
+// streamTrackWithFallback пишет аудио трека в out, перебирая варианты из download-info,
+// как downloadTrackWithFallback. К следующему варианту можно перейти, только пока в out
+// ничего не записано, поэтому ошибка посреди передачи возвращается сразу
+func (c *YandexMusicClient) streamTrackWithFallback(infos []DownloadInfo, out io.Writer, progressCallback func(float64)) (DownloadInfo, error) {
+	var errs []error
+	for _, info := range infos {
+		mp3URL, err := c.resolveDownloadURL(info)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		req, err := http.NewRequest("GET", mp3URL, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ошибка создания запроса: %w", err))
+			continue
+		}
+		req.Header = c.downloadHeaders().Clone()
+		release := c.acquireDownloadHost(mp3URL)
+		resp, err := c.client.Do(req)
+		if err != nil {
+			release()
+			errs = append(errs, fmt.Errorf("ошибка выполнения запроса: %w", err))
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			release()
+			errs = append(errs, fmt.Errorf("ошибка HTTP: статус %d", resp.StatusCode))
+			continue
+		}
+
+		err = copyWithProgress(out, resp, progressCallback, &c.transferred)
+		resp.Body.Close()
+		release()
+		return info, err
+	}
+
+	return DownloadInfo{}, combineDownloadErrors(errs)
+}
+
+// acquireDownloadHost занимает место для скачивания с хоста из rawURL (см. PerHostConcurrency)
+// и возвращает функцию его освобождения
+func (c *YandexMusicClient) acquireDownloadHost(rawURL string) func() {
+	host := rawURL
+	if parsed, err := url.Parse(rawURL); err == nil {
+		host = parsed.Host
+	}
+	return c.hosts.Acquire(host)
+}
+
+// Quality возвращает описание качества варианта, например "mp3 320"
+func (d DownloadInfo) Quality() string {
+	return fmt.Sprintf("%s %d", d.Codec, d.Bitrate)
+}
+
+func main() {
+	// Парсим аргументы командной строки
+	var (
+		command            = flag.String("cmd", "", "Команда: playlist, likes, wave, list-playlists, download-playlist, download-likes, sync-playlist, download-artist, merge, retry, retag, fix-tags, template-preview, link, stream, doctor, list-formats, history, covers, login, export-podcasts, export-all-tracks, info")
+		playlistID         = flag.String("id", "", "ID плейлиста для команды playlist или download-playlist (для download-playlist, sync-playlist и info — также ссылка на плейлист), ID трека для команды link")
+		outputFmt          = flag.String("out", "", "Формат вывода: json (по умолчанию - текст)")
+		folderName         = flag.String("to", "", "Папка для сохранения (для команды download-playlist)")
+		breakLock          = flag.Bool("break-lock", false, "Снять блокировку папки назначения, оставшуюся от другого запуска")
+		strict             = flag.Bool("strict", false, "Завершаться с ненулевым кодом, если хоть один трек не получен полностью: ошибка, недоступность или только превью")
+		failFast           = flag.Bool("fail-fast", false, "Прекратить скачивание после первого трека с ошибкой (для проверки настроек)")
+		outputEncoding     = flag.String("output-encoding", encodingUTF8, "Кодировка текстового вывода и CSV: utf-8 или utf-8-bom (с меткой порядка байтов для Excel)")
+		bomFlag            = flag.Bool("bom", false, "Начинать текстовый вывод и CSV с метки порядка байтов UTF-8, как -output-encoding=utf-8-bom")
+		minFreeFlag        = flag.String("min-free", "", "Не начинать скачивание файла, если после него на диске останется меньше указанного, например 1G или 500M")
+		playlistMeta       = flag.Bool("playlist-meta", false, "Сохранять в папку плейлиста его обложку (playlist.jpg) и описание (playlist.json)")
+		extMismatch        = flag.String("extension-mismatch", mismatchRename, "Если скачанный файл оказался не MP3 (AAC, FLAC): rename — исправить расширение, warn — только предупредить")
+		onCollision        = flag.String("on-collision", collisionSuffix, "Что делать, если разные треки получают одинаковое имя файла: skip, overwrite, suffix")
+		lang               = flag.String("lang", "", "Язык ответов API, например en (по умолчанию — язык аккаунта)")
+		region             = flag.String("region", "", "Регион локали, например KZ (используется вместе с -lang)")
+		tagISRC            = flag.Bool("isrc", false, "Записывать ISRC трека в тег TSRC, если API его возвращает (включает -rich-tracks)")
+		noTags             = flag.Bool("no-tags", false, "Не записывать ID3 теги в скачанные файлы (для тех, кто тегирует сам, например beets)")
+		id3VersionFlag     = flag.String("id3-version", "2.3", "Версия ID3-тегов: 2.3 (совместимость с большинством устройств) или 2.4")
+		tagBPM             = flag.Bool("bpm", false, "Записывать темп трека в тег TBPM, если API его возвращает (включает -rich-tracks)")
+		richTracks         = flag.Bool("rich-tracks", false, "Запрашивать полные данные треков в лайках (параметр rich-tracks); плейлисты запрашиваются с ними всегда")
+		catalogPath        = flag.String("catalog", "", "Путь к SQLite-базе, в которую записываются метаданные треков и альбомов")
+		allAlbums          = flag.Bool("all-albums", false, "Для команды download-artist: скачать все альбомы исполнителя вместо популярных треков")
+		cue                = flag.Bool("cue", false, "Для команды download-artist с -all-albums: записать в папку каждого альбома CUE-файл со списком треков")
+		minDuration        = flag.String("min-duration", "", "Пропускать треки короче заданной длительности (м:сс или секунды)")
+		maxDuration        = flag.String("max-duration", "", "Пропускать треки длиннее заданной длительности (м:сс или секунды)")
+		layout             = flag.String("layout", layoutFlat, "Раскладка файлов: flat ({исполнитель}-{название}.mp3) или media-server ({исполнитель}/{альбом}/{NN} - {название}.mp3 и folder.jpg)")
+		debug              = flag.Bool("debug", false, "Выводить в stderr отладочные подробности, например начало ответов API, которые не удалось разобрать")
+		dumpResponses      = flag.String("dump-responses", "", "Папка для сохранения сырых ответов API (для отладки разбора)")
+		summaryPath        = flag.String("summary", "", "Путь к JSON-файлу с итогом команды скачивания: счетчики треков, байты, время и код выхода")
+		manifestPath       = flag.String("manifest", "", "Путь к JSON-манифесту выгрузки: версия, параметры запуска и итог по каждому треку (для команд скачивания)")
+		csvOut             = flag.String("csv", "", "Путь к CSV-индексу результатов скачивания (для команд скачивания)")
+		m3uOut             = flag.String("m3u", "", "Путь к плейлисту M3U из скачанных треков (для команд скачивания)")
+		jsonOut            = flag.String("json", "", "Путь к JSON-файлу с результатами скачивания (для команд скачивания)")
+		dedupIndex         = flag.String("dedup-index", "", "Общий для нескольких папок индекс скачанных треков: трек, уже скачанный в другую папку, не скачивается заново")
+		dedupLink          = flag.String("link", dedupLinkHard, "Как использовать трек из другой папки по -dedup-index: hard, symlink, copy или skip")
+		eventsPath         = flag.String("events", "", "Писать события выгрузки в формате JSON Lines в файл (\"-\" — в stderr): итог по каждому треку и периодическую сводку прогресса")
+		eventsInterval     = flag.Duration("events-interval", 5*time.Second, "Как часто писать в -events сводку прогресса (0 — только в конце)")
+		targzPath          = flag.String("targz", "", "Упаковать папку выгрузки после скачивания в архив tar.gz с сохранением структуры папок (для команд скачивания)")
+		lyricsFile         = flag.String("lyrics-file", "", "Путь к общему файлу с текстами песен скачанных треков: .json — JSON, иначе текст (для команд скачивания)")
+		errorReport        = flag.String("error-report", "", "Для команды retry: JSON-отчёт прошлого запуска (файл -json или -manifest), из которого берутся треки с ошибками")
+		coverSize          = flag.String("cover-size", albumCoverSize, "Для команды covers: размер обложек, например 400x400 или orig")
+		refreshTags        = flag.Bool("refresh", false, "Для команды fix-tags: перед исправлением перезаписать теги файлов с YANDEX_TRACK_ID свежими метаданными из API")
+		shuffle            = flag.Bool("shuffle", false, "Перемешать треки перед выводом или скачиванием: меняет порядок вывода, M3U и номеров -prepend-index")
+		shuffleSeed        = flag.Int64("seed", 0, "Seed для -shuffle: с одним и тем же seed порядок повторяется (0 — случайный seed, он выводится в stderr)")
+		normalizeCase      = flag.String("normalize-case", caseAsIs, "Регистр исполнителей и названий в тегах и именах файлов: none — как в API, title — каждое слово с заглавной")
+		completeAlbums     = flag.Bool("complete-albums", false, "Для команды download-likes: докачать недостающие треки альбомов, из которых лайкнута заметная часть (см. -complete-albums-threshold)")
+		completeThreshold  = flag.Int("complete-albums-threshold", 50, "Для -complete-albums: минимальная доля лайкнутых треков альбома в процентах")
+		addedSince         = flag.String("added-since", "", "Для команд playlist и download-playlist: только треки, добавленные в плейлист с этой даты (YYYY-MM-DD или RFC 3339)")
+		jsonProfile        = flag.String("json-profile", jsonProfileSimple, "Для команд playlist, likes и wave с -out=json: форма объектов — simple, detailed или array-artists")
+		onlyDownloadable   = flag.Bool("only-downloadable", false, "Для команд playlist, likes и wave: не выводить треки, для которых не удалось получить ссылку на полный трек")
+		groupByAlbum       = flag.Bool("group-by-album", false, "Для команды likes: сгруппировать треки по альбомам, упорядочив по альбому и номеру трека")
+		waveCount          = flag.Int("count", 20, "Для команды wave: сколько следующих треков «Моей волны» получить")
+		limit              = flag.Int("limit", 0, "Для команды history: сколько последних треков вывести (0 — все, что отдаёт API); для template-preview: сколько первых треков показать (0 — все)")
+		concurrency        = flag.Int("concurrency", 1, "Сколько запросов и скачиваний выполнять параллельно")
+		connectTimeout     = flag.Duration("connect-timeout", defaultConnectTimeout, "Таймаут установки соединения, например 5s (0 — без ограничения)")
+		tlsTimeout         = flag.Duration("tls-timeout", defaultTLSHandshakeTimeout, "Таймаут TLS-рукопожатия (0 — без ограничения)")
+		responseTimeout    = flag.Duration("response-timeout", defaultResponseHeaderTimeout, "Сколько ждать заголовков ответа после отправки запроса (0 — без ограничения)")
+		totalTimeout       = flag.Duration("timeout", 0, "Таймаут всего запроса вместе со скачиванием файла, например 10m (0 — без ограничения)")
+		likesConc          = flag.Int("likes-concurrency", defaultLikesConcurrency, "Сколько запросов полных данных треков лайков (по 100 треков) выполнять одновременно")
+		perHostConc        = flag.Int("per-host-concurrency", defaultPerHostConcurrency, "Сколько файлов скачивать одновременно с одного хоста CDN (0 — без ограничения)")
+		quality            = flag.String("quality", "", "Качество скачивания: max — лучшее, что позволяет подписка аккаунта (вместо -bitrate)")
+		bitrate            = flag.Int("bitrate", 0, "Предпочитаемый битрейт в кбит/с, например 320 (по умолчанию — первый вариант из ответа API)")
+		bitrateRep         = flag.String("bitrate-report", "", "Путь к JSON-файлу с отчётом о битрейтах скачанных треков")
+		quiet              = flag.Bool("quiet", false, "Не выводить ничего, кроме ошибок (в stderr); при ошибках скачивания код выхода ненулевой")
+		ciMode             = flag.Bool("ci", false, "Режим для логов CI: строка на трек и сводка каждые 30 секунд вместо живого прогресса (включается сам, если вывод не в терминал)")
+		knownArtistsPath   = flag.String("known-artists", "", "Файл со списком исполнителей (по одному на строку, имя или ссылка): оставлять только треки, среди исполнителей которых есть кто-то из списка")
+		excludeDislikes    = flag.Bool("exclude-dislikes", false, "Исключать из просмотра и скачивания треки, отмеченные как «не нравится»")
+		maxRetries         = flag.Int("max-retries", 0, "Для команд скачивания: сколько запусков подряд повторять трек с ошибкой; после этого ошибка записывается в файл состояния как постоянная и трек пропускается (0 — повторять всегда)")
+		retryPermanent     = flag.Bool("retry-permanent-failures", false, "Снова скачивать треки, которые прошлые запуски отметили как постоянно не скачивающиеся (-max-retries)")
+		recheckRemoved     = flag.Bool("recheck-removed", false, "Снова запросить треки, которые прошлые запуски отметили как удалённые из каталога (404 или 410)")
+		includeUnavailable = flag.Bool("include-unavailable", false, "Пытаться скачать треки, помеченные недоступными в регионе, вместо раннего пропуска")
+		nameTemplate       = flag.String("name-template", "", "Шаблон имени файла трека вместо имени по -layout, например \"{track} - {artist} - {title}\". Плейсхолдеры: {artist}, {title}, {album}, {year}, {track}, {id}, {date}, {datetime}")
+		prependIdx         = flag.Bool("prepend-index", false, "Начинать имя файла с позиции трека в плейлисте (001 - ...), чтобы файлы сортировались в порядке плейлиста")
+		maxTitleLength     = flag.Int("max-title-length", 0, "Укорачивать название трека в имени файла до этого числа символов с многоточием (теги не меняются)")
+		maxArtists         = flag.Int("max-artists", 0, "Показывать в выводе и имени файла не больше стольких исполнителей, остальных заменять на «и др.» (теги не меняются)")
+		assumeYes          = flag.Bool("yes", false, "Не спрашивать подтверждение перед скачиванием большого числа треков")
+		insecure           = flag.Bool("insecure", false, "Не проверять TLS-сертификаты (небезопасно; для прокси с подменой сертификатов)")
+		caCert             = flag.String("cacert", "", "Файл PEM с дополнительными корневыми сертификатами (например, внутреннего CA)")
+		apiHostsFlag       = flag.String("api-hosts", baseURL, "Адреса API через запятую: основной и запасные на случай ошибок соединения и ответов 5xx")
+		userAgent          = flag.String("user-agent", defaultUserAgent, "User-Agent запросов к API")
+		downloadUA         = flag.String("download-user-agent", defaultDownloadUserAgent, "User-Agent скачивания аудио с CDN")
+		prune              = flag.Bool("prune", false, "После скачивания перенести в .trash файлы треков, которых больше нет в плейлисте или лайках")
+		pruneHard          = flag.Bool("prune-hard", false, "Вместе с -prune: удалять лишние файлы насовсем вместо переноса в .trash")
+		coverMode          = flag.String("cover-mode", "", "Обложки при скачивании: embed-all — в каждый трек, embed-first — только в первый трек альбома и folder.jpg, folder-only — только folder.jpg")
+		coverFile          = flag.String("cover-file", "", "Встраивать в теги эту обложку (JPEG или PNG) вместо обложки из API; для папки — файлы {id альбома}.jpg")
+		showStats          = flag.Bool("stats", false, "Вывести в stderr статистику запуска: обращения к кэшу треков и ограничения запросов API")
+		allowPartial       = flag.Bool("allow-partial", false, "Пропускать с предупреждением элементы, которые не удалось получить или разобрать, вместо завершения с ошибкой")
+		tokenFile          = flag.String("token-file", "", "Файл с токеном доступа (например, секрет Docker); имеет приоритет над -keyring и переменными окружения")
+		useKeyring         = flag.Bool("keyring", false, "Читать токен из системного хранилища учётных данных (сохраняется командой login); если записи нет — из .env и переменных окружения")
+		commentTmpl        = flag.String("comment-template", "", "Шаблон ID3-комментария, например \"Exported from Yandex on {date} from playlist {playlist}\". Плейсхолдеры: {date}, {datetime}, {playlist}, {source}, {quality}")
+		dateFormat         = flag.String("date-format", defaultDateFormat, "Формат {date} в -to и -comment-template: YYYY, YY, MM, DD, hh, mm, ss и разделители - _ . /; {datetime} добавляет к нему _hh-mm-ss")
+	)
+
+	queryParams := keyValueFlag{}
+	flag.Var(queryParams, "query", "Дополнительный query-параметр для всех запросов к API в виде ключ=значение (можно указывать несколько раз)")
+	commonHeaders := headerFlag{}
+	flag.Var(commonHeaders, "header", "Дополнительный заголовок всех запросов (к API и к CDN) в виде \"Имя: значение\" (можно указывать несколько раз)")
+	apiHeaders := keyValueFlag{}
+	flag.Var(apiHeaders, "api-header", "Дополнительный заголовок запросов к API в виде Имя=значение (можно указывать несколько раз)")
+	downloadHeaders := keyValueFlag{}
+	flag.Var(downloadHeaders, "download-header", "Дополнительный заголовок скачивания аудио с CDN в виде Имя=значение (можно указывать несколько раз)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Использование: %s [опции]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Команды:\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=playlist -id=ID [-out=json] Просмотреть список всех песен плейлиста с ссылками на MP3\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=likes [-out=json]           Просмотреть список избранного с ссылками на MP3\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=wave [-count=N] [-to=folder] Вывести или скачать следующие треки «Моей волны»\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=list-playlists [-out=json]   Просмотреть список всех плейлистов\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=history [-limit=N] [-out=json] Просмотреть историю прослушиваний\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=export-podcasts [-out=opml|json|text] Выгрузить список подписок на подкасты (по умолчанию OPML со ссылками на страницы в Яндекс Музыке, без RSS-лент: для переноса подписок в другое приложение не подходит)\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=export-all-tracks [-out=json|csv] Выгрузить все треки из всех плейлистов без повторов\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=info -id=URL                 Показать сводку о плейлисте, альбоме, треке или исполнителе\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=download-playlist -id=ID -to=folder Скачать все песни плейлиста в папку\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=download-likes -to=folder    Скачать лайкнутые треки в папку\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=covers -id=ID -to=folder     Сохранить обложки альбомов плейлиста без аудио\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=sync-playlist -id=ID -to=folder Докачать только новые треки плейлиста, если он изменился\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=download-artist -id=ARTISTID -to=folder [-all-albums] Скачать популярные треки (или все альбомы) исполнителя\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=merge -id=ID1,ID2 -to=folder Скачать объединение нескольких плейлистов без повторов\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=retry -error-report=FILE -to=folder Повторить скачивание треков с ошибками из отчёта\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=fix-tags -to=folder          Исправить кодировку и формат ID3-тегов без повторного скачивания\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=retag -to=folder             Перезаписать ID3-теги свежими метаданными\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=template-preview -id=ID [-limit=N] Показать пути, которые получат треки плейлиста, без скачивания\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=link -id=TRACKID             Вывести прямую ссылку на MP3 трека\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=stream -id=TRACKID           Записать аудио трека в stdout\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=list-formats -id=TRACKID     Показать варианты скачивания трека\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=doctor [-id=TRACKID]         Проверить токен, доступ к API и скачивание\n")
+		fmt.Fprintf(os.Stderr, "  -cmd=login                        Сохранить токен из stdin в системное хранилище учётных данных\n\n")
+		fmt.Fprintf(os.Stderr, "Примеры:\n")
+		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=playlist -id=12345\n")
+		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=playlist -id=12345 -out=json\n")
+		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=likes\n")
+		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=list-playlists\n")
+		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=list-playlists -out=json\n")
+		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=download-playlist -id=12345 -to=./music\n")
+		fmt.Fprintf(os.Stderr, "  curl -o track.mp3 \"$(yandex-music-exporter -cmd=link -id=12345)\"\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	// Загрузка переменных окружения из .env файла
+	// С -keyring и для login .env не обязателен, поэтому предупреждение не выводится
+	if err := godotenv.Load(); err != nil && !*quiet && !*useKeyring && *tokenFile == "" && *command != "login" {
+		log.Printf("Предупреждение: не удалось загрузить .env файл: %v", err)
+	}
+
+	// Команде login токен не нужен: она его сохраняет
+	if *command == "login" {
+		handleLogin()
+		return
+	}
+
+	// Получаем токен доступа: из файла -token-file, из хранилища учётных данных (с -keyring),
+	// затем из окружения: файла ACCESS_TOKEN_FILE или переменной ACCESS_TOKEN
+	// Команда doctor продолжает работу и без токена, чтобы сообщить об этом в отчёте
+	tokenProvider := reloadEnvToken
+	token, tokenSource := "", ""
+	var tokenErr error
+	if *tokenFile != "" {
+		path := *tokenFile
+		tokenProvider = func() (string, error) { return readTokenFile(path) }
+		tokenSource = "-token-file"
+		var err error
+		if token, err = readTokenFile(path); err != nil {
+			tokenErr = fmt.Errorf("-token-file: %w", err)
+		}
+	}
+	if token == "" && tokenErr == nil && *useKeyring {
+		tokenProvider = reloadKeyringToken
+		tokenSource = "хранилище учётных данных"
+		var err error
+		if token, err = keyringToken(); err != nil {
+			log.Printf("Предупреждение: не удалось прочитать токен из хранилища учётных данных: %v", err)
+		}
+	}
+	if token == "" && tokenErr == nil {
+		tokenSource = "ACCESS_TOKEN"
+		if os.Getenv("ACCESS_TOKEN_FILE") != "" {
+			tokenSource = "ACCESS_TOKEN_FILE"
+		}
+		var err error
+		if token, err = envToken(); err != nil {
+			tokenErr = err
+		}
+	}
+	if token == "" && tokenErr == nil {
+		tokenErr = errors.New("ACCESS_TOKEN не найден в .env файле или переменных окружения")
+	}
+	if tokenErr != nil && *command != "doctor" {
+		log.Printf("Ошибка: %v", tokenErr)
+		os.Exit(exitAuth)
+	}
+
+	tlsConfig, err := newTLSConfig(*insecure, *caCert)
+	if err != nil {
+		log.Fatalf("Ошибка: неверное значение -cacert: %v", err)
+	}
+	if *insecure {
+		log.Print("ВНИМАНИЕ: проверка TLS-сертификатов отключена (-insecure). Соединение может перехватить и изменить любой узел в сети, включая токен доступа. Используйте -cacert с сертификатом вашего прокси, если это возможно")
+	}
+
+	apiHosts, err := parseAPIHosts(*apiHostsFlag)
+	if err != nil {
+		log.Fatalf("Ошибка: неверное значение -api-hosts: %v", err)
+	}
+
+	switch *quality {
+	case "", "max":
+	default:
+		log.Fatalf("Ошибка: неизвестное значение -quality: %s. Доступные: max", *quality)
+	}
+	if *quality == "max" && *bitrate > 0 {
+		log.Fatal("Ошибка: -quality=max и -bitrate нельзя использовать вместе")
+	}
+
+	// Создаем клиент
+	client := NewClient(token, ClientOptions{
+		Lang:    *lang,
+		Region:  *region,
+		Bitrate: *bitrate,
+
+		QueryParams:       queryParams,
+		UserAgent:         *userAgent,
+		Headers:           commonHeaders,
+		APIHeaders:        apiHeaders,
+		DownloadUserAgent: *downloadUA,
+		DownloadHeaders:   downloadHeaders,
+		TokenProvider:     tokenProvider,
+		DumpDir:           *dumpResponses,
+		Debug:             *debug,
+		AllowPartial:      *allowPartial,
+		TLSConfig:         tlsConfig,
+		APIHosts:          apiHosts,
+
+		PerHostConcurrency: *perHostConc,
+		LikesConcurrency:   *likesConc,
+
+		ConnectTimeout:        *connectTimeout,
+		TLSHandshakeTimeout:   *tlsTimeout,
+		ResponseHeaderTimeout: *responseTimeout,
+		Timeout:               *totalTimeout,
+		// ISRC и BPM приходят только в полных данных треков
+		RichTracks: *richTracks || *tagISRC || *tagBPM,
+	})
+
+	// Для -quality=max качество подбирается по подписке аккаунта
+	requestedBitrate := *bitrate
+	if *quality == "max" {
+		choice, err := client.EnableMaxQuality()
+		if err != nil {
+			fatalf(err, "Ошибка: -quality=max: %v\n", err)
+		}
+		if !*quiet {
+			log.Printf("Качество: %s\n", choice)
+		}
+		requestedBitrate = client.opts.MaxBitrate
+	}
+
+	switch *onCollision {
+	case collisionSkip, collisionOverwrite, collisionSuffix:
+	default:
+		log.Fatalf("Ошибка: неизвестная стратегия -on-collision: %s. Доступные: skip, overwrite, suffix", *onCollision)
+	}
+	id3Version, err := parseID3Version(*id3VersionFlag)
+	if err != nil {
+		log.Fatalf("Ошибка: неверное значение -id3-version: %v", err)
+	}
+	var minFree int64
+	if *minFreeFlag != "" {
+		if minFree, err = parseByteSize(*minFreeFlag); err != nil {
+			log.Fatalf("Ошибка: неверное значение -min-free: %v", err)
+		}
+		if _, err := diskFreeSpace("."); errors.Is(err, errDiskSpaceUnsupported) {
+			log.Fatalf("Ошибка: -min-free: %v", err)
+		}
+	}
+	switch *extMismatch {
+	case mismatchRename, mismatchWarn:
+	default:
+		log.Fatalf("Ошибка: неизвестное значение -extension-mismatch: %s. Доступные: rename, warn", *extMismatch)
+	}
+	switch *dedupLink {
+	case dedupLinkHard, dedupLinkSymlink, dedupLinkCopy, dedupLinkSkip:
+	default:
+		log.Fatalf("Ошибка: неизвестное значение -link: %s. Доступные: hard, symlink, copy, skip", *dedupLink)
+	}
+	// {date} и {datetime} вычисляются один раз при запуске: у всех файлов запуска одна метка
+	dateLayout, err := parseDateFormat(*dateFormat)
+	if err != nil {
+		log.Fatalf("Ошибка: неверное значение -date-format: %v", err)
+	}
+	runStartedAt := time.Now()
+	exportDate := runStartedAt.Format(dateLayout)
+	exportDateTime := runStartedAt.Format(dateLayout + "_15-04-05")
+	*folderName = expandDatePlaceholders(*folderName, exportDate, exportDateTime)
+
+	downloadOpts := DownloadOptions{
+		OnCollision:        *onCollision,
+		CommentTemplate:    *commentTmpl,
+		ExportDate:         exportDate,
+		ExportDateTime:     exportDateTime,
+		CI:                 *ciMode || !isTerminal(os.Stdout),
+		Bitrate:            requestedBitrate,
+		BitrateReport:      *bitrateRep,
+		DedupLink:          *dedupLink,
+		EventsInterval:     *eventsInterval,
+		TagISRC:            *tagISRC,
+		TagBPM:             *tagBPM,
+		ID3Version:         id3Version,
+		NoTags:             *noTags,
+		Quiet:              *quiet,
+		Prune:              *prune || *pruneHard,
+		PruneHard:          *pruneHard,
+		AssumeYes:          *assumeYes,
+		MaxTitleLength:     *maxTitleLength,
+		NameTemplate:       expandDatePlaceholders(*nameTemplate, exportDate, exportDateTime),
+		MaxArtists:         *maxArtists,
+		PrependIndex:       *prependIdx,
+		ExtensionMismatch:  *extMismatch,
+		PlaylistMeta:       *playlistMeta,
+		FailFast:           *failFast,
+		MinFree:            minFree,
+		IncludeUnavailable: *includeUnavailable,
+		RecheckRemoved:     *recheckRemoved,
+		MaxRetries:         *maxRetries,
+		RetryPermanent:     *retryPermanent,
+		Concurrency:        *concurrency,
+	}
+	var filter TrackFilter
+	if filter.MinDuration, err = parseTrackDuration(*minDuration); err != nil {
+		log.Fatalf("Ошибка: неверное значение -min-duration: %v", err)
+	}
+	if filter.MaxDuration, err = parseTrackDuration(*maxDuration); err != nil {
+		log.Fatalf("Ошибка: неверное значение -max-duration: %v", err)
+	}
+	if *excludeDislikes {
+		dislikes, err := client.GetDislikedTracks()
+		if err != nil {
+			fatalf(err, "Ошибка при получении дизлайкнутых треков: %v\n", err)
+		}
+		filter.ExcludeIDs = make(map[string]bool, len(dislikes))
+		for _, id := range dislikes {
+			filter.ExcludeIDs[id] = true
+		}
+	}
+	if *knownArtistsPath != "" {
+		if filter.KnownArtists, err = loadKnownArtists(*knownArtistsPath); err != nil {
+			log.Fatalf("Ошибка: неверное значение -known-artists: %v", err)
+		}
+	}
+	downloadOpts.Filter = filter
+
+	switch *layout {
+	case layoutFlat, layoutMediaServer:
+		downloadOpts.Layout = *layout
+	default:
+		log.Fatalf("Ошибка: неизвестная раскладка -layout: %s. Доступные: flat, media-server", *layout)
+	}
+
+	if *maxTitleLength < 0 {
+		log.Fatal("Ошибка: значение -max-title-length не может быть отрицательным")
+	}
+
+	if *nameTemplate != "" {
+		if err := parseNameTemplate(*nameTemplate); err != nil {
+			log.Fatalf("Ошибка: неверное значение -name-template: %v", err)
+		}
+	}
+
+	if *maxArtists < 0 {
+		log.Fatal("Ошибка: значение -max-artists не может быть отрицательным")
+	}
+
+	if *concurrency < 1 {
+		log.Fatal("Ошибка: значение -concurrency должно быть не меньше 1")
+	}
+	if *limit < 0 {
+		log.Fatal("Ошибка: значение -limit не может быть отрицательным")
+	}
+	if *connectTimeout < 0 || *tlsTimeout < 0 || *responseTimeout < 0 || *totalTimeout < 0 {
+		log.Fatal("Ошибка: таймауты не могут быть отрицательными")
+	}
+	if *perHostConc < 0 {
+		log.Fatal("Ошибка: значение -per-host-concurrency не может быть отрицательным")
+	}
+	if *likesConc < 1 {
+		log.Fatal("Ошибка: значение -likes-concurrency должно быть не меньше 1")
+	}
+	listOpts := ListOptions{
+		Concurrency: *concurrency,
+		Filter:      filter,
+		MaxArtists:  *maxArtists,
+
+		OnlyDownloadable: *onlyDownloadable,
+	}
+
+	switch *jsonProfile {
+	case jsonProfileSimple, jsonProfileDetailed, jsonProfileArrayArtists:
+		listOpts.JSONProfile = *jsonProfile
+	default:
+		log.Fatalf("Ошибка: неизвестный профиль -json-profile: %s. Доступные: simple, detailed, array-artists", *jsonProfile)
+	}
+
+	if *coverFile != "" {
+		if downloadOpts.Covers, err = OpenCoverSource(*coverFile); err != nil {
+			log.Fatalf("Ошибка: неверное значение -cover-file: %v", err)
+		}
+	}
+
+	switch *coverMode {
+	case "":
+	case coverModeEmbedAll, coverModeEmbedFirst, coverModeFolderOnly:
+		switch *command {
+		case "download-playlist", "download-likes", "sync-playlist", "download-artist", "retry", "merge", "wave":
+		default:
+			log.Fatal("Ошибка: флаг -cover-mode работает только с командами скачивания")
+		}
+		// folder.jpg общий для папки, поэтому без отдельной папки на альбом
+		// обложка одного альбома досталась бы трекам всех остальных
+		if *coverMode != coverModeEmbedAll && *layout != layoutMediaServer && !(*command == "download-artist" && *allAlbums) {
+			log.Fatalf("Ошибка: -cover-mode=%s требует отдельной папки для каждого альбома: -layout=media-server или download-artist -all-albums", *coverMode)
+		}
+		downloadOpts.CoverMode = *coverMode
+		// Без -cover-file встраивается обложка альбома из API
+		if downloadOpts.Covers == nil && *coverMode != coverModeFolderOnly {
+			downloadOpts.Covers = newAPICoverSource(client)
+		}
+	default:
+		log.Fatalf("Ошибка: неизвестный режим -cover-mode: %s. Доступные: embed-all, embed-first, folder-only", *coverMode)
+	}
+
+	if *catalogPath != "" {
+		catalog, err := OpenCatalog(*catalogPath)
+		if err != nil {
+			log.Fatalf("Ошибка открытия каталога %s: %v", *catalogPath, err)
+		}
+		defer catalog.Close()
+		downloadOpts.Catalog = catalog
+		listOpts.Catalog = catalog
+	}
+
+	if *eventsPath != "" {
+		if downloadOpts.Events, err = OpenEventWriter(*eventsPath); err != nil {
+			log.Fatalf("Ошибка: не удалось открыть файл событий %s: %v", *eventsPath, err)
+		}
+		defer downloadOpts.Events.Close()
+	}
+
+	if *dedupIndex != "" {
+		if downloadOpts.Dedup, err = LoadDedupIndex(*dedupIndex); err != nil {
+			log.Fatalf("Ошибка: неверное значение -dedup-index: %v", err)
+		}
+	}
+
+	// Обрабатываем команды
+	if *command == "" {
+		flag.Usage()
+		log.Fatal("Ошибка: необходимо указать команду через флаг -cmd")
+	}
+
+	// Сопутствующие файлы строятся из результатов скачивания в том же запуске
+	companion := CompanionOutputs{CSV: *csvOut, M3U: *m3uOut, JSON: *jsonOut}
+	withBOM, err := parseOutputEncoding(*outputEncoding, *bomFlag)
+	if err != nil {
+		log.Fatalf("Ошибка: неверное значение -output-encoding: %v", err)
+	}
+	stdoutBOM := withBOM && writesTextToStdout(*command, *folderName)
+	if withBOM && !stdoutBOM && companion.CSV == "" {
+		log.Fatal("Ошибка: метка порядка байтов (-bom, -output-encoding=utf-8-bom) применяется только к текстовому выводу команд просмотра и к файлу -csv")
+	}
+	companion.BOM = withBOM
+	switch *command {
+	case "download-playlist", "download-likes", "sync-playlist", "download-artist", "retry", "merge", "wave":
+	default:
+		if companion.Enabled() || *manifestPath != "" || *summaryPath != "" || *lyricsFile != "" || *eventsPath != "" || *targzPath != "" {
+			log.Fatal("Ошибка: флаги -csv, -m3u, -json, -manifest, -summary, -lyrics-file, -events и -targz работают только с командами скачивания")
+		}
+	}
+
+	if *onlyDownloadable {
+		switch {
+		case *command == "wave" && *folderName != "", *command != "playlist" && *command != "likes" && *command != "favorites" && *command != "wave":
+			log.Fatal("Ошибка: флаг -only-downloadable работает только с командами просмотра playlist, likes и wave")
+		case *groupByAlbum:
+			log.Fatal("Ошибка: флаг -only-downloadable несовместим с -group-by-album: при группировке ссылки не запрашиваются")
+		}
+	}
+
+	if *shuffle {
+		if *groupByAlbum {
+			log.Fatal("Ошибка: флаг -shuffle несовместим с -group-by-album: альбомы выводятся сгруппированными")
+		}
+		seed := *shuffleSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+			log.Printf("Порядок треков перемешан, seed: %d (повторить порядок: -seed=%d)\n", seed, seed)
+		}
+		listOpts.Shuffle, listOpts.ShuffleSeed = true, seed
+		downloadOpts.Shuffle, downloadOpts.ShuffleSeed = true, seed
+	} else if *shuffleSeed != 0 {
+		log.Fatal("Ошибка: флаг -seed работает только вместе с -shuffle")
+	}
+
+	switch *normalizeCase {
+	case caseAsIs:
+	case caseTitle:
+		downloadOpts.NormalizeCase = caseTitle
+	default:
+		log.Fatalf("Ошибка: неизвестный режим -normalize-case: %s. Доступные: none, title", *normalizeCase)
+	}
+
+	if *refreshTags && *command != "fix-tags" {
+		log.Fatal("Ошибка: флаг -refresh работает только с командой fix-tags")
+	}
+
+	if *maxRetries < 0 {
+		log.Fatal("Ошибка: значение -max-retries не может быть отрицательным")
+	}
+
+	if *completeAlbums {
+		if *command != "download-likes" {
+			log.Fatal("Ошибка: флаг -complete-albums работает только с командой download-likes")
+		}
+		if *completeThreshold < 1 || *completeThreshold > 100 {
+			log.Fatal("Ошибка: значение -complete-albums-threshold должно быть от 1 до 100")
+		}
+		downloadOpts.CompleteAlbums = *completeThreshold
+	}
+
+	if *addedSince != "" {
+		if *command != "playlist" && *command != "download-playlist" && *command != "template-preview" {
+			log.Fatal("Ошибка: флаг -added-since работает только с командами playlist, download-playlist и template-preview")
+		}
+		since, err := parseAddedSince(*addedSince)
+		if err != nil {
+			log.Fatalf("Ошибка: неверное значение -added-since: %v", err)
+		}
+		listOpts.AddedSince = since
+		downloadOpts.AddedSince = since
+	}
+
+	if *cue && (*command != "download-artist" || !*allAlbums) {
+		log.Fatal("Ошибка: флаг -cue работает только с командой download-artist и флагом -all-albums")
+	}
+
+	// Команды скачивания блокируют папку назначения, чтобы два запуска (например, с разных
+	// компьютеров в общую папку на NAS) не писали в неё и в файл состояния одновременно
+	// -to=webdav://...: файлы готовятся во временной папке и выгружаются на сервер
+	// target — папка назначения для отчётов: с WebDAV -to заменяется временной папкой,
+	// а в манифест и итог записывается адрес сервера
+	target := *folderName
+	var webdav *webdavDestination
+	if isWebDAVTarget(*folderName) {
+		switch *command {
+		case "download-playlist", "download-likes", "sync-playlist", "download-artist", "merge", "wave":
+		default:
+			log.Fatalf("Ошибка: выгрузка на WebDAV поддерживается командами download-playlist, download-likes, sync-playlist, download-artist, merge и wave")
+		}
+		if *prune || *pruneHard || *dedupIndex != "" || *catalogPath != "" || *m3uOut != "" || *targzPath != "" {
+			log.Fatal("Ошибка: флаги -prune, -prune-hard, -dedup-index, -catalog, -m3u и -targz работают только с локальной папкой -to")
+		}
+		if webdav, err = newWebDAVDestination(*folderName, client.client); err != nil {
+			log.Fatalf("Ошибка: неверное значение -to: %v", err)
+		}
+		defer runExitHooks()
+		atExit(webdav.Discard)
+		downloadOpts.infof("Выгрузка на WebDAV: %s\n", webdav)
+		downloadOpts.Destination = webdav
+		target = webdav.String()
+		*folderName = webdav.root
+	}
+
+	var lock *exportLock
+	switch *command {
+	case "download-playlist", "download-likes", "sync-playlist", "download-artist", "retry", "merge", "retag", "fix-tags", "wave":
+		if webdav != nil {
+			if lock, err = webdav.acquireLock(*breakLock); err != nil {
+				fatal("Ошибка: %v\n", err)
+			}
+			defer runExitHooks()
+			atExit(lock.Release)
+		} else if *folderName != "" {
+			if lock, err = acquireExportLock(*folderName, *breakLock); err != nil {
+				fatal("Ошибка: %v\n", err)
+			}
+			defer runExitHooks()
+			atExit(lock.Release)
+		}
+	}
+
+	if stdoutBOM {
+		os.Stdout.WriteString(utf8BOM)
+	}
+
+	// Итоги команд скачивания
+	var summary DownloadSummary
+	startedAt := time.Now()
+
+	switch *command {
+	case "playlist":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'playlist' необходимо указать ID плейлиста через флаг -id")
+		}
+		handlePlaylistTracks(client, *playlistID, *outputFmt, listOpts)
+	case "likes", "favorites":
+		handleLikes(client, *outputFmt, *groupByAlbum, listOpts)
+	case "list-playlists":
+		handleListPlaylists(client, *outputFmt)
+	case "history":
+		handleHistory(client, *outputFmt, *limit, listOpts)
+	case "export-podcasts":
+		handleExportPodcasts(client, *outputFmt)
+	case "export-all-tracks":
+		handleExportAllTracks(client, *outputFmt, listOpts)
+	case "info":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'info' необходимо указать ссылку или ID через флаг -id")
+		}
+		handleInfo(client, *playlistID, *outputFmt)
+	case "download-playlist":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'download-playlist' необходимо указать ID плейлиста через флаг -id")
+		}
+		if *folderName == "" {
+			fatal("Ошибка: для команды 'download-playlist' необходимо указать папку через флаг -to")
+		}
+		summary = handleDownloadPlaylist(client, *playlistID, *folderName, downloadOpts)
+	case "wave":
+		if *waveCount < 1 {
+			fatal("Ошибка: значение -count должно быть не меньше 1")
+		}
+		summary = handleWave(client, *waveCount, *folderName, *outputFmt, listOpts, downloadOpts)
+	case "download-likes":
+		if *folderName == "" {
+			fatal("Ошибка: для команды 'download-likes' необходимо указать папку через флаг -to")
+		}
+		summary = handleDownloadLikes(client, *folderName, downloadOpts)
+	case "sync-playlist":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'sync-playlist' необходимо указать ID плейлиста через флаг -id")
+		}
+		if *folderName == "" {
+			fatal("Ошибка: для команды 'sync-playlist' необходимо указать папку через флаг -to")
+		}
+		summary = handleSyncPlaylist(client, *playlistID, *folderName, downloadOpts)
+	case "download-artist":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'download-artist' необходимо указать ID исполнителя через флаг -id")
+		}
+		if *folderName == "" {
+			fatal("Ошибка: для команды 'download-artist' необходимо указать папку через флаг -to")
+		}
+		downloadOpts.Cue = *cue
+		summary = handleDownloadArtist(client, *playlistID, *folderName, *allAlbums, downloadOpts)
+	case "merge":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'merge' необходимо указать ID плейлистов через запятую во флаге -id")
+		}
+		if *folderName == "" {
+			fatal("Ошибка: для команды 'merge' необходимо указать папку через флаг -to")
+		}
+		summary = handleMerge(client, *playlistID, *folderName, downloadOpts)
+	case "retry":
+		if *errorReport == "" {
+			fatal("Ошибка: для команды 'retry' необходимо указать отчёт прошлого запуска через флаг -error-report")
+		}
+		if *folderName == "" {
+			fatal("Ошибка: для команды 'retry' необходимо указать папку через флаг -to")
+		}
+		summary = handleRetry(client, *errorReport, *folderName, downloadOpts)
+	case "link":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'link' необходимо указать ID трека через флаг -id")
+		}
+		handleLink(client, *playlistID)
+	case "list-formats":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'list-formats' необходимо указать ID трека через флаг -id")
+		}
+		handleListFormats(client, *playlistID, *outputFmt)
+	case "covers":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'covers' необходимо указать ID плейлиста через флаг -id")
+		}
+		if *folderName == "" {
+			fatal("Ошибка: для команды 'covers' необходимо указать папку через флаг -to")
+		}
+		handleCovers(client, *playlistID, *folderName, *coverSize, listOpts)
+	case "fix-tags":
+		if *folderName == "" {
+			fatal("Ошибка: для команды 'fix-tags' необходимо указать папку через флаг -to")
+		}
+		if code := handleFixTags(client, *folderName, *refreshTags, downloadOpts); code != exitOK {
+			lock.Release()
+			exit(code)
+		}
+	case "retag":
+		if *folderName == "" {
+			fatal("Ошибка: для команды 'retag' необходимо указать папку через флаг -to")
+		}
+		if code := handleRetag(client, *folderName, downloadOpts); code != exitOK {
+			lock.Release()
+			exit(code)
+		}
+	case "doctor":
+		if code := handleDoctor(client, tokenSource, tokenErr, *playlistID); code != exitOK {
+			exit(code)
+		}
+	case "template-preview":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'template-preview' необходимо указать ID плейлиста через флаг -id")
+		}
+		handleTemplatePreview(client, *playlistID, *folderName, *outputFmt, *limit, downloadOpts)
+	case "stream":
+		if *playlistID == "" {
+			fatal("Ошибка: для команды 'stream' необходимо указать ID трека через флаг -id")
+		}
+		handleStream(client, *playlistID, *quiet)
+	default:
+		fatal("Неизвестная команда: %s. Доступные команды: playlist, likes, wave, list-playlists, download-playlist, download-likes, sync-playlist, download-artist, merge, retry, retag, fix-tags, template-preview, link, stream, doctor, list-formats, history, covers, login, export-podcasts, export-all-tracks, info", *command)
+	}
+
+	if webdav != nil {
+		if err := webdav.Flush(); err != nil {
+			fatal("Ошибка выгрузки на WebDAV: %v\n", err)
+		}
+	}
+
+	if *showStats {
+		stats := client.TrackCacheStats()
+		log.Printf("Кэш треков: запросов %d, из кэша %d, загружено из API %d\n", stats.Hits+stats.Misses, stats.Hits, stats.Misses)
+		throttle := client.ThrottleStats()
+		log.Printf("Ограничения API: ответов 429: %d, капч: %d, повторов: %d (удалось: %d, безуспешно: %d)\n",
+			throttle.Throttled, throttle.Captchas, throttle.Retries, throttle.RetriesSucceeded, throttle.RetriesGaveUp)
+	}
+
+	if companion.Enabled() {
+		// Пути в -csv и -json указывают туда, где файлы остались, а не во временную папку WebDAV
+		results := summary.Results
+		if webdav != nil {
+			results = make([]TrackResult, len(summary.Results))
+			for i, r := range summary.Results {
+				r.Path = trackLocation(webdav, r.Path)
+				results[i] = r
+			}
+		}
+		if err := companion.Write(results); err != nil {
+			fatal("Ошибка: %v\n", err)
+		}
+	}
+
+	if *lyricsFile != "" {
+		written, err := writeLyricsFile(client, *lyricsFile, summary.Results)
+		if err != nil {
+			fatal("Ошибка записи текстов песен %s: %v\n", *lyricsFile, err)
+		}
+		downloadOpts.infof("Текстов песен записано в %s: %d из %d\n", *lyricsFile, written, len(summary.Results))
+	}
+
+	if *manifestPath != "" {
+		manifest := newManifest(*command, *playlistID, target, *folderName, ManifestOptions{
+			Layout:             downloadOpts.Layout,
+			OnCollision:        downloadOpts.OnCollision,
+			Bitrate:            downloadOpts.Bitrate,
+			Quality:            *quality,
+			MaxTitleLength:     downloadOpts.MaxTitleLength,
+			NameTemplate:       *nameTemplate,
+			MaxArtists:         downloadOpts.MaxArtists,
+			PrependIndex:       downloadOpts.PrependIndex,
+			CommentTemplate:    downloadOpts.CommentTemplate,
+			ISRC:               downloadOpts.TagISRC,
+			BPM:                downloadOpts.TagBPM,
+			ID3Version:         *id3VersionFlag,
+			NoTags:             *noTags,
+			MinDuration:        *minDuration,
+			MaxDuration:        *maxDuration,
+			ExcludeDislikes:    *excludeDislikes,
+			AllAlbums:          *allAlbums,
+			CoverFile:          *coverFile,
+			CoverMode:          downloadOpts.CoverMode,
+			AddedSince:         *addedSince,
+			CompleteAlbums:     downloadOpts.CompleteAlbums,
+			NormalizeCase:      downloadOpts.NormalizeCase,
+			ShuffleSeed:        downloadOpts.ShuffleSeed,
+			DateFormat:         dateFormatOption(*dateFormat),
+			KnownArtists:       *knownArtistsPath,
+			Lang:               *lang,
+			Region:             *region,
+			IncludeUnavailable: downloadOpts.IncludeUnavailable,
+			DedupLink:          dedupLinkOption(*dedupIndex, *dedupLink),
+			Cue:                downloadOpts.Cue,
+		}, summary)
+		if len(queryParams) > 0 {
+			manifest.Extra = queryParams
+		}
+		if err := manifest.Save(*manifestPath); err != nil {
+			fatal("Ошибка записи манифеста %s: %v\n", *manifestPath, err)
+		}
+	}
+
+	if *targzPath != "" {
+		added, err := writeTarGz(*targzPath, *folderName, []string{*manifestPath, *csvOut, *m3uOut, *jsonOut, *bitrateRep, *lyricsFile})
+		if err != nil {
+			fatal("Ошибка записи архива %s: %v\n", *targzPath, err)
+		}
+		downloadOpts.infof("Архив %s: файлов %d\n", *targzPath, added)
+	}
+
+	// Об ошибках отдельных треков сообщает код выхода: частичный или полный провал
+	code := summary.ExitCode()
+	// С -strict неполным результатом считаются и пропуски из-за недоступности, и превью
+	if incomplete := summary.Incomplete(); *strict && len(incomplete) > 0 {
+		log.Printf("Выгрузка неполная (-strict): не получено полностью треков: %d\n", len(incomplete))
+		for _, result := range incomplete {
+			reason := result.Status
+			if result.Preview {
+				reason = "preview"
+			}
+			if result.Error != "" {
+				reason += ": " + result.Error
+			}
+			log.Printf("  %s — %s (%s) [%s]\n", result.Artist, result.Title, result.ID, reason)
+		}
+		if code == exitOK {
+			code = exitPartial
+			if summary.Downloaded+summary.Skipped == 0 {
+				code = exitFailure
+			}
+		}
+	}
+	if *summaryPath != "" {
+		run := newRunSummary(*command, *playlistID, target, summary, client.TransferredBytes(), startedAt, time.Now(), code)
+		if err := run.Save(*summaryPath); err != nil {
+			fatal("Ошибка записи итога %s: %v\n", *summaryPath, err)
+		}
+	}
+	if code != exitOK {
+		lock.Release()
+		exit(code)
+	}
+}
+
+// handlePlaylistTracks обрабатывает команду playlist
+func handlePlaylistTracks(client *YandexMusicClient, playlistID string, outputFmt string, opts ListOptions) {
+	tracks, err := client.GetPlaylistTracks(playlistID)
+	if err != nil {
+		fatalf(err, "Ошибка при получении треков плейлиста: %v\n", err)
+	}
+
+	if opts.Catalog != nil {
+		if err := opts.Catalog.SaveTrackShorts(tracks); err != nil {
+			log.Printf("Предупреждение: не удалось записать треки в каталог: %v\n", err)
+		}
+	}
+
+	if !opts.AddedSince.IsZero() {
+		tracks = applyAddedSince(tracks, opts.AddedSince)
+	}
+	renderTracks(client, tracks, outputFmt, opts)
+}
+
+// handleLikes обрабатывает команду likes
+func handleLikes(client *YandexMusicClient, outputFmt string, groupByAlbum bool, opts ListOptions) {
+	likedTracks, err := client.GetLikedTracks("")
+	if err != nil {
+		fatalf(err, "Ошибка при получении избранных треков: %v\n", err)
+	}
+
+	if opts.Catalog != nil {
+		if err := opts.Catalog.SaveTrackShorts(likedTracks); err != nil {
+			log.Printf("Предупреждение: не удалось записать треки в каталог: %v\n", err)
+		}
+	}
+
+	if groupByAlbum {
+		renderAlbumGroups(likedTracks, outputFmt, opts)
+		return
+	}
+	renderTracks(client, likedTracks, outputFmt, opts)
+}
+
+// AlbumGroup представляет альбом с лайкнутыми из него треками в выводе likes -group-by-album
+type AlbumGroup struct {
+	ID         string            `json:"id,omitempty"`
+	Title      string            `json:"title"`
+	Artist     string            `json:"artist,omitempty"`
+	Year       int               `json:"year,omitempty"`
+	TrackCount int               `json:"trackCount,omitempty"` // Всего треков в альбоме (0 — API не сообщил)
+	Tracks     []AlbumGroupTrack `json:"tracks"`
+}
+
+// AlbumGroupTrack представляет лайкнутый трек внутри AlbumGroup
+type AlbumGroupTrack struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Artist      string `json:"artist"`
+	TrackNumber int    `json:"trackNumber,omitempty"`
+}
+
+// groupTracksByAlbum группирует треки по первому альбому: альбомы упорядочены по названию,
+// треки внутри — по номеру в альбоме. Треки без альбома собираются в группу «Без альбома» в конце
+func groupTracksByAlbum(tracks []TrackShort, maxArtists int) []AlbumGroup {
+	var groups []*AlbumGroup
+	byID := make(map[string]*AlbumGroup)
+	for _, trackShort := range tracks {
+		track := trackShort.Track
+		key := ""
+		var album Album
+		if len(track.Albums) > 0 {
+			album = track.Albums[0]
+			key = formatID(album.ID)
+		}
+		group, ok := byID[key]
+		if !ok {
+			group = &AlbumGroup{ID: key, Title: album.Title, Year: album.Year, TrackCount: album.TrackCount}
+			if key == "" {
+				group.Title = "Без альбома"
+			}
+			var names []string
+			for _, artist := range album.Artists {
+				names = append(names, artist.Name)
+			}
+			group.Artist = strings.Join(names, ", ")
+			byID[key] = group
+			groups = append(groups, group)
+		}
+		group.Tracks = append(group.Tracks, AlbumGroupTrack{
+			ID:          track.TrackID(),
+			Title:       track.Title,
+			Artist:      track.DisplayArtists(maxArtists),
+			TrackNumber: track.TrackNumber,
+		})
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if (a.ID == "") != (b.ID == "") {
+			return b.ID == ""
+		}
+		if ta, tb := strings.ToLower(a.Title), strings.ToLower(b.Title); ta != tb {
+			return ta < tb
+		}
+		return a.ID < b.ID
+	})
+	result := make([]AlbumGroup, len(groups))
+	for i, group := range groups {
+		// Треки без номера идут после пронумерованных в порядке лайков
+		sort.SliceStable(group.Tracks, func(i, j int) bool {
+			a, b := group.Tracks[i].TrackNumber, group.Tracks[j].TrackNumber
+			if (a == 0) != (b == 0) {
+				return b == 0
+			}
+			return a < b
+		})
+		result[i] = *group
+	}
+	return result
+}
+
+// renderAlbumGroups выводит треки, сгруппированные по альбомам, в текстовом или JSON формате.
+// Ссылки на MP3 не запрашиваются
+func renderAlbumGroups(tracks []TrackShort, outputFmt string, opts ListOptions) {
+	tracks, excluded := opts.Filter.Apply(tracks)
+	if excluded > 0 {
+		log.Printf("Исключено фильтрами: %d\n", excluded)
+	}
+	groups := groupTracksByAlbum(tracks, opts.MaxArtists)
+
+	if outputFmt == "json" {
+		jsonData, err := json.MarshalIndent(groups, "", "  ")
+		if err != nil {
+			fatal("Ошибка формирования JSON: %v\n", err)
+		}
+		fmt.Println(string(jsonData))
+		return
+	}
+
+	// Текстовый формат: заголовок альбома с числом лайкнутых треков из общего,
+	// под ним треки: {номер}. {название} — {исполнители} \t {ID трека}
+	for i, group := range groups {
+		if i > 0 {
+			fmt.Println()
+		}
+		header := group.Title
+		if group.Artist != "" {
+			header += " — " + group.Artist
+		}
+		if group.Year > 0 {
+			header += fmt.Sprintf(" (%d)", group.Year)
+		}
+		if group.TrackCount > 0 {
+			header += fmt.Sprintf(" [%d из %d]", len(group.Tracks), group.TrackCount)
+		} else {
+			header += fmt.Sprintf(" [%d]", len(group.Tracks))
+		}
+		fmt.Println(header)
+		for _, track := range group.Tracks {
+			number := "    "
+			if track.TrackNumber > 0 {
+				number = fmt.Sprintf("%2d. ", track.TrackNumber)
+			}
+			fmt.Printf("  %s%s — %s\t%s\n", number, track.Title, track.Artist, track.ID)
+		}
+	}
+}
+
+// handleHistory обрабатывает команду history: выводит недавно прослушанные треки
+// с днём прослушивания
+func handleHistory(client *YandexMusicClient, outputFmt string, limit int, opts ListOptions) {
+	entries, err := client.GetPlayHistory(limit)
+	if err != nil {
+		fatalf(err, "Ошибка при получении истории прослушиваний: %v\n", err)
+	}
+
+	if outputFmt == "json" {
+		jsonData, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			fatal("Ошибка формирования JSON: %v\n", err)
+		}
+		fmt.Println(string(jsonData))
+		return
+	}
+
+	// Текстовый формат: {день} \t {название} — {исполнители} \t {ID трека}
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s — %s\t%s\n", entry.PlayedOn, entry.Track.Title, entry.Track.DisplayArtists(opts.MaxArtists), entry.Track.TrackID())
+	}
+}
+
+// TrackOutput представляет трек в выводе команд просмотра
+type TrackOutput struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Link   string `json:"link"`
+}
+
+// Режимы -normalize-case
+const (
+	caseAsIs  = "none"  // Как в API
+	caseTitle = "title" // Каждое слово с заглавной буквы, с оговорками titleCase
+)
+
+// titleCaseParticles — служебные слова, которые внутри строки остаются строчными
+var titleCaseParticles = map[string]bool{
+	"a": true, "an": true, "and": true, "as": true, "at": true, "but": true, "by": true,
+	"for": true, "from": true, "in": true, "into": true, "nor": true, "of": true, "on": true,
+	"or": true, "the": true, "to": true, "vs": true, "vs.": true, "with": true, "feat.": true,
+	"ft.": true, "de": true, "del": true, "della": true, "der": true, "des": true, "di": true,
+	"du": true, "la": true, "le": true, "van": true, "von": true, "y": true,
+}
+
+// titleCase осторожно приводит строку к виду «Каждое Слово С Заглавной»:
+//   - строка целиком из заглавных букв не меняется — это название вроде ABBA или ДДТ;
+//   - слово из заглавных букв внутри строки со строчными остаётся аббревиатурой (DJ, UB40),
+//     кроме служебных слов («THE beatles» → «The Beatles»);
+//   - слова со смешанным регистром (McCartney, deadmau5) и с цифрами не меняются;
+//   - служебные слова (of, the, von и т. п.) внутри строки пишутся строчными;
+//   - в кириллице принято писать с заглавной только первое слово, поэтому у кириллических
+//     слов, кроме первого, регистр не меняется.
+func titleCase(s string) string {
+	hasLower := false
+	for _, r := range s {
+		hasLower = hasLower || unicode.IsLower(r)
+	}
+	if !hasLower {
+		return s
+	}
+
+	words := strings.Split(s, " ")
+	first := true
+	for i, word := range words {
+		if word == "" {
+			continue
+		}
+		words[i] = titleCaseWord(word, first)
+		first = false
+	}
+	return strings.Join(words, " ")
+}
+
+// titleCaseWord меняет регистр одного слова по правилам titleCase
+func titleCaseWord(word string, first bool) string {
+	lower := strings.ToLower(word)
+	var letters, upper, lowerCount int
+	cyrillic := false
+	for _, r := range word {
+		switch {
+		case unicode.IsDigit(r):
+			return word
+		case unicode.IsUpper(r):
+			letters++
+			upper++
+		case unicode.IsLower(r):
+			letters++
+			lowerCount++
+		}
+		cyrillic = cyrillic || unicode.Is(unicode.Cyrillic, r)
+	}
+	if letters == 0 {
+		return word
+	}
+	if cyrillic && !first {
+		return word
+	}
+	if !first && titleCaseParticles[lower] {
+		return lower
+	}
+	switch {
+	case lowerCount == letters:
+		return capitalizeFirst(word)
+	case upper == letters && titleCaseParticles[lower]:
+		return capitalizeFirst(lower)
+	}
+	// Аббревиатуры и слова со смешанным регистром оставляем как есть
+	return word
+}
+
+// capitalizeFirst делает заглавной первую букву слова, пропуская начальные знаки
+// препинания («(live)» → «(Live)»)
+func capitalizeFirst(word string) string {
+	runes := []rune(word)
+	for i, r := range runes {
+		if unicode.IsLetter(r) {
+			runes[i] = unicode.ToUpper(r)
+			break
+		}
+	}
+	return string(runes)
+}
+
+// Профили JSON-вывода команд просмотра (-json-profile)
+const (
+	jsonProfileSimple       = "simple"        // {title, artist, link} — как раньше
+	jsonProfileDetailed     = "detailed"      // С ID, массивом исполнителей, альбомом и длительностью
+	jsonProfileArrayArtists = "array-artists" // Как simple, но исполнители — массивом artists
+)
+
+// ArrayArtistsTrackOutput представляет трек в профиле array-artists
+type ArrayArtistsTrackOutput struct {
+	Title   string   `json:"title"`
+	Artists []string `json:"artists"`
+	Link    string   `json:"link"`
+}
+
+// DetailedTrackOutput представляет трек в профиле detailed
+type DetailedTrackOutput struct {
+	ID         string                 `json:"id"`
+	Title      string                 `json:"title"`
+	Artists    []DetailedArtistOutput `json:"artists"`
+	Album      *DetailedAlbumOutput   `json:"album,omitempty"`
+	DurationMs int                    `json:"durationMs,omitempty"`
+	Link       string                 `json:"link"`
+}
+
+// DetailedArtistOutput представляет исполнителя в профиле detailed
+type DetailedArtistOutput struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+// DetailedAlbumOutput представляет альбом в профиле detailed
+type DetailedAlbumOutput struct {
+	ID    string `json:"id,omitempty"`
+	Title string `json:"title"`
+	Year  int    `json:"year,omitempty"`
+}
+
+// renderedTrack — трек вместе со строкой вывода; из него строится JSON выбранного профиля
+type renderedTrack struct {
+	track  Track
+	output TrackOutput
+}
+
+// profileJSON возвращает представление трека для JSON-вывода в профиле profile
+func (r renderedTrack) profileJSON(profile string) interface{} {
+	switch profile {
+	case jsonProfileArrayArtists:
+		artists := make([]string, 0, len(r.track.Artists))
+		for _, artist := range r.track.Artists {
+			artists = append(artists, artist.Name)
+		}
+		return ArrayArtistsTrackOutput{Title: r.output.Title, Artists: artists, Link: r.output.Link}
+	case jsonProfileDetailed:
+		out := DetailedTrackOutput{
+			ID:         r.track.TrackID(),
+			Title:      r.track.Title,
+			Artists:    make([]DetailedArtistOutput, 0, len(r.track.Artists)),
+			DurationMs: r.track.DurationMs,
+			Link:       r.output.Link,
+		}
+		for _, artist := range r.track.Artists {
+			out.Artists = append(out.Artists, DetailedArtistOutput{ID: formatID(artist.ID), Name: artist.Name})
+		}
+		if len(r.track.Albums) > 0 {
+			album := r.track.Albums[0]
+			out.Album = &DetailedAlbumOutput{ID: formatID(album.ID), Title: album.Title, Year: album.Year}
+		}
+		return out
+	}
+	return r.output
+}
+
+// renderTracks получает ссылки на MP3 для треков и выводит их в текстовом или JSON формате.
+// Ссылки получаются в opts.Concurrency потоков, но вывод всегда идёт в исходном порядке треков
+func renderTracks(client *YandexMusicClient, tracks []TrackShort, outputFmt string, opts ListOptions) {
+	// Сообщение об отфильтрованных треках идёт в stderr, чтобы не портить вывод в stdout
+	tracks, excluded := opts.Filter.Apply(tracks)
+	if excluded > 0 {
+		log.Printf("Исключено фильтрами: %d\n", excluded)
+	}
+	if opts.Shuffle {
+		tracks = shuffleTracks(tracks, opts.ShuffleSeed)
+	}
+
+	// С -only-downloadable трек без ссылки на полный трек остаётся в сборщике пустым
+	// местом (nil), чтобы не нарушать порядок вывода, но не выводится
+	results := newOrderedCollector(len(tracks), func(item *renderedTrack) {
+		// Текстовый формат: {trackname} \t {link}; JSON вывод будет после сбора всех результатов
+		if item != nil && outputFmt != "json" {
+			fmt.Printf("%s — %s\t%s\n", item.output.Title, item.output.Artist, item.output.Link)
+		}
+	})
+
+	var notDownloadable atomic.Int64
+	forEachConcurrently(len(tracks), opts.Concurrency, func(i int) {
+		track := tracks[i].Track
+		artistStr := track.DisplayArtists(opts.MaxArtists)
+
+		// Получаем ссылку на MP3
+		mp3URL, preview, err := client.getTrackDownloadLink(track.TrackID())
+		if err != nil {
+			log.Printf("Ошибка получения ссылки для трека %s: %v\n", track.Title, err)
+			mp3URL = ""
+		}
+		if opts.OnlyDownloadable && (err != nil || preview) {
+			notDownloadable.Add(1)
+			results.Put(i, nil)
+			return
+		}
+
+		results.Put(i, &renderedTrack{track: track, output: TrackOutput{
+			Title:  track.Title,
+			Artist: artistStr,
+			Link:   mp3URL,
+		}})
+	})
+
+	// JSON вывод
+	if outputFmt == "json" {
+		outputs := make([]interface{}, 0, len(tracks))
+		for _, item := range results.Items() {
+			if item != nil {
+				outputs = append(outputs, item.profileJSON(opts.JSONProfile))
+			}
+		}
+		jsonData, err := json.MarshalIndent(outputs, "", "  ")
+		if err != nil {
+			fatal("Ошибка формирования JSON: %v\n", err)
+		}
+		fmt.Println(string(jsonData))
+	}
+	if opts.OnlyDownloadable {
+		log.Printf("Исключено без ссылки на полный трек: %d\n", notDownloadable.Load())
+	}
+}
+
+// opmlDocument представляет OPML 2.0 со списком подписок
+type opmlDocument struct {
+	XMLName  xml.Name      `xml:"opml"`
+	Version  string        `xml:"version,attr"`
+	Title    string        `xml:"head>title"`
+	Created  string        `xml:"head>dateCreated"`
+	Outlines []opmlOutline `xml:"body>outline"`
+}
+
+// opmlOutline представляет одну подписку в OPML
+type opmlOutline struct {
+	Type        string `xml:"type,attr"`
+	Text        string `xml:"text,attr"`
+	Title       string `xml:"title,attr"`
+	URL         string `xml:"url,attr"`
+	Description string `xml:"description,attr,omitempty"`
+	Author      string `xml:"author,attr,omitempty"`
+}
+
+// handleExportPodcasts обрабатывает команду export-podcasts: выводит подписки на подкасты
+// в OPML (по умолчанию), JSON или тексте. RSS-лент API не отдаёт, поэтому каждая
+// подписка ссылается на страницу подкаста в Яндекс Музыке: это список для справки,
+// а не файл для импорта подписок в подкаст-приложение
+func handleExportPodcasts(client *YandexMusicClient, outputFmt string) {
+	podcasts, err := client.GetLikedPodcasts("")
+	if err != nil {
+		fatalf(err, "Ошибка при получении подписок на подкасты: %v\n", err)
+	}
+
+	type PodcastOutput struct {
+		Title       string `json:"title"`
+		ID          string `json:"id"`
+		Author      string `json:"author,omitempty"`
+		Description string `json:"description,omitempty"`
+		URL         string `json:"url"`
+		Cover       string `json:"cover,omitempty"`
+	}
+
+	podcastsOutput := make([]PodcastOutput, 0, len(podcasts))
+	for _, podcast := range podcasts {
+		authors := make([]string, 0, len(podcast.Artists))
+		for _, artist := range podcast.Artists {
+			authors = append(authors, artist.Name)
+		}
+		podcastsOutput = append(podcastsOutput, PodcastOutput{
+			Title:       podcast.Title,
+			ID:          formatID(podcast.ID),
+			Author:      strings.Join(authors, ", "),
+			Description: podcast.Description,
+			URL:         podcast.URL(),
+			Cover:       coverURL(podcast.CoverUri, tagCoverSize),
+		})
+	}
+
+	switch outputFmt {
+	case "", "opml":
+		doc := opmlDocument{
+			Version: "2.0",
+			Title:   "Подписки на подкасты Яндекс Музыки",
+			Created: time.Now().Format(time.RFC1123Z),
+		}
+		for _, podcast := range podcastsOutput {
+			doc.Outlines = append(doc.Outlines, opmlOutline{
+				Type:        "link",
+				Text:        podcast.Title,
+				Title:       podcast.Title,
+				URL:         podcast.URL,
+				Description: podcast.Description,
+				Author:      podcast.Author,
+			})
+		}
+		data, err := xml.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			fatal("Ошибка формирования OPML: %v\n", err)
+		}
+		fmt.Println(xml.Header + string(data))
+	case "json":
+		jsonData, err := json.MarshalIndent(podcastsOutput, "", "  ")
+		if err != nil {
+			fatal("Ошибка формирования JSON: %v\n", err)
+		}
+		fmt.Println(string(jsonData))
+	default:
+		// Текстовый формат: {title} \t {url}
+		for _, podcast := range podcastsOutput {
+			fmt.Printf("%s\t%s\n", podcast.Title, podcast.URL)
+		}
+	}
+}
+
+// handleListPlaylists обрабатывает команду list-playlists
+func handleListPlaylists(client *YandexMusicClient, outputFmt string) {
+	playlists, err := client.GetUserPlaylists("")
+	if err != nil {
+		fatalf(err, "Ошибка при получении списка плейлистов: %v\n", err)
+	}
+
+	// Подготавливаем данные для вывода
+	type PlaylistOutput struct {
+		Title  string `json:"title"`
+		ID     string `json:"id"`
+		UUID   string `json:"uuid,omitempty"`
+		Kind   int    `json:"kind,omitempty"`
+		Tracks int    `json:"tracks,omitempty"`
+	}
+
+	var playlistsOutput []PlaylistOutput
+	for _, playlist := range playlists {
+		// Определяем ID (приоритет UUID, затем Kind)
+		playlistID := playlist.CommandID()
+
+		playlistsOutput = append(playlistsOutput, PlaylistOutput{
+			Title:  playlist.Title,
+			ID:     playlistID,
+			UUID:   playlist.PlaylistUuid,
+			Kind:   playlist.Kind,
+			Tracks: playlist.TrackCount,
+		})
+
+		// Вывод в зависимости от формата
+		if outputFmt == "json" {
+			// JSON вывод будет после цикла
+		} else {
+			// Текстовый формат: {title} \t {id}
+			fmt.Printf("%s\t%s\n", playlist.Title, playlistID)
+		}
+	}
+
+	// JSON вывод
+	if outputFmt == "json" {
+		jsonData, err := json.MarshalIndent(playlistsOutput, "", "  ")
+		if err != nil {
+			fatal("Ошибка формирования JSON: %v\n", err)
+		}
+		fmt.Println(string(jsonData))
+	}
+}
+
+// handleExportAllTracks обрабатывает команду export-all-tracks: собирает треки всех
+// плейлистов пользователя в один список без повторов. У каждого трека перечислены
+// плейлисты, в которых он встречается. Плейлисты запрашиваются по очереди
+func handleExportAllTracks(client *YandexMusicClient, outputFmt string, opts ListOptions) {
+	playlists, err := client.GetUserPlaylists("")
+	if err != nil {
+		fatalf(err, "Ошибка при получении списка плейлистов: %v\n", err)
+	}
+
+	type ExportedTrack struct {
+		ID         string   `json:"id"`
+		Title      string   `json:"title"`
+		Artist     string   `json:"artist"`
+		Album      string   `json:"album,omitempty"`
+		DurationMs int      `json:"durationMs"`
+		Playlists  []string `json:"playlists"`
+	}
+
+	var exported []*ExportedTrack
+	byID := make(map[string]*ExportedTrack)
+	lastPlaylist := make(map[string]int) // Номер последнего плейлиста, записанного у трека (с 1)
+	excluded := 0
+	for i, playlist := range playlists {
+		playlistID := playlist.CommandID()
+		if playlistID == "" {
+			continue
+		}
+		// Прогресс идёт в stderr, чтобы не портить вывод в stdout
+		log.Printf("[%d/%d] Плейлист: %s\n", i+1, len(playlists), playlist.Title)
+		tracks, err := client.GetPlaylistTracks(playlistID)
+		if err != nil {
+			fatalf(err, "Ошибка при получении треков плейлиста %s: %v\n", playlist.Title, err)
+		}
+		if opts.Catalog != nil {
+			if err := opts.Catalog.SaveTrackShorts(tracks); err != nil {
+				log.Printf("Предупреждение: не удалось записать треки в каталог: %v\n", err)
+			}
+		}
+		tracks, n := opts.Filter.Apply(tracks)
+		excluded += n
+
+		for _, trackShort := range tracks {
+			track := trackShort.Track
+			id := track.TrackID()
+			entry, ok := byID[id]
+			if !ok {
+				artistNames := make([]string, 0, len(track.Artists))
+				for _, artist := range track.Artists {
+					artistNames = append(artistNames, artist.Name)
+				}
+				entry = &ExportedTrack{
+					ID:         id,
+					Title:      track.Title,
+					Artist:     strings.Join(artistNames, ", "),
+					DurationMs: track.DurationMs,
+				}
+				if len(track.Albums) > 0 {
+					entry.Album = track.Albums[0].Title
+				}
+				byID[id] = entry
+				exported = append(exported, entry)
+			}
+			// Трек может повторяться внутри одного плейлиста — плейлист записываем один раз
+			if lastPlaylist[id] != i+1 {
+				lastPlaylist[id] = i + 1
+				entry.Playlists = append(entry.Playlists, playlist.Title)
+			}
+		}
+	}
+	if excluded > 0 {
+		log.Printf("Исключено фильтрами: %d\n", excluded)
+	}
+	log.Printf("Уникальных треков: %d в %d плейлистах\n", len(exported), len(playlists))
+
+	switch outputFmt {
+	case "", "json":
+		jsonData, err := json.MarshalIndent(exported, "", "  ")
+		if err != nil {
+			fatal("Ошибка формирования JSON: %v\n", err)
+		}
+		fmt.Println(string(jsonData))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"id", "title", "artist", "album", "duration_ms", "playlists"})
+		for _, t := range exported {
+			w.Write([]string{t.ID, t.Title, t.Artist, t.Album, strconv.Itoa(t.DurationMs), strings.Join(t.Playlists, "; ")})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			fatal("Ошибка формирования CSV: %v\n", err)
+		}
+	default:
+		fatal("Ошибка: неизвестный формат -out для export-all-tracks: %s. Доступные: json, csv", outputFmt)
+	}
+}
+
+// Типы сущностей, которые распознаёт parseEntityRef
+const (
+	entityPlaylist = "playlist"
+	entityAlbum    = "album"
+	entityTrack    = "track"
+	entityArtist   = "artist"
+)
+
+// EntityRef указывает на сущность Яндекс Музыки, заданную ссылкой или ID
+type EntityRef struct {
+	Type  string // playlist, album, track или artist
+	ID    string // ID сущности; для плейлиста — kind или UUID
+	Owner string // Логин или uid владельца плейлиста (пусто — текущий пользователь)
+}
+
+// parseEntityRef разбирает ссылку на music.yandex.ru (любой домен) или ID. Поддерживаются:
+//
+//	/users/{владелец}/playlists/{kind}, /playlists/{uuid} — плейлист
+//	/album/{id} — альбом; /album/{id}/track/{id} и /track/{id} — трек
+//	/artist/{id} — исполнитель
+//
+// Значение без схемы и слэшей считается ID плейлиста, как в остальных командах
+func parseEntityRef(value string) (EntityRef, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		if value == "" {
+			return EntityRef{}, fmt.Errorf("пустой ID")
+		}
+		return EntityRef{Type: entityPlaylist, ID: value}, nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return EntityRef{}, fmt.Errorf("неверная ссылка: %w", err)
+	}
+	if u.Host == "" && !strings.HasPrefix(value, "/") {
+		// Ссылка без схемы: music.yandex.ru/album/1
+		if u, err = url.Parse("https://" + value); err != nil {
+			return EntityRef{}, fmt.Errorf("неверная ссылка: %w", err)
+		}
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 4 && parts[0] == "users" && parts[2] == "playlists":
+		return EntityRef{Type: entityPlaylist, ID: parts[3], Owner: parts[1]}, nil
+	case len(parts) == 2 && parts[0] == "playlists":
+		return EntityRef{Type: entityPlaylist, ID: parts[1]}, nil
+	case len(parts) == 4 && parts[0] == "album" && parts[2] == "track":
+		return EntityRef{Type: entityTrack, ID: parts[3]}, nil
+	case len(parts) == 2 && parts[0] == "album":
+		return EntityRef{Type: entityAlbum, ID: parts[1]}, nil
+	case len(parts) == 2 && parts[0] == "track":
+		return EntityRef{Type: entityTrack, ID: parts[1]}, nil
+	case len(parts) == 2 && parts[0] == "artist":
+		return EntityRef{Type: entityArtist, ID: parts[1]}, nil
+	}
+	return EntityRef{}, fmt.Errorf("не удалось распознать ссылку %s: ожидается ссылка на плейлист, альбом, трек или исполнителя", value)
+}
+
+// EntityInfo представляет сводку о сущности для команды info
+type EntityInfo struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Title      string   `json:"title"`
+	Artists    []string `json:"artists,omitempty"`
+	Owner      string   `json:"owner,omitempty"`
+	Album      string   `json:"album,omitempty"`
+	Year       int      `json:"year,omitempty"`
+	Genres     []string `json:"genres,omitempty"`
+	DurationMs int      `json:"durationMs,omitempty"`
+	Tracks     int      `json:"tracks,omitempty"`
+	Albums     int      `json:"albums,omitempty"`
+	Visibility string   `json:"visibility,omitempty"`
+	Revision   int      `json:"revision,omitempty"`
+	URL        string   `json:"url,omitempty"`
+}
+
+// fatalPlaylistPrivate завершает программу с подсказкой, что делать с приватным плейлистом
+// другого пользователя
+func fatalPlaylistPrivate(err error, ref EntityRef) {
+	fatalf(err, "Ошибка: плейлист %s пользователя %s приватный и недоступен с вашим токеном. Попросите владельца открыть доступ к плейлисту или экспортируйте его со своего аккаунта\n", ref.ID, ref.Owner)
+}
+
+// loadPlaylistRef получает плейлист по ссылке или ID из -id для команд скачивания;
+// если получить его не удалось, завершает программу
+func loadPlaylistRef(client *YandexMusicClient, value string) *Playlist {
+	ref, err := parseEntityRef(value)
+	if err != nil {
+		fatal("Ошибка: %v\n", err)
+	}
+	if ref.Type != entityPlaylist {
+		fatal("Ошибка: %s — ссылка не на плейлист\n", value)
+	}
+	playlist, err := client.GetPlaylistByRef(ref)
+	if errors.Is(err, ErrPlaylistPrivate) {
+		fatalPlaylistPrivate(err, ref)
+	}
+	if err != nil {
+		fatalf(err, "Ошибка при получении треков плейлиста: %v\n", err)
+	}
+	return playlist
+}
+
+// handleInfo обрабатывает команду info: распознаёт ссылку или ID и выводит сводку
+// о плейлисте, альбоме, треке или исполнителе, ничего не скачивая
+func handleInfo(client *YandexMusicClient, value string, outputFmt string) {
+	ref, err := parseEntityRef(value)
+	if err != nil {
+		fatal("Ошибка: %v", err)
+	}
+
+	info := EntityInfo{Type: ref.Type, ID: ref.ID}
+	switch ref.Type {
+	case entityPlaylist:
+		playlist, err := client.GetPlaylistByRef(ref)
+		if errors.Is(err, ErrPlaylistPrivate) {
+			fatalPlaylistPrivate(err, ref)
+		}
+		if err != nil {
+			fatalf(err, "Ошибка при получении плейлиста: %v\n", err)
+		}
+		info.Title = playlist.Title
+		info.Owner = playlist.Owner.Login
+		if playlist.Owner.Name != "" {
+			info.Owner = fmt.Sprintf("%s (%s)", playlist.Owner.Name, playlist.Owner.Login)
+		}
+		info.Tracks = playlist.TrackCount
+		if info.Tracks == 0 {
+			info.Tracks = len(playlist.Tracks)
+		}
+		info.Visibility = playlist.Visibility
+		info.Revision = playlist.Revision
+		info.URL = fmt.Sprintf("https://music.yandex.ru/users/%s/playlists/%d", playlist.Owner.Login, playlist.Kind)
+	case entityAlbum:
+		album, err := client.GetAlbum(ref.ID)
+		if err != nil {
+			fatalf(err, "Ошибка при получении альбома: %v\n", err)
+		}
+		info.Title = album.Title
+		for _, artist := range album.Artists {
+			info.Artists = append(info.Artists, artist.Name)
+		}
+		info.Year = album.Year
+		if album.Genre != "" {
+			info.Genres = []string{album.Genre}
+		}
+		info.Tracks = album.TrackCount
+		info.URL = "https://music.yandex.ru/album/" + ref.ID
+	case entityTrack:
+		track, err := client.getTrackByID(ref.ID)
+		if err != nil {
+			fatalf(err, "Ошибка при получении трека: %v\n", err)
+		}
+		info.Title = track.Title
+		for _, artist := range track.Artists {
+			info.Artists = append(info.Artists, artist.Name)
+		}
+		if len(track.Albums) > 0 {
+			info.Album = track.Albums[0].Title
+			info.Year = track.Albums[0].Year
+			info.URL = fmt.Sprintf("https://music.yandex.ru/album/%s/track/%s", formatID(track.Albums[0].ID), ref.ID)
+		}
+		info.DurationMs = track.DurationMs
+	case entityArtist:
+		artist, err := client.GetArtist(ref.ID)
+		if err != nil {
+			fatalf(err, "Ошибка при получении исполнителя: %v\n", err)
+		}
+		info.Title = artist.Name
+		info.Genres = artist.Genres
+		info.Tracks = artist.Counts.Tracks
+		info.Albums = artist.Counts.DirectAlbums
+		info.URL = "https://music.yandex.ru/artist/" + ref.ID
+	}
+
+	if outputFmt == "json" {
+		jsonData, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			fatal("Ошибка формирования JSON: %v\n", err)
+		}
+		fmt.Println(string(jsonData))
+		return
+	}
+
+	// Текстовый формат: по строке «Поле: значение», пустые поля не выводятся
+	typeNames := map[string]string{
+		entityPlaylist: "плейлист",
+		entityAlbum:    "альбом",
+		entityTrack:    "трек",
+		entityArtist:   "исполнитель",
+	}
+	printField := func(name string, value string) {
+		if value != "" && value != "0" {
+			fmt.Printf("%s: %s\n", name, value)
+		}
+	}
+	printField("Тип", typeNames[info.Type])
+	printField("ID", info.ID)
+	printField("Название", info.Title)
+	printField("Исполнители", strings.Join(info.Artists, ", "))
+	printField("Владелец", info.Owner)
+	printField("Альбом", info.Album)
+	printField("Год", strconv.Itoa(info.Year))
+	printField("Жанры", strings.Join(info.Genres, ", "))
+	if info.DurationMs > 0 {
+		printField("Длительность", formatTrackDuration(info.DurationMs))
+	}
+	printField("Треков", strconv.Itoa(info.Tracks))
+	printField("Альбомов", strconv.Itoa(info.Albums))
+	printField("Видимость", info.Visibility)
+	printField("Ревизия", strconv.Itoa(info.Revision))
+	printField("Ссылка", info.URL)
+}
+
+// handleLink обрабатывает команду link: выводит в stdout только прямую ссылку на MP3,
+// чтобы её можно было передать в curl или wget
+func handleLink(client *YandexMusicClient, trackID string) {
+	mp3URL, err := client.GetTrackDownloadURL(trackID)
+	if err != nil {
+		fatalf(err, "Ошибка получения ссылки для трека %s: %v\n", trackID, err)
+	}
+
+	fmt.Println(mp3URL)
+}
+
+// handleListFormats обрабатывает команду list-formats: выводит все варианты скачивания
+// трека из download-info — кодек, битрейт, частоту, каналы, превью и прямое скачивание
+func handleListFormats(client *YandexMusicClient, trackID string, outputFmt string) {
+	infos, err := client.GetTrackDownloadOptions(trackID)
+	if err != nil {
+		fatalf(err, "Ошибка получения вариантов скачивания трека %s: %v\n", trackID, err)
+	}
+
+	if outputFmt == "json" {
+		type formatOutput struct {
+			Codec      string `json:"codec"`
+			Bitrate    int    `json:"bitrate"`
+			SampleRate int    `json:"sampleRate,omitempty"`
+			Channels   int    `json:"channels,omitempty"`
+			Preview    bool   `json:"preview"`
+			Direct     bool   `json:"direct"`
+		}
+		formats := make([]formatOutput, 0, len(infos))
+		for _, info := range infos {
+			formats = append(formats, formatOutput{
+				Codec:      info.Codec,
+				Bitrate:    info.Bitrate,
+				SampleRate: info.SampleRate,
+				Channels:   info.Channels,
+				Preview:    info.Preview,
+				Direct:     info.Direct,
+			})
+		}
+		jsonData, err := json.MarshalIndent(formats, "", "  ")
+		if err != nil {
+			fatal("Ошибка сериализации в JSON: %v\n", err)
+		}
+		fmt.Println(string(jsonData))
+		return
+	}
+
+	// Неизвестные API значения выводятся прочерком
+	orDash := func(value int) string {
+		if value == 0 {
+			return "—"
+		}
+		return strconv.Itoa(value)
+	}
+	yesNo := func(value bool) string {
+		if value {
+			return "да"
+		}
+		return "нет"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "КОДЕК\tБИТРЕЙТ\tЧАСТОТА\tКАНАЛЫ\tПРЕВЬЮ\tПРЯМОЕ")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Codec, orDash(info.Bitrate), orDash(info.SampleRate),
+			orDash(info.Channels), yesNo(info.Preview), yesNo(info.Direct))
+	}
+	w.Flush()
+}
+
+// handleStream обрабатывает команду stream: пишет аудио трека в stdout, чтобы его можно
+// было передать другой программе. Все сообщения и прогресс идут в stderr, теги не пишутся
+func handleStream(client *YandexMusicClient, trackID string, quiet bool) {
+	infos, err := client.GetTrackDownloadInfo(trackID)
+	if err != nil {
+		fatalf(err, "Ошибка получения вариантов скачивания трека %s: %v\n", trackID, err)
+	}
+
+	var progress func(float64)
+	if !quiet {
+		progress = func(percent float64) {
+			fmt.Fprintf(os.Stderr, "\rПередача трека %s: %.0f%%", trackID, percent)
+		}
+	}
+	out := bufio.NewWriter(os.Stdout)
+	info, err := client.streamTrackWithFallback(infos, out, progress)
+	if err == nil {
+		err = out.Flush()
+	}
+	if progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		fatalf(err, "Ошибка передачи трека %s: %v\n", trackID, err)
+	}
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Передано: %s (%s)\n", trackID, info.Quality())
+	}
+}
+
+// handleDownloadPlaylist обрабатывает команду download-playlist
+func handleDownloadPlaylist(client *YandexMusicClient, playlistID string, folderName string, opts DownloadOptions) DownloadSummary {
+	playlist := loadPlaylistRef(client, playlistID)
+	tracks := playlist.Tracks
+
+	opts.infof("Найдено треков в плейлисте: %d\n", len(tracks))
+	opts.Source = "playlist"
+	opts.PlaylistTitle = playlist.Title
+	savePlaylistMetaIfRequested(client, folderName, playlist, opts)
+	// -prune сверяется со всем плейлистом: старые треки из него не удаляются
+	toDownload := tracks
+	if !opts.AddedSince.IsZero() {
+		toDownload = applyAddedSince(tracks, opts.AddedSince)
+	}
+	summary := downloadTracks(client, toDownload, folderName, opts)
+	pruneIfRequested(client, folderName, tracks, opts)
+	return summary
+}
+
+// handleMerge обрабатывает команду merge: скачивает объединение нескольких плейлистов
+// в одну папку. Трек, встречающийся в нескольких плейлистах, скачивается один раз и стоит
+// на месте первого появления, поэтому -m3u повторяет порядок плейлистов из -id
+func handleMerge(client *YandexMusicClient, playlistIDs string, folderName string, opts DownloadOptions) DownloadSummary {
+	var tracks []TrackShort
+	var titles []string
+	seen := make(map[string]bool)
+	total := 0
+	for _, playlistID := range strings.Split(playlistIDs, ",") {
+		playlistID = strings.TrimSpace(playlistID)
+		if playlistID == "" {
+			continue
+		}
+		playlist, err := client.GetPlaylist(playlistID)
+		if err != nil {
+			fatalf(err, "Ошибка при получении треков плейлиста %s: %v\n", playlistID, err)
+		}
+		opts.infof("Плейлист «%s»: %d треков\n", playlist.Title, len(playlist.Tracks))
+		titles = append(titles, playlist.Title)
+		for _, trackShort := range playlist.Tracks {
+			total++
+			trackID := trackShort.Track.TrackID()
+			if seen[trackID] {
+				continue
+			}
+			seen[trackID] = true
+			tracks = append(tracks, trackShort)
+		}
+	}
+	if len(titles) == 0 {
+		fatal("Ошибка: для команды 'merge' необходимо указать ID плейлистов через запятую во флаге -id")
+	}
+
+	opts.infof("Уникальных треков: %d, повторов объединено: %d\n", len(tracks), total-len(tracks))
+	opts.Source = "playlist"
+	opts.PlaylistTitle = strings.Join(titles, ", ")
+	summary := downloadTracks(client, tracks, folderName, opts)
+	pruneIfRequested(client, folderName, tracks, opts)
+	return summary
+}
+
+// handleCovers обрабатывает команду covers: сохраняет в folderName обложки альбомов
+// треков плейлиста, не скачивая аудио. Каждая обложка скачивается один раз и называется
+// {id альбома}.jpg, как файлы папки для -cover-file; уже сохранённые пропускаются
+func handleCovers(client *YandexMusicClient, playlistID string, folderName string, size string, opts ListOptions) {
+	playlist, err := client.GetPlaylist(playlistID)
+	if err != nil {
+		fatalf(err, "Ошибка при получении треков плейлиста: %v\n", err)
+	}
+	if err := os.MkdirAll(folderName, 0755); err != nil {
+		fatal("Ошибка создания папки %s: %v\n", folderName, err)
+	}
+
+	// Обложка альбома берётся у первого его трека
+	type albumCover struct {
+		id    string
+		title string
+		uri   string
+	}
+	var albums []albumCover
+	seen := make(map[string]bool)
+	for _, trackShort := range playlist.Tracks {
+		track := trackShort.Track
+		if len(track.Albums) == 0 {
+			continue
+		}
+		album := track.Albums[0]
+		albumID := formatID(album.ID)
+		if albumID == "" || seen[albumID] {
+			continue
+		}
+		seen[albumID] = true
+		uri := album.CoverUri
+		if uri == "" {
+			uri = trackCoverURI(track)
+		}
+		albums = append(albums, albumCover{id: albumID, title: album.Title, uri: uri})
+	}
+	fmt.Printf("Альбомов в плейлисте: %d\n", len(albums))
+
+	var mu sync.Mutex
+	saved, skipped, failed := 0, 0, 0
+	count := func(counter *int) {
+		mu.Lock()
+		*counter++
+		mu.Unlock()
+	}
+	forEachConcurrently(len(albums), opts.Concurrency, func(i int) {
+		album := albums[i]
+		coverPath := filepath.Join(folderName, album.id+".jpg")
+		if _, err := os.Stat(coverPath); err == nil {
+			count(&skipped)
+			return
+		}
+
+		url := coverURL(album.uri, size)
+		if url == "" {
+			log.Printf("Нет обложки у альбома %s (%s)\n", album.title, album.id)
+			count(&failed)
+			return
+		}
+		data, err := client.fetchCover(url)
+		if err != nil {
+			log.Printf("Ошибка скачивания обложки альбома %s (%s): %v\n", album.title, album.id, err)
+			count(&failed)
+			return
+		}
+		if err := os.WriteFile(coverPath, data, 0644); err != nil {
+			log.Printf("Ошибка записи обложки альбома %s (%s): %v\n", album.title, album.id, err)
+			count(&failed)
+			return
+		}
+		fmt.Printf("✓ %s.jpg — %s\n", album.id, album.title)
+		count(&saved)
+	})
+
+	fmt.Printf("\nСохранено обложек: %d, уже были: %d, ошибок: %d\n", saved, skipped, failed)
+	if failed > 0 && saved+skipped > 0 {
+		exit(exitPartial)
+	} else if failed > 0 {
+		exit(exitFailure)
+	}
+}
+
+// listMP3Files возвращает пути всех MP3 в папке и подпапках, кроме корзины .trash
+func listMP3Files(folderName string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(folderName, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == pruneTrashDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.EqualFold(filepath.Ext(path), ".mp3") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// handleRetag обрабатывает команду retag: перезаписывает теги MP3 в папке свежими метаданными.
+// Трек определяется по фрейму TXXX YANDEX_TRACK_ID, а у файлов без него — по имени файла
+// в файле состояния выгрузки. Возвращает код завершения
+func handleRetag(client *YandexMusicClient, folderName string, opts DownloadOptions) int {
+	// Сопоставление имени файла с ID трека для файлов, выгруженных без фрейма с ID
+	state, err := loadExportState(filepath.Join(folderName, exportStateFileName))
+	if err != nil {
+		fatal("Ошибка загрузки состояния выгрузки: %v\n", err)
+	}
+	idByFile := make(map[string]string)
+	for id, trackState := range state.Tracks {
+		if trackState.File != "" {
+			idByFile[filepath.ToSlash(trackState.File)] = id
+		}
+	}
+
+	files, err := listMP3Files(folderName)
+	if err != nil {
+		fatal("Ошибка обхода папки %s: %v\n", folderName, err)
+	}
+	fmt.Printf("MP3 файлов в папке: %d\n", len(files))
+
+	var mu sync.Mutex
+	byID, byName, unmatched, failed := 0, 0, 0, 0
+	count := func(counter *int) {
+		mu.Lock()
+		*counter++
+		mu.Unlock()
+	}
+	forEachConcurrently(len(files), opts.Concurrency, func(i int) {
+		path := files[i]
+		rel, _ := filepath.Rel(folderName, path)
+
+		trackID, err := readEmbeddedTrackID(path)
+		if err != nil {
+			log.Printf("Ошибка чтения %s: %v\n", rel, err)
+			count(&failed)
+			return
+		}
+		matched := &byID
+		if trackID == "" {
+			matched = &byName
+			trackID = idByFile[filepath.ToSlash(rel)]
+		}
+		if trackID == "" {
+			log.Printf("Не удалось определить трек для %s: нет фрейма %s и записи в %s\n", rel, trackIDFrameDescription, exportStateFileName)
+			count(&unmatched)
+			return
+		}
+
+		fetched, err := client.getTrackByID(trackID)
+		if err != nil {
+			log.Printf("Ошибка получения трека %s для %s: %v\n", trackID, rel, err)
+			count(&failed)
+			return
+		}
+		normalized := opts.normalizeTrack(*fetched)
+		track := &normalized
+		tagOpts := TagOptions{
+			ISRC:    opts.TagISRC,
+			BPM:     opts.TagBPM,
+			Version: opts.ID3Version,
+		}
+		if opts.Covers != nil {
+			if tagOpts.Cover, err = opts.Covers.ForTrack(*track); err != nil {
+				log.Printf("Предупреждение: обложка для %s не встроена (%v)\n", rel, err)
+			}
+		}
+		if err := writeID3Tags(path, *track, tagOpts); err != nil {
+			log.Printf("Ошибка записи тегов %s: %v\n", rel, err)
+			count(&failed)
+			return
+		}
+		fmt.Printf("✓ %s — %s\n", rel, track.Title)
+		count(matched)
+	})
+
+	fmt.Printf("\nПерезаписаны теги: %d (по фрейму ID: %d, по имени файла: %d), не определено: %d, ошибок: %d\n",
+		byID+byName, byID, byName, unmatched, failed)
+	switch {
+	case failed+unmatched == 0:
+		return exitOK
+	case byID+byName > 0:
+		return exitPartial
+	default:
+		return exitFailure
+	}
+}
+
+// handleFixTags обрабатывает команду fix-tags: приводит ID3-теги MP3 в папке к текущим
+// настройкам без повторного скачивания — версию ID3v2, кодировку текстовых фреймов,
+// кириллицу, записанную в однобайтовой кодировке Windows, и формат TRCK/TPOS. С refresh
+// теги файлов с фреймом YANDEX_TRACK_ID сначала перезаписываются свежими метаданными из API.
+// Каждое изменение выводится. Возвращает код завершения
+func handleFixTags(client *YandexMusicClient, folderName string, refresh bool, opts DownloadOptions) int {
+	files, err := listMP3Files(folderName)
+	if err != nil {
+		fatal("Ошибка обхода папки %s: %v\n", folderName, err)
+	}
+	fmt.Printf("MP3 файлов в папке: %d\n", len(files))
+
+	version := opts.ID3Version
+	if version == 0 {
+		version = defaultID3Version
+	}
+
+	var mu sync.Mutex
+	fixed, refreshed, unchanged, failed := 0, 0, 0, 0
+	count := func(counter *int) {
+		mu.Lock()
+		*counter++
+		mu.Unlock()
+	}
+	forEachConcurrently(len(files), opts.Concurrency, func(i int) {
+		path := files[i]
+		rel, _ := filepath.Rel(folderName, path)
+
+		var changes []string
+		if refresh {
+			trackID, err := readEmbeddedTrackID(path)
+			if err != nil {
+				log.Printf("Ошибка чтения %s: %v\n", rel, err)
+				count(&failed)
+				return
+			}
+			if trackID != "" {
+				track, err := client.getTrackByID(trackID)
+				if err != nil {
+					log.Printf("Ошибка получения трека %s для %s: %v\n", trackID, rel, err)
+					count(&failed)
+					return
+				}
+				tagOpts := TagOptions{ISRC: opts.TagISRC, BPM: opts.TagBPM, Version: version}
+				if err := writeID3Tags(path, opts.normalizeTrack(*track), tagOpts); err != nil {
+					log.Printf("Ошибка записи тегов %s: %v\n", rel, err)
+					count(&failed)
+					return
+				}
+				changes = append(changes, "метаданные обновлены из API")
+				count(&refreshed)
+			}
+		}
+
+		tagChanges, err := fixTagFrames(path, version)
+		if err != nil {
+			log.Printf("Ошибка исправления тегов %s: %v\n", rel, err)
+			count(&failed)
+			return
+		}
+		changes = append(changes, tagChanges...)
+		if len(changes) == 0 {
+			count(&unchanged)
+			return
+		}
+		mu.Lock()
+		fmt.Printf("✓ %s\n", rel)
+		for _, change := range changes {
+			fmt.Printf("    %s\n", change)
+		}
+		fixed++
+		mu.Unlock()
+	})
+
+	fmt.Printf("\nИсправлено файлов: %d (метаданные из API: %d), без изменений: %d, ошибок: %d\n", fixed, refreshed, unchanged, failed)
+	switch {
+	case failed == 0:
+		return exitOK
+	case fixed+unchanged > 0:
+		return exitPartial
+	default:
+		return exitFailure
+	}
+}
+
+// fixTagFrames приводит теги файла к версии ID3v2 version и сохраняет файл, если что-то
+// изменилось. Возвращает описания изменений
+func fixTagFrames(filePath string, version byte) ([]string, error) {
+	tag, err := id3v2.Open(filePath, id3v2.Options{Parse: true})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения тегов: %w", err)
+	}
+	defer tag.Close()
+	if !tag.HasFrames() {
+		return nil, nil
+	}
+
+	var changes []string
+	if from := tag.Version(); from != version {
+		changes = append(changes, fmt.Sprintf("версия ID3v2.%d → ID3v2.%d", from, version))
+		// Год в v2.3 хранится в TYER, в v2.4 — в TDRC
+		oldYear, newYear := "TYER", "TDRC"
+		if version == 3 {
+			oldYear, newYear = "TDRC", "TYER"
+		}
+		if frame, ok := tag.GetLastFrame(oldYear).(id3v2.TextFrame); ok {
+			tag.DeleteFrames(oldYear)
+			if version == 3 && len(frame.Text) > 4 {
+				frame.Text = frame.Text[:4]
+			}
+			tag.AddFrame(newYear, frame)
+			changes = append(changes, fmt.Sprintf("год перенесён из %s в %s", oldYear, newYear))
+		}
+	}
+	tag.SetVersion(version)
+	// v2.3 не знает UTF-8, а ISO-8859-1 не вмещает кириллицу: для v2.3 — UTF-16, для v2.4 — UTF-8
+	encoding := id3v2.EncodingUTF8
+	if version == 3 {
+		encoding = id3v2.EncodingUTF16
+	}
+	tag.SetDefaultEncoding(encoding)
+
+	allFrames := tag.AllFrames()
+	ids := make([]string, 0, len(allFrames))
+	for id := range allFrames {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, frame := range allFrames[id] {
+			switch f := frame.(type) {
+			case id3v2.TextFrame:
+				text := fixTextValue(id, f.Encoding, f.Text, version, &changes)
+				if reencode := needsReencoding(f.Encoding, encoding, text); text != f.Text || reencode {
+					if reencode {
+						changes = append(changes, fmt.Sprintf("%s: кодировка %s → %s", id, f.Encoding, encoding))
+					}
+					tag.AddFrame(id, id3v2.TextFrame{Encoding: encoding, Text: text})
+				}
+			case id3v2.UserDefinedTextFrame:
+				value := fixTextValue(id, f.Encoding, f.Value, version, &changes)
+				if reencode := needsReencoding(f.Encoding, encoding, value); value != f.Value || reencode {
+					if reencode {
+						changes = append(changes, fmt.Sprintf("%s %s: кодировка %s → %s", id, f.Description, f.Encoding, encoding))
+					}
+					tag.AddUserDefinedTextFrame(id3v2.UserDefinedTextFrame{Encoding: encoding, Description: f.Description, Value: value})
+				}
+			case id3v2.CommentFrame:
+				text := fixTextValue(id, f.Encoding, f.Text, version, &changes)
+				if reencode := needsReencoding(f.Encoding, encoding, text); text != f.Text || reencode {
+					if reencode {
+						changes = append(changes, fmt.Sprintf("%s: кодировка %s → %s", id, f.Encoding, encoding))
+					}
+					tag.AddCommentFrame(id3v2.CommentFrame{Encoding: encoding, Language: f.Language, Description: f.Description, Text: text})
+				}
+			}
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	if err := tag.Save(); err != nil {
+		return nil, fmt.Errorf("ошибка сохранения тегов: %w", err)
+	}
+	return changes, nil
+}
+
+// needsReencoding сообщает, нужно ли переписать фрейм в кодировке target. Текст из одних
+// ASCII-символов в ISO-8859-1 читается везде одинаково и остаётся как есть
+func needsReencoding(current id3v2.Encoding, target id3v2.Encoding, text string) bool {
+	if current.Equals(target) {
+		return false
+	}
+	if current.Equals(id3v2.EncodingISO) {
+		for _, r := range text {
+			if r >= utf8.RuneSelf {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// fixTextValue исправляет значение текстового фрейма id: восстанавливает кириллицу,
+// записанную в cp1251 под видом ISO-8859-1, нормализует TRCK/TPOS и разделители
+// нескольких значений для версии version. Изменения дописываются в changes
+func fixTextValue(id string, encoding id3v2.Encoding, text string, version byte, changes *[]string) string {
+	fixed := text
+	if encoding.Equals(id3v2.EncodingISO) {
+		if decoded, ok := decodeMisencodedCyrillic(fixed); ok {
+			*changes = append(*changes, fmt.Sprintf("%s: кириллица «%s» → «%s»", id, fixed, decoded))
+			fixed = decoded
+		}
+	}
+	switch id {
+	case "TRCK", "TPOS":
+		if normalized, ok := normalizeTrackPosition(fixed); ok && normalized != fixed {
+			*changes = append(*changes, fmt.Sprintf("%s: «%s» → «%s»", id, fixed, normalized))
+			fixed = normalized
+		}
+	}
+	// Нулевой байт разделяет значения только в v2.4; в v2.3 пишем их через запятую, как writeID3Tags
+	if version == 3 && strings.Contains(strings.TrimRight(fixed, "\x00"), "\x00") {
+		joined := strings.ReplaceAll(strings.TrimRight(fixed, "\x00"), "\x00", ", ")
+		*changes = append(*changes, fmt.Sprintf("%s: несколько значений объединены через запятую", id))
+		fixed = joined
+	}
+	return fixed
+}
+
+// decodeMisencodedCyrillic распознаёт текст в cp1251, прочитанный как ISO-8859-1
+// («Êèíî» вместо «Кино»), и возвращает его в правильном виде. Чтобы не испортить
+// настоящий латинский текст с диакритикой (Beyoncé, Motörhead), текст считается
+// испорченным, только если в нём не меньше трёх таких символов и они составляют
+// не меньше половины букв
+func decodeMisencodedCyrillic(text string) (string, bool) {
+	raw := make([]byte, 0, len(text))
+	high, letters := 0, 0
+	for _, r := range text {
+		if r > 0xFF {
+			return "", false
+		}
+		switch {
+		case r >= 0xC0 || r == 0xA8 || r == 0xB8:
+			high++
+			letters++
+		case r >= 0x80:
+			// В cp1251 на этих местах редкие символы — такой текст вряд ли кириллица
+			return "", false
+		case unicode.IsLetter(r):
+			letters++
+		}
+		raw = append(raw, byte(r))
+	}
+	if high < 3 || high*2 < letters {
+		return "", false
+	}
+	decoded, err := charmap.Windows1251.NewDecoder().Bytes(raw)
+	if err != nil {
+		return "", false
+	}
+	return string(decoded), true
+}
+
+// normalizeTrackPosition приводит номер трека или диска к виду «N» или «N/M» без ведущих
+// нулей и пробелов. false — значение не число и не пара чисел
+func normalizeTrackPosition(value string) (string, bool) {
+	parts := strings.SplitN(strings.TrimRight(value, "\x00"), "/", 2)
+	numbers := make([]string, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return "", false
+		}
+		numbers = append(numbers, strconv.Itoa(n))
+	}
+	if len(numbers) == 2 && numbers[1] == "0" {
+		numbers = numbers[:1]
+	}
+	return strings.Join(numbers, "/"), true
+}
+
+// doctorProbeBytes — сколько байт аудио скачивает doctor, чтобы проверить доступ к CDN
+const doctorProbeBytes = 64 * 1024
+
+// doctorReport печатает результаты проверок команды doctor и запоминает код первой неудачной
+type doctorReport struct {
+	failed int
+	code   int
+}
+
+// Pass отмечает пройденную проверку
+func (r *doctorReport) Pass(name string, detail string) {
+	fmt.Printf("✓ %s: %s\n", name, detail)
+}
+
+// Fail отмечает проваленную проверку с ошибкой и подсказкой, что исправить
+func (r *doctorReport) Fail(name string, err error, hint string) {
+	fmt.Printf("✗ %s: %v\n", name, err)
+	if hint != "" {
+		fmt.Printf("    Что сделать: %s\n", hint)
+	}
+	if r.failed == 0 {
+		r.code = exitCodeFor(err)
+	}
+	r.failed++
+}
+
+// Skip отмечает проверку, которую нельзя выполнить из-за предыдущей ошибки
+func (r *doctorReport) Skip(name string, reason string) {
+	fmt.Printf("- %s: пропущено (%s)\n", name, reason)
+}
+
+// doctorHint возвращает подсказку по ошибке запроса к API или CDN
+func doctorHint(err error) string {
+	switch exitCodeFor(err) {
+	case exitAuth:
+		return "токен недействителен или истёк — получите новый и сохраните его в .env (ACCESS_TOKEN) или через -cmd=login"
+	case exitNetwork:
+		return "проверьте подключение к интернету, прокси (HTTPS_PROXY) и сертификат корпоративного прокси (-cacert); при медленной сети увеличьте -connect-timeout и -response-timeout"
+	case exitNotFound:
+		return "проверьте ID трека в -id"
+	}
+	return "повторите с -dump-responses=папка и приложите сохранённые ответы API к описанию проблемы"
+}
+
+// probeDownload скачивает первые size байт файла по ссылке и возвращает, сколько получено
+func (c *YandexMusicClient) probeDownload(rawURL string, size int64) (int64, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка создания запроса: %w", err)
+	}
+	req.Header = c.downloadHeaders().Clone()
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+
+	release := c.acquireDownloadHost(rawURL)
+	defer release()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка выполнения запроса: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, &APIError{StatusCode: resp.StatusCode, Endpoint: "GET " + req.URL.Host}
+	}
+	n, err := io.CopyN(io.Discard, resp.Body, size)
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+	if n == 0 {
+		return 0, errors.New("сервер вернул пустой ответ")
+	}
+	return n, nil
+}
+
+// handleDoctor обрабатывает команду doctor: по очереди проверяет токен, доступ к аккаунту,
+// получение трека, ссылки на скачивание и само скачивание, и выводит отчёт с подсказками.
+// Трек для проверки берётся из trackID, а если он не задан — первый из лайков.
+// Возвращает код завершения по первой неудачной проверке
+func handleDoctor(client *YandexMusicClient, tokenSource string, tokenErr error, trackID string) int {
+	report := &doctorReport{}
+
+	if tokenErr != nil {
+		report.Fail("Токен", tokenErr, "задайте ACCESS_TOKEN в .env или переменной окружения, укажите файл через -token-file или сохраните токен командой -cmd=login")
+		report.code = exitAuth
+		report.Skip("Аккаунт", "нет токена")
+		report.Skip("Трек", "нет токена")
+		report.Skip("Ссылка на скачивание", "нет токена")
+		report.Skip("Скачивание", "нет токена")
+		return report.code
+	}
+	report.Pass("Токен", "найден ("+tokenSource+")")
+
+	account, err := client.GetAccountStatus()
+	if err == nil && account.Result.Account.UserID == 0 {
+		err = &APIError{StatusCode: http.StatusUnauthorized, Body: "API не узнал пользователя по токену", Endpoint: "GET " + accountStatusPath}
+	}
+	if err != nil {
+		report.Fail("Аккаунт", err, doctorHint(err))
+		report.Skip("Трек", "нет доступа к аккаунту")
+		report.Skip("Ссылка на скачивание", "нет доступа к аккаунту")
+		report.Skip("Скачивание", "нет доступа к аккаунту")
+		return report.code
+	}
+	info := account.Result.Account
+	plus := "без подписки Плюс"
+	if account.Result.Plus.HasPlus {
+		plus = "есть подписка Плюс"
+	}
+	report.Pass("Аккаунт", fmt.Sprintf("%s (uid %d), %s", info.Login, info.UserID, plus))
+
+	if trackID == "" {
+		ids, err := client.likedTrackIDs("")
+		if err != nil {
+			report.Fail("Трек", fmt.Errorf("не удалось получить лайки для выбора трека: %w", err), doctorHint(err))
+		} else if len(ids) == 0 {
+			report.Skip("Трек", "в лайках нет треков, укажите ID трека через -id")
+		} else {
+			trackID = ids[0]
+		}
+	}
+	if trackID == "" {
+		report.Skip("Ссылка на скачивание", "нет трека для проверки")
+		report.Skip("Скачивание", "нет трека для проверки")
+		return report.code
+	}
+
+	track, err := client.getTrackByID(trackID)
+	if err != nil {
+		report.Fail("Трек", err, doctorHint(err))
+	} else if !track.IsAvailable() {
+		report.Fail("Трек", fmt.Errorf("%s — %s: %w", track.Title, track.DisplayArtists(0), ErrTrackUnavailable),
+			"трек закрыт правообладателем в вашем регионе — проверьте другой трек через -id или задайте -region")
+	} else {
+		report.Pass("Трек", fmt.Sprintf("%s — %s (%s)", track.Title, track.DisplayArtists(0), trackID))
+	}
+
+	infos, err := client.GetTrackDownloadInfo(trackID)
+	if err == nil && len(infos) == 0 {
+		err = errors.New("API не вернул вариантов скачивания")
+	}
+	var downloadURL string
+	var used DownloadInfo
+	if err == nil {
+		var errs []error
+		for _, candidate := range infos {
+			if downloadURL, err = client.resolveDownloadURL(candidate); err == nil {
+				used = candidate
+				break
+			}
+			errs = append(errs, err)
+		}
+		if downloadURL == "" {
+			err = combineDownloadErrors(errs)
+		}
+	}
+	if err != nil {
+		hint := doctorHint(err)
+		if errors.Is(err, ErrNotDirectlyDownloadable) {
+			hint = "трек отдаётся только потоком — проверьте другой трек через -id"
+		}
+		report.Fail("Ссылка на скачивание", err, hint)
+		report.Skip("Скачивание", "нет ссылки")
+		return report.code
+	}
+	report.Pass("Ссылка на скачивание", used.Quality())
+
+	n, err := client.probeDownload(downloadURL, doctorProbeBytes)
+	if err != nil {
+		hint := doctorHint(err)
+		if exitCodeFor(err) == exitAuth {
+			hint = "CDN отклонил запрос — попробуйте другой -download-user-agent или уберите лишние -download-header"
+		}
+		report.Fail("Скачивание", err, hint)
+		return report.code
+	}
+	report.Pass("Скачивание", fmt.Sprintf("получено %s", formatSize(n)))
+
+	if report.failed == 0 {
+		fmt.Println("\nВсе проверки пройдены")
+	}
+	return report.code
+}
+
+// TemplatePreview представляет путь, который получит трек, в выводе команды template-preview
+type TemplatePreview struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Path   string `json:"path,omitempty"` // Путь относительно папки -to; пусто — трек будет пропущен
+	// Совпадение с именем другого трека: suffix — добавлен номер, overwrite — файл будет
+	// перезаписан, skip — трек пропускается
+	Collision string `json:"collision,omitempty"`
+	Sanitized bool   `json:"sanitized,omitempty"` // В названии, исполнителе или альбоме заменены недопустимые символы
+	Truncated bool   `json:"truncated,omitempty"` // Название укорочено по -max-title-length
+	Exists    bool   `json:"exists,omitempty"`    // Файл уже есть в папке -to
+	// Прежнее имя скачанного файла, который при скачивании будет переименован в Path
+	RenamedFrom string `json:"renamedFrom,omitempty"`
+}
+
+// handleTemplatePreview обрабатывает команду template-preview: показывает, какие пути
+// получат первые limit треков плейлиста (0 — все) с текущими флагами раскладки и имён,
+// ничего не скачивая. Имена закрепляются для всех треков по порядку, как при скачивании,
+// поэтому совпадения с более ранними треками и с файлом состояния в folderName видны сразу
+func handleTemplatePreview(client *YandexMusicClient, playlistID string, folderName string, outputFmt string, limit int, opts DownloadOptions) {
+	playlist, err := client.GetPlaylist(playlistID)
+	if err != nil {
+		fatalf(err, "Ошибка при получении треков плейлиста: %v\n", err)
+	}
+	// Порядок и отбор — как при скачивании: -added-since, фильтры, затем -shuffle
+	tracks := playlist.Tracks
+	if !opts.AddedSince.IsZero() {
+		tracks = applyAddedSince(tracks, opts.AddedSince)
+	}
+	tracks, excluded := opts.Filter.Apply(tracks)
+	if excluded > 0 {
+		log.Printf("Исключено фильтрами: %d\n", excluded)
+	}
+	if opts.Shuffle {
+		tracks = shuffleTracks(tracks, opts.ShuffleSeed)
+	}
+	tracks = opts.normalizeTracks(tracks)
+
+	// Без -to имена проверяются только между треками плейлиста
+	state := &ExportState{Tracks: map[string]*TrackState{}}
+	if folderName != "" {
+		if state, err = loadExportState(filepath.Join(folderName, exportStateFileName)); err != nil {
+			fatal("Ошибка загрузки состояния выгрузки: %v\n", err)
+		}
+	}
+	plans := planTrackFiles(tracks, newFileNameRegistry(state), opts)
+
+	total := len(tracks)
+	if limit > 0 && limit < total {
+		tracks, plans = tracks[:limit], plans[:limit]
+	}
+	previews := make([]TemplatePreview, 0, len(tracks))
+	for i, trackShort := range tracks {
+		track := trackShort.Track
+		plan := plans[i]
+		preview := TemplatePreview{
+			ID:        track.TrackID(),
+			Title:     track.Title,
+			Artist:    plan.artistStr,
+			Truncated: truncateTitle(track.Title, opts.MaxTitleLength) != track.Title,
+		}
+		names := []string{track.Title, plan.artistStr}
+		if len(track.Albums) > 0 {
+			names = append(names, track.Albums[0].Title)
+		}
+		for _, name := range names {
+			if sanitizeFileName(name) != name {
+				preview.Sanitized = true
+			}
+		}
+		switch {
+		case !plan.ok:
+			preview.Collision = collisionSkip
+		case plan.overwrite:
+			preview.Collision = collisionOverwrite
+		case plan.fileName != plan.wanted:
+			preview.Collision = collisionSuffix
+		}
+		if plan.ok {
+			preview.Path = plan.fileName
+			preview.RenamedFrom = plan.previous
+			if folderName != "" {
+				if _, err := os.Stat(filepath.Join(folderName, plan.fileName)); err == nil {
+					preview.Exists = true
+				}
+			}
+		}
+		previews = append(previews, preview)
+	}
+
+	if outputFmt == "json" {
+		jsonData, err := json.MarshalIndent(previews, "", "  ")
+		if err != nil {
+			fatal("Ошибка формирования JSON: %v\n", err)
+		}
+		fmt.Println(string(jsonData))
+		return
+	}
+
+	// Текстовый формат: {путь} и пометки в квадратных скобках
+	collisions, sanitized := 0, 0
+	for _, preview := range previews {
+		var marks []string
+		switch preview.Collision {
+		case collisionSuffix:
+			marks = append(marks, "имя занято, добавлен номер")
+		case collisionOverwrite:
+			marks = append(marks, "перезапишет файл другого трека")
+		case collisionSkip:
+			marks = append(marks, "будет пропущен: имя занято")
+		}
+		if preview.Collision != "" {
+			collisions++
+		}
+		if preview.Sanitized {
+			marks = append(marks, "заменены символы")
+			sanitized++
+		}
+		if preview.Truncated {
+			marks = append(marks, "название укорочено")
+		}
+		if preview.Exists {
+			marks = append(marks, "уже есть")
+		}
+		if preview.RenamedFrom != "" {
+			marks = append(marks, "будет переименован из "+preview.RenamedFrom)
+		}
+		path := preview.Path
+		if path == "" {
+			path = preview.Title + " — " + preview.Artist
+		}
+		if len(marks) > 0 {
+			fmt.Printf("%s\t[%s]\n", path, strings.Join(marks, ", "))
+		} else {
+			fmt.Println(path)
+		}
+	}
+	fmt.Printf("\nПоказано треков: %d из %d, совпадений имён: %d, с заменёнными символами: %d\n", len(previews), total, collisions, sanitized)
+}
+
+// handleSyncPlaylist обрабатывает команду sync-playlist: сравнивает ревизию плейлиста
+// с сохранённой в файле состояния и скачивает только добавленные с прошлой синхронизации треки
+func handleSyncPlaylist(client *YandexMusicClient, playlistID string, folderName string, opts DownloadOptions) DownloadSummary {
+	playlist := loadPlaylistRef(client, playlistID)
+
+	if err := os.MkdirAll(folderName, 0755); err != nil {
+		fatal("Ошибка создания папки %s: %v\n", folderName, err)
+	}
+	statePath := filepath.Join(folderName, exportStateFileName)
+	if err := opts.destination().Restore(statePath); err != nil {
+		fatal("Ошибка загрузки состояния выгрузки: %v\n", err)
+	}
+	state, err := loadExportState(statePath)
+	if err != nil {
+		fatal("Ошибка загрузки состояния выгрузки: %v\n", err)
+	}
+
+	// Обложка и описание могли измениться и без изменения треков, поэтому сохраняются всегда
+	savePlaylistMetaIfRequested(client, folderName, playlist, opts)
+
+	key := fmt.Sprintf("%d:%d", playlist.Owner.UserID, playlist.Kind)
+	prev := state.Playlists[key]
+	// Без ревизии (у списка дизлайков её нет) изменения не определить — сверяем по составу.
+	// С -retry-permanent-failures сверяем и неизменившийся плейлист: треки с постоянной
+	// ошибкой не входят в синхронизированные и будут скачаны снова
+	if prev != nil && playlist.Revision != 0 && prev.Revision == playlist.Revision && !opts.RetryPermanent {
+		opts.infof("Плейлист «%s» не изменился (ревизия %d), скачивать нечего\n", playlist.Title, playlist.Revision)
+		pruneIfRequested(client, folderName, playlist.Tracks, opts)
+		return DownloadSummary{}
+	}
+
+	// Сравниваем наборы ID треков и оставляем только новые
+	synced := make(map[string]bool)
+	if prev != nil {
+		for _, id := range prev.TrackIDs {
+			synced[id] = true
+		}
+	}
+	var newTracks []TrackShort
+	for _, trackShort := range playlist.Tracks {
+		if !synced[trackShort.Track.TrackID()] {
+			newTracks = append(newTracks, trackShort)
+		}
+	}
+
+	if prev != nil {
+		opts.infof("Плейлист «%s» изменился: ревизия %d → %d\n", playlist.Title, prev.Revision, playlist.Revision)
+	}
+	opts.infof("Треков в плейлисте: %d, новых: %d\n", len(playlist.Tracks), len(newTracks))
+
+	// Позиции для -prepend-index считаются по всему плейлисту, а не по новым трекам
+	if opts.PrependIndex {
+		kept, _ := opts.Filter.Apply(playlist.Tracks)
+		if opts.Shuffle {
+			kept = shuffleTracks(kept, opts.ShuffleSeed)
+		}
+		opts.positions = make(map[string]int, len(kept))
+		for i, trackShort := range kept {
+			opts.positions[trackShort.Track.TrackID()] = i + 1
+		}
+	}
+
+	opts.Source = "playlist"
+	opts.PlaylistTitle = playlist.Title
+	summary := downloadTracks(client, newTracks, folderName, opts)
+
+	// Перечитываем состояние: downloadTracks обновил в нём статусы треков
+	state, err = loadExportState(statePath)
+	if err != nil {
+		fatal("Ошибка загрузки состояния выгрузки: %v\n", err)
+	}
+	playlistState := &PlaylistState{
+		Title:    playlist.Title,
+		SyncedAt: time.Now().Format(time.RFC3339),
+	}
+	for _, trackShort := range playlist.Tracks {
+		id := trackShort.Track.TrackID()
+		if entry, ok := state.Tracks[id]; ok && entry.Status == trackStateDone {
+			playlistState.TrackIDs = append(playlistState.TrackIDs, id)
+		}
+	}
+	// Ревизию запоминаем только при полной синхронизации, иначе следующий
+	// запуск пропустил бы плейлист вместе с треками, которые не скачались
+	if summary.Failed == 0 {
+		playlistState.Revision = playlist.Revision
+		playlistState.Snapshot = playlist.Snapshot
+	} else if prev != nil {
+		playlistState.Revision = prev.Revision
+		playlistState.Snapshot = prev.Snapshot
+	}
+	state.Playlists[key] = playlistState
+	if err := state.Save(); err != nil {
+		log.Printf("Предупреждение: не удалось сохранить состояние выгрузки: %v\n", err)
+	}
+
+	pruneIfRequested(client, folderName, playlist.Tracks, opts)
+	return summary
+}
+
+// handleDownloadArtist обрабатывает команду download-artist: скачивает популярные треки
+// исполнителя или, с allAlbums, все его альбомы в папки {исполнитель}/{альбом}
+func handleDownloadArtist(client *YandexMusicClient, artistID string, folderName string, allAlbums bool, opts DownloadOptions) DownloadSummary {
+	opts.Source = "artist"
+	var summary DownloadSummary
+
+	if !allAlbums {
+		tracks, err := client.GetArtistTracks(artistID, artistTopTracksCount)
+		if err != nil {
+			fatalf(err, "Ошибка при получении треков исполнителя: %v\n", err)
+		}
+		if len(tracks) == 0 {
+			log.Printf("У исполнителя %s не найдено треков\n", artistID)
+			exit(exitNotFound)
+		}
+		artistName := artistNameByID(tracks, artistID)
+		opts.PlaylistTitle = artistName
+		opts.infof("Найдено популярных треков исполнителя %s: %d\n", artistName, len(tracks))
+
+		// Раскладываем треки по папкам альбомов, сохраняя порядок первого появления
+		var albumTitles []string
+		byAlbum := make(map[string][]TrackShort)
+		for _, track := range tracks {
+			albumTitle := "Без альбома"
+			if len(track.Albums) > 0 && track.Albums[0].Title != "" {
+				albumTitle = track.Albums[0].Title
+			}
+			if _, ok := byAlbum[albumTitle]; !ok {
+				albumTitles = append(albumTitles, albumTitle)
+			}
+			byAlbum[albumTitle] = append(byAlbum[albumTitle], TrackShort{Track: track})
+		}
+		for _, albumTitle := range albumTitles {
+			albumFolder := filepath.Join(folderName, sanitizeFileName(artistName), sanitizeFileName(albumTitle))
+			summary.Add(downloadTracks(client, byAlbum[albumTitle], albumFolder, opts))
+			if opts.FailFast && summary.Failed > 0 {
+				break
+			}
+		}
+		return summary
+	}
+
+	albums, err := client.GetArtistAlbums(artistID)
+	if err != nil {
+		fatalf(err, "Ошибка при получении альбомов исполнителя: %v\n", err)
+	}
+	opts.infof("Найдено альбомов исполнителя: %d\n", len(albums))
+
+	artistName := ""
+	for i, album := range albums {
+		albumID := formatID(album.ID)
+		tracks, err := client.GetAlbumTracks(albumID)
+		if err != nil {
+			log.Printf("Ошибка при получении треков альбома %s: %v\n", album.Title, err)
+			summary.Failed++
+			if opts.FailFast {
+				break
+			}
+			continue
+		}
+		if artistName == "" {
+			artistName = artistNameByID(tracks, artistID)
+			opts.PlaylistTitle = artistName
+		}
+
+		opts.infof("\n[Альбом %d/%d] %s (%d)\n", i+1, len(albums), album.Title, album.Year)
+		trackShorts := make([]TrackShort, 0, len(tracks))
+		for _, track := range tracks {
+			trackShorts = append(trackShorts, TrackShort{Track: track})
+		}
+		albumFolder := filepath.Join(folderName, sanitizeFileName(artistName), sanitizeFileName(album.Title))
+		albumSummary := downloadTracks(client, trackShorts, albumFolder, opts)
+		summary.Add(albumSummary)
+		if opts.Cue {
+			written, err := writeAlbumCue(albumFolder, album, artistName, tracks, albumSummary.Results)
+			if err != nil {
+				log.Printf("Предупреждение: не удалось записать CUE-файл альбома %s: %v\n", album.Title, err)
+			}
+			for _, path := range written {
+				opts.infof("CUE-файл: %s\n", path)
+			}
+		}
+		if opts.FailFast && summary.Failed > 0 {
+			break
+		}
+	}
+
+	return summary
+}
+
+// cueString экранирует строку для CUE-файла: двойные кавычки внутри значения не допускаются
+func cueString(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, "'") + `"`
+}
+
+// writeAlbumCue пишет CUE-файл альбома со ссылками на файлы треков, которые есть на диске
+// после скачивания. Каждый трек лежит в своём файле, поэтому у каждого FILE одна запись
+// TRACK с INDEX 01 00:00:00. Для альбома из нескольких дисков пишется отдельный файл
+// на каждый диск. Возвращает пути записанных файлов
+func writeAlbumCue(albumFolder string, album Album, artistName string, tracks []Track, results []TrackResult) ([]string, error) {
+	paths := make(map[string]string, len(results))
+	for _, result := range results {
+		if result.HasFile() {
+			paths[result.ID] = result.Path
+		}
+	}
+
+	type cueTrack struct {
+		track Track
+		file  string
+	}
+	discs := make(map[int][]cueTrack)
+	var discOrder []int
+	for _, track := range tracks {
+		path, ok := paths[track.TrackID()]
+		if !ok {
+			continue
+		}
+		rel, err := filepath.Rel(albumFolder, path)
+		if err != nil {
+			return nil, err
+		}
+		disc := 1
+		if len(track.Albums) > 0 && track.Albums[0].TrackPosition != nil && track.Albums[0].TrackPosition.Volume > 0 {
+			disc = track.Albums[0].TrackPosition.Volume
+		}
+		if _, ok := discs[disc]; !ok {
+			discOrder = append(discOrder, disc)
+		}
+		discs[disc] = append(discs[disc], cueTrack{track: track, file: filepath.ToSlash(rel)})
+	}
+	if len(discOrder) == 0 {
+		return nil, nil
+	}
+	sort.Ints(discOrder)
+
+	var written []string
+	for _, disc := range discOrder {
+		var b strings.Builder
+		fmt.Fprintf(&b, "PERFORMER %s\n", cueString(artistName))
+		fmt.Fprintf(&b, "TITLE %s\n", cueString(album.Title))
+		if album.Year > 0 {
+			fmt.Fprintf(&b, "REM DATE %d\n", album.Year)
+		}
+		if album.Genre != "" {
+			fmt.Fprintf(&b, "REM GENRE %s\n", cueString(album.Genre))
+		}
+		if len(discOrder) > 1 {
+			fmt.Fprintf(&b, "REM DISCNUMBER %d\n", disc)
+			fmt.Fprintf(&b, "REM TOTALDISCS %d\n", discOrder[len(discOrder)-1])
+		}
+
+		// Номера треков берутся из альбома, но в CUE они должны возрастать
+		number := 0
+		for _, item := range discs[disc] {
+			if n := item.track.TrackNumber; n > number && n <= 99 {
+				number = n
+			} else {
+				number++
+			}
+			fmt.Fprintf(&b, "FILE %s MP3\n", cueString(item.file))
+			fmt.Fprintf(&b, "  TRACK %02d AUDIO\n", number)
+			fmt.Fprintf(&b, "    TITLE %s\n", cueString(item.track.Title))
+			fmt.Fprintf(&b, "    PERFORMER %s\n", cueString(item.track.DisplayArtists(0)))
+			if item.track.ISRC != "" {
+				fmt.Fprintf(&b, "    ISRC %s\n", item.track.ISRC)
+			}
+			fmt.Fprintf(&b, "    INDEX 01 00:00:00\n")
+		}
+
+		name := sanitizeFileName(album.Title)
+		if len(discOrder) > 1 {
+			name += fmt.Sprintf(" (CD%d)", disc)
+		}
+		cuePath := filepath.Join(albumFolder, name+".cue")
+		if err := os.WriteFile(cuePath, []byte(b.String()), 0644); err != nil {
+			return written, err
+		}
+		written = append(written, cuePath)
+	}
+	return written, nil
+}
+
+// artistNameByID находит имя исполнителя по ID среди исполнителей треков
+func artistNameByID(tracks []Track, artistID string) string {
+	for _, track := range tracks {
+		for _, artist := range track.Artists {
+			if formatID(artist.ID) == artistID && artist.Name != "" {
+				return artist.Name
+			}
+		}
+	}
+	return artistID
+}
+
+// handleDownloadLikes обрабатывает команду download-likes
+func handleDownloadLikes(client *YandexMusicClient, folderName string, opts DownloadOptions) DownloadSummary {
+	tracks, err := client.GetLikedTracks("")
+	if err != nil {
+		fatalf(err, "Ошибка при получении лайкнутых треков: %v\n", err)
+	}
+
+	opts.infof("Найдено лайкнутых треков: %d\n", len(tracks))
+	opts.Source = "likes"
+	opts.PlaylistTitle = likesPlaylistTitle
+	toDownload := tracks
+	if opts.CompleteAlbums > 0 {
+		extra := completeLikedAlbums(client, tracks, opts)
+		toDownload = append(append([]TrackShort(nil), tracks...), extra...)
+		// Треки, добавленные для полноты альбомов, не должны удаляться -prune
+		tracks = toDownload
+	}
+	summary := downloadTracks(client, toDownload, folderName, opts)
+	pruneIfRequested(client, folderName, tracks, opts)
+	return summary
+}
+
+// completeLikedAlbums находит альбомы, из которых лайкнуто не меньше opts.CompleteAlbums
+// процентов треков, и возвращает их недостающие треки в порядке альбома. Число треков
+// альбома берётся из данных лайков; если API его не сообщил, альбом запрашивается целиком.
+// По каждому дополняемому альбому выводится строка отчёта
+func completeLikedAlbums(client *YandexMusicClient, liked []TrackShort, opts DownloadOptions) []TrackShort {
+	groups := groupTracksByAlbum(liked, opts.MaxArtists)
+	likedIDs := make(map[string]bool, len(liked))
+	for _, trackShort := range liked {
+		likedIDs[trackShort.Track.TrackID()] = true
+	}
+	qualifies := func(likedCount, total int) bool {
+		return total > likedCount && likedCount*100 >= opts.CompleteAlbums*total
+	}
+
+	var candidates []AlbumGroup
+	for _, group := range groups {
+		if group.ID == "" {
+			continue
+		}
+		if group.TrackCount == 0 || qualifies(len(group.Tracks), group.TrackCount) {
+			candidates = append(candidates, group)
+		}
+	}
+
+	missing := make([][]TrackShort, len(candidates))
+	forEachConcurrently(len(candidates), opts.Concurrency, func(i int) {
+		group := candidates[i]
+		albumTracks, err := client.GetAlbumTracks(group.ID)
+		if err != nil {
+			log.Printf("Предупреждение: не удалось получить альбом «%s» для дополнения: %v\n", group.Title, err)
+			return
+		}
+		if !qualifies(len(group.Tracks), len(albumTracks)) {
+			return
+		}
+		for _, track := range albumTracks {
+			if !likedIDs[track.TrackID()] {
+				missing[i] = append(missing[i], TrackShort{Track: track})
+			}
+		}
+	})
+
+	var extra []TrackShort
+	completed := 0
+	for i, group := range candidates {
+		if len(missing[i]) == 0 {
+			continue
+		}
+		completed++
+		total := len(group.Tracks) + len(missing[i])
+		label := group.Title
+		if group.Artist != "" {
+			label = group.Artist + " — " + group.Title
+		}
+		opts.infof("Дополняется альбом %s: лайкнуто %d из %d, добавлено треков: %d\n", label, len(group.Tracks), total, len(missing[i]))
+		extra = append(extra, missing[i]...)
+	}
+	opts.infof("Дополнено альбомов: %d, добавлено треков: %d\n", completed, len(extra))
+	return extra
+}
+
+// handleWave обрабатывает команду wave: получает следующие count треков «Моей волны»
+// и выводит их, как likes, или скачивает в folderName, если папка задана
+func handleWave(client *YandexMusicClient, count int, folderName string, outputFmt string, listOpts ListOptions, opts DownloadOptions) DownloadSummary {
+	tracks, err := client.GetWaveTracks(count)
+	if err != nil {
+		if len(tracks) == 0 {
+			fatalf(err, "Ошибка при получении треков «Моей волны»: %v\n", err)
+		}
+		log.Printf("Предупреждение: получено только %d из %d треков «Моей волны»: %v\n", len(tracks), count, err)
+	} else if len(tracks) < count {
+		log.Printf("Станция перестала выдавать новые треки: получено %d из %d\n", len(tracks), count)
+	}
+
+	trackShorts := make([]TrackShort, 0, len(tracks))
+	for _, track := range tracks {
+		trackShorts = append(trackShorts, TrackShort{Track: track})
+	}
+	if folderName == "" {
+		renderTracks(client, trackShorts, outputFmt, listOpts)
+		return DownloadSummary{}
+	}
+
+	opts.infof("Получено треков «Моей волны»: %d\n", len(trackShorts))
+	opts.Source = "wave"
+	opts.PlaylistTitle = waveTitle
+	return downloadTracks(client, trackShorts, folderName, opts)
+}
+
+// handleRetry повторяет скачивание треков, которые в прошлом запуске завершились ошибкой.
+// Треки берутся из отчёта reportPath (файл -json или -manifest) и скачиваются в folderName
+func handleRetry(client *YandexMusicClient, reportPath string, folderName string, opts DownloadOptions) DownloadSummary {
+	ids, err := readFailedTrackIDs(reportPath)
+	if err != nil {
+		fatal("Ошибка чтения отчёта %s: %v\n", reportPath, err)
+	}
+	if len(ids) == 0 {
+		opts.infof("В отчёте нет треков с ошибками\n")
+		return DownloadSummary{}
+	}
+
+	tracks := make([]TrackShort, 0, len(ids))
+	for _, id := range ids {
+		track, err := client.getTrackByID(id)
+		if err != nil {
+			log.Printf("Ошибка получения трека %s: %v\n", id, err)
+			continue
+		}
+		tracks = append(tracks, TrackShort{Track: *track})
+	}
+
+	opts.infof("Треков с ошибками в отчёте: %d\n", len(ids))
+	opts.Source = "retry"
+	return downloadTracks(client, tracks, folderName, opts)
+}
+
+// pruneIfRequested убирает лишние файлы, если задан -prune, и выводит итог. Если часть
+// треков источника не удалось получить или разобрать, tracks неполон и по нему нельзя
+// судить, каких треков больше нет: тогда файлы не трогаются
+func pruneIfRequested(client *YandexMusicClient, folderName string, tracks []TrackShort, opts DownloadOptions) {
+	if !opts.Prune {
+		return
+	}
+	if dropped := client.DroppedTracks(); dropped > 0 {
+		log.Printf("Предупреждение: -prune пропущен: не удалось получить или разобрать треков источника: %d, их файлы могли бы быть убраны по ошибке\n", dropped)
+		return
+	}
+	pruned, err := pruneOrphans(folderName, tracks, opts)
+	if err != nil {
+		log.Printf("Предупреждение: не удалось убрать лишние файлы: %v\n", err)
+	}
+	if opts.PruneHard {
+		opts.infof("Удалено файлов треков, которых больше нет в источнике: %d\n", pruned)
+	} else {
+		opts.infof("Перенесено в %s файлов треков, которых больше нет в источнике: %d\n", pruneTrashDir, pruned)
+	}
+}
+
+// pruneOrphans убирает из папки файлы треков, которых больше нет в источнике. Файл трека
+// определяется по файлу состояния выгрузки: если ID трека нет среди tracks, его файл
+// переносится в .trash с сохранением относительного пути (или удаляется с PruneHard),
+// а запись о треке удаляется из состояния. Файлы, не записанные в состоянии, не трогаются
+func pruneOrphans(folderName string, tracks []TrackShort, opts DownloadOptions) (int, error) {
+	state, err := loadExportState(filepath.Join(folderName, exportStateFileName))
+	if err != nil {
+		return 0, err
+	}
+
+	current := make(map[string]bool, len(tracks))
+	for _, trackShort := range tracks {
+		current[trackShort.Track.TrackID()] = true
+	}
+
+	// Файлы могут быть закреплены за несколькими записями; трогаем только те,
+	// которые не нужны ни одному треку источника
+	keep := make(map[string]bool)
+	for id, entry := range state.Tracks {
+		if current[id] && entry.File != "" {
+			keep[strings.ToLower(entry.File)] = true
+		}
+	}
+
+	pruned := 0
+	for id, entry := range state.Tracks {
+		if current[id] {
+			continue
+		}
+		if entry.File == "" || keep[strings.ToLower(entry.File)] {
+			state.Forget(id)
+			continue
+		}
+
+		filePath := filepath.Join(folderName, entry.File)
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			state.Forget(id)
+			continue
+		}
+		if opts.PruneHard {
+			err = os.Remove(filePath)
+		} else {
+			trashPath := filepath.Join(folderName, pruneTrashDir, entry.File)
+			if err = os.MkdirAll(filepath.Dir(trashPath), 0755); err == nil {
+				err = os.Rename(filePath, trashPath)
+			}
+		}
+		if err != nil {
+			log.Printf("Предупреждение: не удалось убрать %s: %v\n", filePath, err)
+			// Оставляем запись, чтобы повторить в следующий раз
+			continue
+		}
+		state.Forget(id)
+		opts.infof("Убрано (нет в источнике): %s\n", entry.File)
+		removeEmptyDirs(filepath.Dir(filePath), folderName)
+		pruned++
+	}
+
+	return pruned, state.Save()
+}
+
+// removeEmptyDirs удаляет опустевшие папки от dir вверх до root (не включая его)
+func removeEmptyDirs(dir string, root string) {
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// downloadTracks скачивает список треков в указанную папку
+func downloadTracks(client *YandexMusicClient, tracks []TrackShort, folderName string, opts DownloadOptions) DownloadSummary {
+	// Создаем папку, если её нет
+	if err := os.MkdirAll(folderName, 0755); err != nil {
+		fatal("Ошибка создания папки %s: %v\n", folderName, err)
+	}
+
+	var excluded int
+	tracks, excluded = opts.Filter.Apply(tracks)
+	if excluded > 0 {
+		opts.infof("Исключено фильтрами: %d\n", excluded)
+	}
+	if opts.Shuffle {
+		tracks = shuffleTracks(tracks, opts.ShuffleSeed)
+	}
+	tracks = opts.normalizeTracks(tracks)
+
+	opts.infof("Папка для сохранения: %s\n\n", folderName)
+
+	// Загружаем состояние предыдущего запуска, чтобы продолжить с места остановки
+	dest := opts.destination()
+	if err := dest.Restore(filepath.Join(folderName, exportStateFileName)); err != nil {
+		fatal("Ошибка загрузки состояния выгрузки: %v\n", err)
+	}
+	state, err := loadExportState(filepath.Join(folderName, exportStateFileName))
+	if err != nil {
+		fatal("Ошибка загрузки состояния выгрузки: %v\n", err)
+	}
+	// Запоминаем треки, известные по прошлым запускам, до отметки новых как ожидающих
+	knownTracks := make(map[string]bool, len(state.Tracks))
+	for id := range state.Tracks {
+		knownTracks[id] = true
+	}
+
+	// Перед большим скачиванием в терминале даём шанс передумать
+	var pending []TrackShort
+	for _, trackShort := range tracks {
+		entry, ok := state.Tracks[trackShort.Track.TrackID()]
+		if ok && (entry.Status == trackStateDone || entry.Status == trackStateRemoved && !opts.RecheckRemoved ||
+			entry.Status == trackStatePermanentlyFailed && !opts.RetryPermanent) {
+			continue
+		}
+		pending = append(pending, trackShort)
+	}
+	if !confirmDownload(pending, folderName, opts) {
+		opts.infof("Скачивание отменено\n")
+		return DownloadSummary{}
+	}
+	for _, trackShort := range tracks {
+		trackIDStr := trackShort.Track.TrackID()
+		if _, ok := state.Tracks[trackIDStr]; !ok {
+			state.Tracks[trackIDStr] = &TrackState{Status: trackStatePending}
+		}
+	}
+	if err := state.Save(); err != nil {
+		log.Printf("Предупреждение: не удалось сохранить состояние выгрузки: %v\n", err)
+	}
+
+	// Отметки треков пишутся на диск пачками, поэтому при Ctrl+C или SIGTERM
+	// накопленное сохраняется перед выходом — иначе следующий запуск скачал бы их заново
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	interruptDone := make(chan struct{})
+	defer func() {
+		signal.Stop(interrupts)
+		close(interruptDone)
+	}()
+	go func() {
+		select {
+		case sig := <-interrupts:
+			if err := state.Save(); err != nil {
+				log.Printf("Предупреждение: не удалось сохранить состояние выгрузки: %v\n", err)
+			}
+			log.Printf("Прервано (%v), состояние выгрузки сохранено\n", sig)
+			exit(exitFailure)
+		case <-interruptDone:
+		}
+	}()
+
+	// Имена файлов, закреплённые за треками в прошлых запусках и в текущем
+	fileNames := newFileNameRegistry(state)
+
+	// Треки для SQLite-каталога записываются пачками, по транзакции на пачку
+	var catalogBatch []CatalogEntry
+	flushCatalog := func() {
+		if opts.Catalog == nil || len(catalogBatch) == 0 {
+			return
+		}
+		if err := opts.Catalog.SaveTracks(catalogBatch); err != nil {
+			log.Printf("Предупреждение: не удалось записать треки в каталог: %v\n", err)
+		}
+		catalogBatch = catalogBatch[:0]
+	}
+	addToCatalog := func(entry CatalogEntry) {
+		if opts.Catalog == nil {
+			return
+		}
+		catalogBatch = append(catalogBatch, entry)
+		if len(catalogBatch) >= catalogBatchSize {
+			flushCatalog()
+		}
+	}
+
+	// Счётчики, каталог и итоги общие для параллельных скачиваний и защищены mu
+	var mu sync.Mutex
+	downloaded := 0
+	skipped := 0
+	failed := 0
+	notDirect := 0
+	unavailable := 0
+	removed := 0
+	permanent := 0
+
+	// Фактические битрейты и итоги по трекам собираются по индексу трека,
+	// чтобы отчёты шли в исходном порядке независимо от порядка завершения.
+	// Каждый трек обрабатывает одна горутина и пишет только в свой слот, поэтому
+	// блокировка не нужна; слоты читаются после завершения всех скачиваний
+	bitrateSlots := make([]*BitrateRecord, len(tracks))
+	resultSlots := make([]*TrackResult, len(tracks))
+	setResult := func(i int, track Track, artistStr string, status string, filePath string, trackErr error) *TrackResult {
+		result := &TrackResult{
+			ID:         track.TrackID(),
+			Title:      track.Title,
+			Artist:     artistStr,
+			DurationMs: track.DurationMs,
+			Status:     status,
+			Path:       filePath,
+		}
+		if len(track.Albums) > 0 {
+			result.Album = track.Albums[0].Title
+			result.AlbumID = formatID(track.Albums[0].ID)
+		}
+		if trackErr != nil {
+			result.Error = trackErr.Error()
+		}
+		result.Unavailable = !track.IsAvailable() && status != resultUnavailable
+		resultSlots[i] = result
+		opts.Events.Emit(TrackEvent{
+			Event:  "track",
+			Time:   time.Now().Format(time.RFC3339),
+			ID:     result.ID,
+			Title:  result.Title,
+			Artist: result.Artist,
+			Status: result.Status,
+			Path:   trackLocation(opts.destination(), result.Path),
+			Error:  result.Error,
+		})
+		return result
+	}
+
+	// Живой прогресс — по строке на каждое активное скачивание; в CI, в -quiet
+	// и при выводе не в терминал печатаются только итоговые строки по трекам
+	progress := newProgressArea(os.Stdout, !opts.CI && !opts.Quiet)
+	logf := func(format string, args ...interface{}) {
+		if !opts.Quiet {
+			progress.Printf(format, args...)
+		}
+	}
+	errf := func(format string, args ...interface{}) {
+		if opts.Quiet {
+			fmt.Fprintf(os.Stderr, format, args...)
+			return
+		}
+		progress.Printf(format, args...)
+	}
+
+	// В режиме CI вместо живого прогресса периодически печатаем сводку
+	lastHeartbeat := time.Now()
+	heartbeat := func() {
+		if !opts.CI || opts.Quiet {
+			return
+		}
+		mu.Lock()
+		if time.Since(lastHeartbeat) < ciHeartbeatInterval {
+			mu.Unlock()
+			return
+		}
+		lastHeartbeat = time.Now()
+		line := fmt.Sprintf("Прогресс: %d/%d обработано, скачано: %d, пропущено: %d, ошибок: %d\n",
+			downloaded+skipped+failed+notDirect+unavailable+removed+permanent, len(tracks), downloaded, skipped, failed)
+		mu.Unlock()
+		logf("%s", line)
+	}
+	count := func(counter *int) {
+		mu.Lock()
+		*counter++
+		mu.Unlock()
+	}
+
+	// С -events раз в EventsInterval пишем сводку прогресса — даже если долго качается
+	// один большой трек. Последняя сводка пишется после обработки всех треков
+	startedAt := time.Now()
+	startBytes := client.TransferredBytes()
+	lastBytes, lastAt := startBytes, startedAt
+	emitProgress := func() {
+		now := time.Now()
+		transferred := client.TransferredBytes()
+		mu.Lock()
+		done := downloaded + skipped + failed + notDirect + unavailable + removed + permanent
+		mu.Unlock()
+		event := ProgressEvent{
+			Event: "progress",
+			Time:  now.Format(time.RFC3339),
+			Done:  done,
+			Total: len(tracks),
+			Bytes: transferred - startBytes,
+		}
+		if elapsed := now.Sub(lastAt).Seconds(); elapsed > 0 {
+			event.BytesPerSec = int64(float64(transferred-lastBytes) / elapsed)
+		}
+		if done > 0 {
+			eta := int(now.Sub(startedAt).Seconds() / float64(done) * float64(len(tracks)-done))
+			event.ETASeconds = &eta
+		}
+		lastBytes, lastAt = transferred, now
+		opts.Events.Emit(event)
+	}
+	stopEvents := make(chan struct{})
+	eventsDone := make(chan struct{})
+	if opts.Events != nil && opts.EventsInterval > 0 {
+		go func() {
+			defer close(eventsDone)
+			ticker := time.NewTicker(opts.EventsInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					emitProgress()
+				case <-stopEvents:
+					return
+				}
+			}
+		}()
+	} else {
+		close(eventsDone)
+	}
+
+	// С -fail-fast первая ошибка останавливает обработку: уже начатые скачивания
+	// завершаются, а новые не начинаются
+	var stopped, diskFull atomic.Bool
+	fail := func() {
+		count(&failed)
+		if opts.FailFast {
+			stopped.Store(true)
+		}
+	}
+
+	// Файлы треков этой папки попадают в общий индекс -dedup-index для других папок.
+	// Символические ссылки не записываются: в индексе остаётся исходный файл
+	recordDedup := func(trackID string, filePath string) {
+		if opts.Dedup == nil {
+			return
+		}
+		if info, err := os.Lstat(filePath); err == nil && info.Mode().IsRegular() {
+			opts.Dedup.Record(trackID, filePath)
+		}
+	}
+
+	// Имена файлов закрепляются заранее и по порядку треков, чтобы результат
+	// -on-collision не зависел от того, какое скачивание завершится раньше. Файлы,
+	// имена которых устарели (например, сдвинулась позиция в плейлисте), переименовываются
+	plans := planTrackFiles(tracks, fileNames, opts)
+	renamePlannedFiles(folderName, tracks, plans, state)
+
+	// Статусы треков до начала скачивания: при параллельной работе состояние меняется на ходу
+	prevStatus := make(map[string]string, len(state.Tracks))
+	prevFile := make(map[string]string, len(state.Tracks))
+	for id, entry := range state.Tracks {
+		prevStatus[id] = entry.Status
+		prevFile[id] = entry.File
+	}
+
+	// folder.jpg пишется в папку альбома один раз, даже если треки альбома скачиваются параллельно
+	var coverMu sync.Mutex
+	folderCover := opts.Layout == layoutMediaServer || opts.CoverMode == coverModeEmbedFirst || opts.CoverMode == coverModeFolderOnly
+
+	// С -cover-mode=embed-first обложка встраивается только в первый по списку трек
+	// каждого альбома; индекс определяется заранее, чтобы не зависеть от порядка скачивания
+	firstInAlbum := make(map[string]int)
+	if opts.CoverMode == coverModeEmbedFirst {
+		for j := len(tracks) - 1; j >= 0; j-- {
+			firstInAlbum[trackAlbumID(tracks[j].Track)] = j
+		}
+	}
+
+	forEachConcurrently(len(tracks), opts.Concurrency, func(i int) {
+		if stopped.Load() {
+			return
+		}
+		heartbeat()
+		track := tracks[i].Track
+		trackIDStr := track.TrackID()
+		plan := plans[i]
+		artistStr := plan.artistStr
+		fileName := plan.fileName
+
+		if !plan.ok {
+			logf("[%d/%d] Пропущено (имя файла занято другим треком): %s — %s\n", i+1, len(tracks), track.Title, artistStr)
+			setResult(i, track, artistStr, resultSkipped, "", nil)
+			count(&skipped)
+			return
+		}
+		filePath := filepath.Join(folderName, fileName)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			errf("[%d/%d] Ошибка создания папки %s: %v\n", i+1, len(tracks), filepath.Dir(filePath), err)
+			state.Mark(trackIDStr, trackStateFailed, fileName, err)
+			setResult(i, track, artistStr, resultFailed, "", err)
+			fail()
+			return
+		}
+
+		adoptDecomposedFile(filePath)
+
+		// Проверяем, существует ли файл. Если трек уже известен по файлу состояния,
+		// доверяем только статусу done: файл ожидающего или упавшего трека может быть неполным
+		exists, err := dest.Exists(filePath)
+		if err != nil {
+			errf("[%d/%d] Предупреждение: не удалось проверить %s, трек будет скачан заново (%v)\n", i+1, len(tracks), fileName, err)
+		}
+		if exists && !plan.overwrite {
+			if !knownTracks[trackIDStr] || prevStatus[trackIDStr] == trackStateDone {
+				logf("[%d/%d] Пропущено (уже существует): %s — %s\n", i+1, len(tracks), track.Title, artistStr)
+				state.Mark(trackIDStr, trackStateDone, fileName, nil)
+				recordDedup(trackIDStr, filePath)
+				mu.Lock()
+				addToCatalog(CatalogEntry{Track: track, LocalPath: filePath})
+				mu.Unlock()
+				setResult(i, track, artistStr, resultSkipped, filePath, nil)
+				count(&skipped)
+				return
+			}
+		}
+
+		// Файл мог быть переименован под фактический формат (-extension-mismatch=rename)
+		// в прошлом запуске: тогда в состоянии записано имя с другим расширением
+		if renamed := prevFile[trackIDStr]; prevStatus[trackIDStr] == trackStateDone && !plan.overwrite &&
+			renamed != fileName && strings.TrimSuffix(renamed, filepath.Ext(renamed)) == strings.TrimSuffix(fileName, filepath.Ext(fileName)) {
+			renamedPath := filepath.Join(folderName, renamed)
+			if exists, _ := dest.Exists(renamedPath); exists {
+				logf("[%d/%d] Пропущено (уже существует): %s — %s\n", i+1, len(tracks), track.Title, artistStr)
+				state.Mark(trackIDStr, trackStateDone, renamed, nil)
+				recordDedup(trackIDStr, renamedPath)
+				mu.Lock()
+				addToCatalog(CatalogEntry{Track: track, LocalPath: renamedPath})
+				mu.Unlock()
+				setResult(i, track, artistStr, resultSkipped, renamedPath, nil)
+				count(&skipped)
+				return
+			}
+		}
+
+		// Трек уже скачан в другую папку из общего индекса (-dedup-index): берём его файл
+		if opts.Dedup != nil && !plan.overwrite {
+			if source, ok := opts.Dedup.Lookup(trackIDStr, filePath); ok {
+				if opts.DedupLink == dedupLinkSkip {
+					logf("[%d/%d] Пропущено (уже есть в %s): %s — %s\n", i+1, len(tracks), source, track.Title, artistStr)
+					state.Mark(trackIDStr, trackStateDone, fileName, nil)
+					setResult(i, track, artistStr, resultSkipped, "", nil)
+					count(&skipped)
+					return
+				}
+				if err := placeDedupFile(source, filePath, opts.DedupLink); err != nil {
+					errf("[%d/%d] Предупреждение: не удалось взять %s из %s, трек будет скачан (%v)\n", i+1, len(tracks), fileName, source, err)
+				} else {
+					logf("[%d/%d] Взято из другой папки (%s): %s — %s\n", i+1, len(tracks), opts.DedupLink, track.Title, artistStr)
+					state.Mark(trackIDStr, trackStateDone, fileName, nil)
+					mu.Lock()
+					addToCatalog(CatalogEntry{Track: track, LocalPath: filePath})
+					mu.Unlock()
+					setResult(i, track, artistStr, resultSkipped, filePath, nil)
+					count(&skipped)
+					return
+				}
+			}
+		}
+
+		// Удалённые из каталога треки не запрашиваем снова, если не задан -recheck-removed
+		if prevStatus[trackIDStr] == trackStateRemoved && !opts.RecheckRemoved {
+			logf("[%d/%d] Пропущено (удалён из каталога): %s — %s\n", i+1, len(tracks), track.Title, artistStr)
+			state.Mark(trackIDStr, trackStateRemoved, fileName, ErrTrackRemoved)
+			setResult(i, track, artistStr, resultRemoved, "", ErrTrackRemoved)
+			count(&removed)
+			return
+		}
+
+		// Треки с постоянной ошибкой не скачиваем снова, если не задан -retry-permanent-failures.
+		// Запись в состоянии не обновляется, чтобы сохранить время и причину ошибки
+		if prevStatus[trackIDStr] == trackStatePermanentlyFailed && !opts.RetryPermanent {
+			permanentErr := fmt.Errorf("постоянная ошибка: %s", state.TrackError(trackIDStr))
+			logf("[%d/%d] Пропущено (%v): %s — %s\n", i+1, len(tracks), permanentErr, track.Title, artistStr)
+			setResult(i, track, artistStr, resultPermanent, "", permanentErr)
+			count(&permanent)
+			return
+		}
+
+		// Треки, недоступные в регионе, пропускаем до запросов к API, если не задан -include-unavailable.
+		// С флагом пробуем скачать, а в строках по треку отмечаем, что трек помечен недоступным
+		unavailableMark := ""
+		if !track.IsAvailable() {
+			if !opts.IncludeUnavailable {
+				logf("[%d/%d] Пропущено (недоступно в регионе): %s — %s\n", i+1, len(tracks), track.Title, artistStr)
+				state.Mark(trackIDStr, trackStateFailed, fileName, ErrTrackUnavailable)
+				setResult(i, track, artistStr, resultUnavailable, "", ErrTrackUnavailable)
+				count(&unavailable)
+				return
+			}
+			unavailableMark = " [помечен недоступным в регионе]"
+		}
+
+		// Получаем варианты скачивания
+		downloadInfos, err := client.GetTrackDownloadInfo(trackIDStr)
+		if errors.Is(err, ErrTrackRemoved) {
+			logf("[%d/%d] Пропущено (удалён из каталога): %s — %s (%v)\n", i+1, len(tracks), track.Title, artistStr, err)
+			state.Mark(trackIDStr, trackStateRemoved, fileName, err)
+			setResult(i, track, artistStr, resultRemoved, "", err)
+			count(&removed)
+			return
+		}
+		if err != nil {
+			errf("[%d/%d] Ошибка получения ссылки: %s — %s%s (%v)\n", i+1, len(tracks), track.Title, artistStr, unavailableMark, err)
+			if state.MarkFailed(trackIDStr, fileName, err, opts.MaxRetries) {
+				errf("[%d/%d] Трек больше не будет скачиваться (-max-retries=%d): %s — %s\n", i+1, len(tracks), opts.MaxRetries, track.Title, artistStr)
+			}
+			setResult(i, track, artistStr, resultFailed, "", err)
+			fail()
+			return
+		}
+
+		// Скачиваем файл, показывая прогресс в своей строке области
+		slot := progress.Acquire()
+		lastProgress := -1.0
+		progressPrefix := fmt.Sprintf("[%d/%d] Скачивание: %s — %s", i+1, len(tracks), track.Title, artistStr)
+		usedInfo, err := client.downloadTrackWithFallback(trackIDStr, downloadInfos, filePath, opts.MinFree, func(p float64) {
+			heartbeat()
+			// Обновляем прогресс только если изменился на 0.5% или больше
+			if p-lastProgress >= 0.5 || p >= 100.0 {
+				progress.Update(slot, fmt.Sprintf("%s %.1f%%", progressPrefix, p))
+				lastProgress = p
+			}
+		})
+		progress.Release(slot)
+		if errors.Is(err, ErrNotDirectlyDownloadable) {
+			logf("[%d/%d] Пропущено (недоступно для прямого скачивания): %s — %s%s\n", i+1, len(tracks), track.Title, artistStr, unavailableMark)
+			state.Mark(trackIDStr, trackStateFailed, fileName, err)
+			os.Remove(filePath)
+			setResult(i, track, artistStr, resultNotDirect, "", err)
+			count(&notDirect)
+			return
+		}
+		if errors.Is(err, ErrLowDiskSpace) {
+			// Место кончается для всех треков сразу, поэтому новые скачивания не начинаются
+			errf("[%d/%d] ✗ Не скачано: %s — %s (%v)\n", i+1, len(tracks), track.Title, artistStr, err)
+			state.Mark(trackIDStr, trackStateFailed, fileName, err)
+			setResult(i, track, artistStr, resultFailed, "", err)
+			count(&failed)
+			diskFull.Store(true)
+			stopped.Store(true)
+			return
+		}
+		if err != nil {
+			errf("[%d/%d] ✗ Ошибка скачивания: %s — %s%s (%v)\n", i+1, len(tracks), track.Title, artistStr, unavailableMark, err)
+			if opts.FailFast {
+				// Недокачанный файл не оставляем: запуск прерывается, и следующий начнёт трек заново
+				os.Remove(filePath)
+			}
+			if state.MarkFailed(trackIDStr, fileName, err, opts.MaxRetries) {
+				errf("[%d/%d] Трек больше не будет скачиваться (-max-retries=%d): %s — %s\n", i+1, len(tracks), opts.MaxRetries, track.Title, artistStr)
+			}
+			setResult(i, track, artistStr, resultFailed, "", err)
+			fail()
+			return
+		}
+
+		// Проверяем, что скачан действительно MP3: CDN иногда отдаёт другой формат
+		isMP3 := true
+		if ext, err := detectAudioExtension(filePath); errors.Is(err, ErrNotAudio) {
+			// Текстовый ответ не сохраняется под видом трека и не отмечается скачанным
+			logf("[%d/%d] Пропущено (недоступно для прямого скачивания: %v): %s — %s%s\n", i+1, len(tracks), err, track.Title, artistStr, unavailableMark)
+			state.Mark(trackIDStr, trackStateFailed, fileName, err)
+			os.Remove(filePath)
+			setResult(i, track, artistStr, resultNotDirect, "", err)
+			count(&notDirect)
+			return
+		} else if err != nil {
+			errf("[%d/%d] Предупреждение: не удалось определить формат файла %s (%v)\n", i+1, len(tracks), fileName, err)
+		} else if ext != "" && ext != ".mp3" {
+			isMP3 = false
+			if opts.ExtensionMismatch == mismatchRename {
+				renamed := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ext
+				if err := os.Rename(filePath, filepath.Join(folderName, renamed)); err != nil {
+					errf("[%d/%d] Предупреждение: файл %s оказался %s, но переименовать его не удалось (%v)\n", i+1, len(tracks), fileName, ext, err)
+				} else {
+					errf("[%d/%d] Предупреждение: файл %s оказался %s, расширение исправлено\n", i+1, len(tracks), fileName, ext)
+					fileName = renamed
+					filePath = filepath.Join(folderName, renamed)
+				}
+			} else {
+				errf("[%d/%d] Предупреждение: файл %s на самом деле %s, расширение не совпадает с содержимым\n", i+1, len(tracks), fileName, ext)
+			}
+		}
+
+		// Записываем ID3 теги; с -no-tags файл остаётся в том виде, в каком скачан
+		if !opts.NoTags && !isMP3 {
+			// ID3 в начале файла другого формата может помешать его воспроизведению
+			errf("[%d/%d] Предупреждение: ID3 теги не записаны — файл %s не MP3\n", i+1, len(tracks), fileName)
+		} else if !opts.NoTags {
+			tagOpts := TagOptions{
+				ISRC:    opts.TagISRC,
+				BPM:     opts.TagBPM,
+				Version: opts.ID3Version,
+			}
+			if opts.CommentTemplate != "" {
+				tagOpts.Comment = expandCommentTemplate(opts.CommentTemplate, opts, usedInfo)
+			}
+			embedCover := opts.CoverMode != coverModeFolderOnly &&
+				(opts.CoverMode != coverModeEmbedFirst || firstInAlbum[trackAlbumID(track)] == i)
+			if opts.Covers != nil && embedCover {
+				if tagOpts.Cover, err = opts.Covers.ForTrack(track); err != nil {
+					errf("[%d/%d] Предупреждение: обложка для %s — %s не встроена (%v)\n", i+1, len(tracks), track.Title, artistStr, err)
+				}
+			}
+			if err := writeID3Tags(filePath, track, tagOpts); err != nil {
+				errf("[%d/%d] Предупреждение: не удалось записать ID3 теги для %s — %s (%v)\n", i+1, len(tracks), track.Title, artistStr, err)
+			}
+		}
+
+		// В раскладке media-server и с -cover-mode=embed-first или folder-only рядом
+		// с треками альбома кладём обложку folder.jpg
+		if folderCover {
+			coverMu.Lock()
+			err := client.saveFolderCover(filepath.Dir(filePath), track)
+			coverMu.Unlock()
+			if err != nil {
+				errf("[%d/%d] Предупреждение: не удалось сохранить %s для %s — %s (%v)\n", i+1, len(tracks), folderCoverFileName, track.Title, artistStr, err)
+			}
+		}
+
+		if err := dest.Store(filePath); err != nil {
+			errf("[%d/%d] ✗ Ошибка выгрузки: %s — %s (%v)\n", i+1, len(tracks), track.Title, artistStr, err)
+			state.Mark(trackIDStr, trackStateFailed, fileName, err)
+			setResult(i, track, artistStr, resultFailed, "", err)
+			fail()
+			return
+		}
+
+		// Выводим результат
+		logf("[%d/%d] ✓ Сохранено: %s%s\n", i+1, len(tracks), fileName, unavailableMark)
+		state.Mark(trackIDStr, trackStateDone, fileName, nil)
+		recordDedup(trackIDStr, filePath)
+		entry := CatalogEntry{Track: track, LocalPath: filePath}
+		if opts.Catalog != nil {
+			if entry.Checksum, err = fileChecksum(filePath); err != nil {
+				log.Printf("Предупреждение: не удалось посчитать контрольную сумму %s: %v\n", filePath, err)
+			}
+		}
+		mu.Lock()
+		addToCatalog(entry)
+		mu.Unlock()
+		bitrateSlots[i] = &BitrateRecord{
+			TrackID: trackIDStr,
+			Title:   track.Title,
+			Artist:  artistStr,
+			File:    fileName,
+			Codec:   usedInfo.Codec,
+			Bitrate: usedInfo.Bitrate,
+		}
+		result := setResult(i, track, artistStr, resultDownloaded, filePath, nil)
+		result.Codec = usedInfo.Codec
+		result.Bitrate = usedInfo.Bitrate
+		result.Preview = usedInfo.Preview
+		count(&downloaded)
+	})
+	progress.Close()
+	if err := state.Save(); err != nil {
+		log.Printf("Предупреждение: не удалось сохранить состояние выгрузки: %v\n", err)
+	}
+	close(stopEvents)
+	<-eventsDone
+	if opts.Events != nil {
+		emitProgress()
+	}
+	if opts.Dedup != nil {
+		if err := opts.Dedup.Save(); err != nil {
+			log.Printf("Предупреждение: не удалось сохранить индекс %s: %v\n", opts.Dedup.path, err)
+		}
+	}
+	if diskFull.Load() {
+		opts.errorf("\nОстановлено: на диске осталось меньше %s (-min-free), обработано %d из %d треков\n",
+			formatSize(opts.MinFree), downloaded+skipped+failed+notDirect+unavailable+removed+permanent, len(tracks))
+	} else if stopped.Load() {
+		opts.errorf("\nОстановлено после первой ошибки (-fail-fast): обработано %d из %d треков\n",
+			downloaded+skipped+failed+notDirect+unavailable+removed+permanent, len(tracks))
+	}
+
+	var bitrates []BitrateRecord
+	for _, record := range bitrateSlots {
+		if record != nil {
+			bitrates = append(bitrates, *record)
+		}
+	}
+	var results []TrackResult
+	for _, result := range resultSlots {
+		if result != nil {
+			results = append(results, *result)
+		}
+	}
+	flushCatalog()
+
+	if len(bitrates) > 0 {
+		report := newBitrateReport(bitrates, opts.Bitrate)
+		if !opts.Quiet {
+			report.Print()
+		}
+		if opts.BitrateReport != "" {
+			if err := report.Save(opts.BitrateReport); err != nil {
+				log.Printf("Предупреждение: не удалось записать отчёт о битрейтах: %v\n", err)
+			}
+		}
+	}
+
+	opts.infof("\nГотово!\n")
+	opts.infof("Скачано: %d\n", downloaded)
+	opts.infof("Пропущено: %d\n", skipped)
+	if notDirect > 0 {
+		opts.infof("Недоступно для прямого скачивания: %d\n", notDirect)
+	}
+	if unavailable > 0 {
+		opts.infof("Недоступно в регионе (пропущено, см. -include-unavailable): %d\n", unavailable)
+	}
+	if removed > 0 {
+		opts.infof("Удалено из каталога (пропущено, см. -recheck-removed): %d\n", removed)
+	}
+	if permanent > 0 {
+		opts.infof("Постоянные ошибки (пропущено, см. -retry-permanent-failures): %d\n", permanent)
+	}
+	opts.infof("Ошибок: %d\n", failed)
+	if opts.MinFree > 0 {
+		if free, err := diskFreeSpace(folderName); err == nil {
+			opts.infof("Свободно на диске: %s\n", formatSize(free))
+		}
+	}
+
+	return DownloadSummary{
+		Downloaded:  downloaded,
+		Skipped:     skipped,
+		Failed:      failed,
+		NotDirect:   notDirect,
+		Unavailable: unavailable,
+		Removed:     removed,
+		Permanent:   permanent,
+		Results:     results,
+	}
+}
+
+// progressArea выводит живой прогресс нескольких одновременных скачиваний: по строке
+// на каждое активное скачивание, которые перерисовываются на месте ANSI-последовательностями.
+// Постоянные сообщения (итог по треку, ошибки) печатаются над областью. Без live
+// (не терминал, -ci, -quiet) живые строки не выводятся, а сообщения печатаются как обычно
+type progressArea struct {
+	mu    sync.Mutex
+	out   io.Writer
+	live  bool
+	lines []string // Живые строки по слотам
+	used  []bool   // Занят ли слот активным скачиванием
+	drawn int      // Сколько строк области сейчас выведено на экран
+}
+
+// newProgressArea создает область прогресса, выводящую в out
+func newProgressArea(out io.Writer, live bool) *progressArea {
+	return &progressArea{out: out, live: live}
+}
+
+// Acquire занимает свободную строку области для нового скачивания и возвращает её номер
+func (p *progressArea) Acquire() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for slot, used := range p.used {
+		if !used {
+			p.used[slot] = true
+			p.lines[slot] = ""
+			return slot
+		}
+	}
+	p.used = append(p.used, true)
+	p.lines = append(p.lines, "")
+	return len(p.used) - 1
+}
+
+// Update заменяет текст строки slot и перерисовывает область
+func (p *progressArea) Update(slot int, line string) {
+	if !p.live {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lines[slot] = line
+	p.redraw()
+}
+
+// Release освобождает строку slot; она исчезает из области при следующей перерисовке
+func (p *progressArea) Release(slot int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used[slot] = false
+	p.lines[slot] = ""
+	if p.live {
+		p.redraw()
+	}
+}
+
+// Printf печатает постоянное сообщение над областью живого прогресса
+func (p *progressArea) Printf(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.live {
+		p.erase()
+	}
+	fmt.Fprintf(p.out, format, args...)
+	if p.live {
+		p.redraw()
+	}
+}
+
+// Close стирает область живого прогресса
+func (p *progressArea) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.live {
+		p.erase()
+	}
+}
+
+// erase поднимает курсор к началу области и стирает её; вызывается под p.mu
+func (p *progressArea) erase() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\033[%dA", p.drawn)
+	}
+	fmt.Fprint(p.out, "\r\033[J")
+	p.drawn = 0
+}
+
+// redraw заново выводит строки активных скачиваний; вызывается под p.mu
+func (p *progressArea) redraw() {
+	p.erase()
+	for slot, line := range p.lines {
+		if p.used[slot] && line != "" {
+			fmt.Fprintln(p.out, line)
+			p.drawn++
+		}
+	}
+}
+
+// Manifest представляет манифест выгрузки — полное описание запуска команды скачивания:
+// источник, параметры, от которых зависят файлы, и итог по каждому треку. Манифеста
+// достаточно, чтобы повторить ту же выгрузку (те же треки, качество, раскладку и имена файлов)
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"` // Версия схемы манифеста
+	ToolVersion   string            `json:"toolVersion"`   // Версия утилиты
+	CreatedAt     string            `json:"createdAt"`     // Время завершения выгрузки (RFC 3339)
+	Command       string            `json:"command"`       // Команда скачивания
+	SourceID      string            `json:"sourceId,omitempty"`
+	Folder        string            `json:"folder"` // Папка назначения (-to)
+	Options       ManifestOptions   `json:"options"`
+	Tracks        []ManifestTrack   `json:"tracks"`
+	Summary       map[string]int    `json:"summary"`
+	Extra         map[string]string `json:"extra,omitempty"` // Дополнительные query-параметры API (-query)
+}
+
+// ManifestOptions содержит параметры запуска, влияющие на состав, качество и имена файлов
+type ManifestOptions struct {
+	Layout             string `json:"layout"`
+	OnCollision        string `json:"onCollision"`
+	Bitrate            int    `json:"bitrate,omitempty"`
+	Quality            string `json:"quality,omitempty"`
+	MaxTitleLength     int    `json:"maxTitleLength,omitempty"`
+	NameTemplate       string `json:"nameTemplate,omitempty"`
+	MaxArtists         int    `json:"maxArtists,omitempty"`
+	PrependIndex       bool   `json:"prependIndex,omitempty"`
+	CommentTemplate    string `json:"commentTemplate,omitempty"`
+	ISRC               bool   `json:"isrc,omitempty"`
+	BPM                bool   `json:"bpm,omitempty"`
+	ID3Version         string `json:"id3Version"`
+	NoTags             bool   `json:"noTags,omitempty"`
+	MinDuration        string `json:"minDuration,omitempty"`
+	MaxDuration        string `json:"maxDuration,omitempty"`
+	ExcludeDislikes    bool   `json:"excludeDislikes,omitempty"`
+	AllAlbums          bool   `json:"allAlbums,omitempty"`
+	CoverFile          string `json:"coverFile,omitempty"`
+	CoverMode          string `json:"coverMode,omitempty"`
+	AddedSince         string `json:"addedSince,omitempty"`
+	CompleteAlbums     int    `json:"completeAlbums,omitempty"` // Порог -complete-albums в процентах
+	NormalizeCase      string `json:"normalizeCase,omitempty"`
+	ShuffleSeed        int64  `json:"shuffleSeed,omitempty"`  // Seed -shuffle, если треки перемешаны
+	DateFormat         string `json:"dateFormat,omitempty"`   // -date-format, если отличается от YYYY-MM-DD
+	KnownArtists       string `json:"knownArtists,omitempty"` // Путь к файлу -known-artists
+	Lang               string `json:"lang,omitempty"`
+	Region             string `json:"region,omitempty"`
+	IncludeUnavailable bool   `json:"includeUnavailable,omitempty"`
+	DedupLink          string `json:"link,omitempty"` // -link, если задан -dedup-index
+	Cue                bool   `json:"cue,omitempty"`
+}
+
+// ManifestTrack представляет трек в манифесте выгрузки
+type ManifestTrack struct {
+	ID      string `json:"id"`
+	AlbumID string `json:"albumId,omitempty"`
+	Title   string `json:"title"`
+	Artist  string `json:"artist"`
+	Album   string `json:"album,omitempty"`
+	Status  string `json:"status"`            // downloaded, skipped, failed, not-direct, unavailable, removed или permanently-failed
+	File    string `json:"file,omitempty"`    // Путь к файлу относительно папки назначения, через /
+	Codec   string `json:"codec,omitempty"`   // Кодек скачанного варианта
+	Bitrate int    `json:"bitrate,omitempty"` // Битрейт скачанного варианта в кбит/с
+	Error   string `json:"error,omitempty"`
+}
+
+// trackLocation возвращает путь к файлу трека для отчётов (см. Destination.Location);
+// пустой путь остаётся пустым
+func trackLocation(dest Destination, localPath string) string {
+	if localPath == "" {
+		return ""
+	}
+	return dest.Location(localPath)
+}
+
+// newManifest собирает манифест по результатам команды скачивания. folder — папка
+// назначения, как её указал пользователь (-to), root — локальная папка, от которой
+// отсчитываются пути файлов; для WebDAV это временная папка, а не адрес сервера
+func newManifest(command string, sourceID string, folder string, root string, options ManifestOptions, summary DownloadSummary) Manifest {
+	manifest := Manifest{
+		SchemaVersion: manifestSchemaVersion,
+		ToolVersion:   version,
+		CreatedAt:     time.Now().Format(time.RFC3339),
+		Command:       command,
+		SourceID:      sourceID,
+		Folder:        folder,
+		Options:       options,
+		Tracks:        make([]ManifestTrack, 0, len(summary.Results)),
+		Summary: map[string]int{
+			resultDownloaded:  summary.Downloaded,
+			resultSkipped:     summary.Skipped,
+			resultFailed:      summary.Failed,
+			resultNotDirect:   summary.NotDirect,
+			resultUnavailable: summary.Unavailable,
+			resultRemoved:     summary.Removed,
+			resultPermanent:   summary.Permanent,
+		},
+	}
+	for _, r := range summary.Results {
+		track := ManifestTrack{
+			ID:      r.ID,
+			AlbumID: r.AlbumID,
+			Title:   r.Title,
+			Artist:  r.Artist,
+			Album:   r.Album,
+			Status:  r.Status,
+			Codec:   r.Codec,
+			Bitrate: r.Bitrate,
+			Error:   r.Error,
+		}
+		if r.Path != "" {
+			if rel, err := filepath.Rel(root, r.Path); err == nil {
+				track.File = filepath.ToSlash(rel)
+			} else {
+				track.File = filepath.ToSlash(r.Path)
+			}
+		}
+		manifest.Tracks = append(manifest.Tracks, track)
+	}
+	return manifest
+}
+
+// Save записывает манифест в JSON-файл
+func (m Manifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// RunSummary представляет итог команды скачивания для -summary: счетчики, объём и
+// длительность без списка треков, чтобы мониторинг мог проверять их без разбора вывода
+type RunSummary struct {
+	ToolVersion    string  `json:"toolVersion"`
+	Command        string  `json:"command"`
+	SourceID       string  `json:"sourceId,omitempty"`
+	Folder         string  `json:"folder"`
+	StartedAt      string  `json:"startedAt"`  // RFC 3339
+	FinishedAt     string  `json:"finishedAt"` // RFC 3339
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	Total          int     `json:"total"` // Всего обработано треков
+	Downloaded     int     `json:"downloaded"`
+	Skipped        int     `json:"skipped"`
+	Failed         int     `json:"failed"`
+	NotDirect      int     `json:"notDirect"`
+	Unavailable    int     `json:"unavailable"`
+	Removed        int     `json:"removed"`
+	Permanent      int     `json:"permanentlyFailed"` // Пропущено из-за постоянной ошибки (-max-retries)
+	Previews       int     `json:"previews"`          // Из них скачано только превью
+	// Доля треков, которые после запуска есть на диске (скачаны или уже были), от 0 до 1;
+	// при пустом списке треков — 1
+	SuccessRate float64 `json:"successRate"`
+	Bytes       int64   `json:"bytes"`    // Скачано байт аудио, включая недокачанные файлы
+	ExitCode    int     `json:"exitCode"` // Код выхода программы
+}
+
+// newRunSummary собирает итог для -summary по счетчикам команды скачивания
+func newRunSummary(command string, sourceID string, folder string, summary DownloadSummary, bytes int64, startedAt, finishedAt time.Time, exitCode int) RunSummary {
+	run := RunSummary{
+		ToolVersion:    version,
+		Command:        command,
+		SourceID:       sourceID,
+		Folder:         folder,
+		StartedAt:      startedAt.Format(time.RFC3339),
+		FinishedAt:     finishedAt.Format(time.RFC3339),
+		ElapsedSeconds: math.Round(finishedAt.Sub(startedAt).Seconds()*1000) / 1000,
+		Total:          len(summary.Results),
+		Downloaded:     summary.Downloaded,
+		Skipped:        summary.Skipped,
+		Failed:         summary.Failed,
+		NotDirect:      summary.NotDirect,
+		Unavailable:    summary.Unavailable,
+		Removed:        summary.Removed,
+		Permanent:      summary.Permanent,
+		SuccessRate:    1,
+		Bytes:          bytes,
+		ExitCode:       exitCode,
+	}
+	withFile := 0
+	for _, r := range summary.Results {
+		if r.Preview {
+			run.Previews++
+		}
+		if r.HasFile() {
+			withFile++
+		}
+	}
+	if run.Total > 0 {
+		run.SuccessRate = math.Round(float64(withFile)/float64(run.Total)*10000) / 10000
+	}
+	return run
+}
+
+// Save записывает итог в JSON-файл
+func (s RunSummary) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// writeResultsCSV записывает CSV-индекс результатов скачивания с заголовком
+func writeResultsCSV(path string, results []TrackResult, bom bool) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if bom {
+		if _, err := file.WriteString(utf8BOM); err != nil {
+			return err
+		}
+	}
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"id", "title", "artist", "album", "duration_ms", "status", "path", "codec", "bitrate", "error"})
+	for _, r := range results {
+		bitrate := ""
+		if r.Bitrate > 0 {
+			bitrate = strconv.Itoa(r.Bitrate)
+		}
+		w.Write([]string{r.ID, r.Title, r.Artist, r.Album, strconv.Itoa(r.DurationMs), r.Status, r.Path, r.Codec, bitrate, r.Error})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Кодировки текстового вывода для -output-encoding
+const (
+	encodingUTF8    = "utf-8"
+	encodingUTF8BOM = "utf-8-bom"
+)
+
+// utf8BOM — метка порядка байтов UTF-8. Без неё Excel в Windows открывает CSV
+// в кодировке ANSI, и кириллица превращается в «кракозябры»
+const utf8BOM = "\xEF\xBB\xBF"
+
+// parseOutputEncoding разбирает значение -output-encoding и сообщает, нужна ли метка
+// порядка байтов. Флаг -bom равносилен -output-encoding=utf-8-bom
+func parseOutputEncoding(value string, bom bool) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", encodingUTF8, "utf8":
+		return bom, nil
+	case encodingUTF8BOM, "utf8-bom":
+		return true, nil
+	default:
+		return false, fmt.Errorf("неизвестная кодировка %q, доступные: %s, %s", value, encodingUTF8, encodingUTF8BOM)
+	}
+}
+
+// writesTextToStdout сообщает, выводит ли команда результат текстом в stdout: только
+// такому выводу нужна метка порядка байтов. Команды скачивания пишут в stdout лишь ход
+// работы, а stream — аудио
+func writesTextToStdout(command string, folderName string) bool {
+	switch command {
+	case "playlist", "likes", "favorites", "list-playlists", "history", "export-podcasts",
+		"export-all-tracks", "info", "template-preview", "list-formats", "link":
+		return true
+	case "wave":
+		return folderName == ""
+	}
+	return false
+}
+
+// writeResultsM3U записывает расширенный плейлист M3U из треков, файлы которых есть на диске.
+// results идут в порядке источника (см. resultSlots в downloadTracks), поэтому и плейлист
+// повторяет его, в каком бы порядке ни завершились параллельные скачивания. Треки, которые
+// не дошли до обработки (-fail-fast, нехватка места) или не скачались, в плейлист не попадают.
+// Пути записываются относительно папки плейлиста, если это возможно
+func writeResultsM3U(path string, results []TrackResult) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+
+	m3uDir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if !r.HasFile() {
+			continue
+		}
+		trackPath, err := filepath.Abs(r.Path)
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(m3uDir, trackPath); err == nil {
+			trackPath = rel
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%s - %s\n%s\n", r.DurationMs/1000, r.Artist, r.Title, filepath.ToSlash(trackPath))
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// writeResultsJSON записывает результаты скачивания в JSON-файл
+func writeResultsJSON(path string, results []TrackResult) error {
+	if results == nil {
+		results = []TrackResult{}
+	}
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// LyricsEntry представляет текст песни в общем файле текстов (-lyrics-file)
+type LyricsEntry struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Lyrics string `json:"lyrics"`
+}
+
+// writeLyricsFile собирает тексты песен треков запуска в один файл: JSON, если у path
+// расширение .json, иначе текст, где каждая песня начинается с заголовка «исполнитель — название».
+// Тексты запрашиваются по одному треку за раз; треки без текста пропускаются
+func writeLyricsFile(client *YandexMusicClient, path string, results []TrackResult) (int, error) {
+	entries := []LyricsEntry{}
+	for _, result := range results {
+		if result.Status == resultFailed || result.Status == resultNotDirect || result.Status == resultUnavailable || result.Status == resultRemoved || result.Status == resultPermanent {
+			continue
+		}
+		lyrics, err := client.GetTrackLyrics(result.ID)
+		if err != nil {
+			log.Printf("Предупреждение: не удалось получить текст песни %s — %s: %v\n", result.Artist, result.Title, err)
+			continue
+		}
+		if lyrics == "" {
+			continue
+		}
+		entries = append(entries, LyricsEntry{ID: result.ID, Title: result.Title, Artist: result.Artist, Lyrics: lyrics})
+	}
+
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var err error
+		if data, err = json.MarshalIndent(entries, "", "  "); err != nil {
+			return 0, err
+		}
+	} else {
+		var b strings.Builder
+		for i, entry := range entries {
+			if i > 0 {
+				b.WriteString("\n\n")
+			}
+			fmt.Fprintf(&b, "=== %s — %s ===\n\n%s\n", entry.Artist, entry.Title, entry.Lyrics)
+		}
+		data = []byte(b.String())
+	}
+	return len(entries), os.WriteFile(path, data, 0644)
+}
+
+// EventWriter пишет события выгрузки для внешних систем мониторинга (-events): по JSON-объекту
+// на строку. Пишется из параллельных скачиваний, поэтому запись защищена мьютексом
+type EventWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	closer io.Closer
+}
+
+// OpenEventWriter открывает поток событий: "-" — stderr, иначе файл (дописывается)
+func OpenEventWriter(path string) (*EventWriter, error) {
+	if path == "-" {
+		return &EventWriter{out: os.Stderr}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &EventWriter{out: f, closer: f}, nil
+}
+
+// Emit записывает событие; ошибки записи не прерывают выгрузку
+func (e *EventWriter) Emit(event interface{}) {
+	if e == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.out.Write(append(data, '\n'))
+}
+
+// Close закрывает файл событий
+func (e *EventWriter) Close() error {
+	if e == nil || e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+// TrackEvent — событие о завершении обработки трека
+type TrackEvent struct {
+	Event  string `json:"event"` // Всегда "track"
+	Time   string `json:"time"`  // RFC 3339
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Status string `json:"status"`
+	Path   string `json:"path,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ProgressEvent — периодическая сводка прогресса, не зависящая от событий по трекам
+type ProgressEvent struct {
+	Event       string `json:"event"` // Всегда "progress"
+	Time        string `json:"time"`  // RFC 3339
+	Done        int    `json:"done"`  // Обработано треков
+	Total       int    `json:"total"`
+	Bytes       int64  `json:"bytes"`       // Скачано байт аудио с начала выгрузки
+	BytesPerSec int64  `json:"bytesPerSec"` // Скорость за последний интервал
+	ETASeconds  *int   `json:"etaSeconds"`  // Оценка оставшегося времени по темпу обработки; null — пока неизвестна
+}
+
+// writeTarGz упаковывает папку выгрузки в архив tar.gz, сохраняя структуру папок раскладки.
+// Треки к этому моменту уже скачаны и протегированы в папке, поэтому в архив попадают готовые
+// файлы. Блокировка, временные файлы и корзина -prune не упаковываются. extra — сопутствующие
+// файлы вне папки (манифест, M3U и т.п.): они кладутся в корень архива под своими именами
+func writeTarGz(archivePath string, folderName string, extra []string) (int, error) {
+	absArchive, _ := filepath.Abs(archivePath)
+	tmpPath := archivePath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	added := 0
+	addFile := func(path string, name string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+		added++
+		return nil
+	}
+
+	inFolder := make(map[string]bool)
+	err = filepath.WalkDir(folderName, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(folderName, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == pruneTrashDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if name == exportLockFileName || strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+		if absPath, _ := filepath.Abs(path); absPath == absArchive {
+			return nil
+		}
+		inFolder[filepath.Clean(path)] = true
+		// Символические ссылки (-link=symlink) упаковываются как файлы, на которые указывают
+		return addFile(path, filepath.ToSlash(rel))
+	})
+	for _, path := range extra {
+		if err != nil {
+			break
+		}
+		if path == "" || inFolder[filepath.Clean(path)] {
+			continue
+		}
+		if _, statErr := os.Stat(path); statErr != nil {
+			continue
+		}
+		err = addFile(path, filepath.Base(path))
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return added, os.Rename(tmpPath, archivePath)
+}
+
+// readFailedTrackIDs читает отчёт прошлого запуска и возвращает ID треков со статусом
+// failed в порядке отчёта. Понимает и массив результатов (-json), и манифест (-manifest)
+func readFailedTrackIDs(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	type reportTrack struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	var tracks []reportTrack
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &tracks)
+	} else {
+		var manifest struct {
+			Tracks []reportTrack `json:"tracks"`
+		}
+		err = json.Unmarshal(data, &manifest)
+		tracks = manifest.Tracks
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка разбора JSON: %w", err)
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, track := range tracks {
+		if track.Status != resultFailed || track.ID == "" || seen[track.ID] {
+			continue
+		}
+		seen[track.ID] = true
+		ids = append(ids, track.ID)
+	}
+	return ids, nil
+}
+
+// APIError представляет ответ API с неуспешным HTTP-статусом
+type APIError struct {
+	StatusCode int    // HTTP-статус ответа
+	Body       string // Тело ответа
+	Endpoint   string // Метод и путь запроса, например "GET /tracks/123"; пусто — неизвестны
+
+	RetryAfter time.Duration // Задержка из заголовка Retry-After (0 — заголовка нет)
+}
+
+func (e *APIError) Error() string {
+	prefix := "ошибка API"
+	if e.Endpoint != "" {
+		prefix = fmt.Sprintf("ошибка API (%s)", e.Endpoint)
+	}
+	if e.Body == "" {
+		return fmt.Sprintf("%s: статус %d", prefix, e.StatusCode)
+	}
+	return fmt.Sprintf("%s: статус %d, ответ: %s", prefix, e.StatusCode, e.Body)
+}
+
+// exitCodeFor определяет код завершения по причине ошибки
+func exitCodeFor(err error) int {
+	if errors.Is(err, ErrPlaylistPrivate) {
+		return exitAuth
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return exitAuth
+		case http.StatusNotFound:
+			return exitNotFound
+		}
+		return exitFailure
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return exitNetwork
+	}
+	return exitFailure
+}
+
+// exitHooks — действия, которые нужно выполнить перед завершением программы: снять
+// блокировку папки назначения, удалить временную папку WebDAV
+var (
+	exitHooksMu sync.Mutex
+	exitHooks   []func()
+)
+
+// atExit регистрирует действие, которое выполнится при завершении программы через exit,
+// fatal или fatalf, а также при обычном выходе из main
+func atExit(fn func()) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, fn)
+}
+
+// runExitHooks выполняет зарегистрированные действия в обратном порядке, каждое один раз
+func runExitHooks() {
+	exitHooksMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitHooksMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// exit выполняет зарегистрированные через atExit действия и завершает программу с кодом code.
+// Вызывается вместо os.Exit и log.Fatal, которые не выполняют defer
+func exit(code int) {
+	runExitHooks()
+	os.Exit(code)
+}
+
+// fatal выводит сообщение об ошибке и завершает программу с кодом exitFailure
+func fatal(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	exit(exitFailure)
+}
+
+// fatalf выводит сообщение об ошибке и завершает программу с кодом, соответствующим её причине
+func fatalf(err error, format string, args ...interface{}) {
+	log.Printf(format, args...)
+	exit(exitCodeFor(err))
+}
+
+// ExitCode возвращает код завершения команды скачивания: 0, если ошибок не было,
+// exitPartial, если часть треков не скачалась, и exitFailure, если не скачалось ничего
+func (s DownloadSummary) ExitCode() int {
+	if s.Failed == 0 {
+		return exitOK
+	}
+	if s.Downloaded+s.Skipped+s.NotDirect+s.Unavailable+s.Removed+s.Permanent > 0 {
+		return exitPartial
+	}
+	return exitFailure
+}
+
+// Incomplete возвращает треки, которые не удалось получить полностью: с ошибкой,
+// недоступные для прямого скачивания или в регионе, удалённые из каталога и скачанные
+// только как превью (-strict)
+func (s DownloadSummary) Incomplete() []TrackResult {
+	var incomplete []TrackResult
+	for _, result := range s.Results {
+		switch {
+		case result.Status == resultFailed, result.Status == resultNotDirect, result.Status == resultUnavailable, result.Status == resultRemoved, result.Status == resultPermanent:
+			incomplete = append(incomplete, result)
+		case result.Preview:
+			incomplete = append(incomplete, result)
+		}
+	}
+	return incomplete
+}
+
+// confirmDownload спрашивает подтверждение, если к скачиванию confirmTrackThreshold треков
+// или больше. Вопрос задаётся только в интерактивном терминале и без -yes, -quiet и режима CI
+func confirmDownload(tracks []TrackShort, folderName string, opts DownloadOptions) bool {
+	if len(tracks) < confirmTrackThreshold || opts.AssumeYes || opts.Quiet || opts.CI || !isTerminal(os.Stdin) {
+		return true
+	}
+
+	bitrate := opts.Bitrate
+	if bitrate <= 0 {
+		bitrate = maxMP3Bitrate
+	}
+	fmt.Printf("Будет скачано треков: %d\n", len(tracks))
+	fmt.Printf("Примерный объём: %s (при %d кбит/с)\n", formatSize(estimateDownloadSize(tracks, bitrate)), bitrate)
+	fmt.Printf("Папка: %s\n", folderName)
+	fmt.Print("Продолжить? [y/N]: ")
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes", "д", "да":
+		return true
+	}
+	return false
+}
+
+// estimateDownloadSize оценивает объём скачивания в байтах по длительности треков и битрейту в кбит/с
+func estimateDownloadSize(tracks []TrackShort, bitrate int) int64 {
+	var totalMs int64
+	for _, trackShort := range tracks {
+		totalMs += int64(trackShort.Track.DurationMs)
+	}
+	return totalMs * int64(bitrate) / 8
+}
+
+// spaceReservations учитывает место, обещанное файлам, которые сейчас скачиваются:
+// diskFreeSpace видит только уже записанные байты, и без резерва параллельные скачивания,
+// каждое из которых прошло проверку, вместе заняли бы больше, чем допускает -min-free
+var spaceReservations struct {
+	mu       sync.Mutex   // Делает проверку и резервирование одним шагом
+	reserved atomic.Int64 // Ещё не записанные байты скачиваний, прошедших проверку
+}
+
+// spaceReservation — место, зарезервированное под один файл. По мере записи резерв
+// уменьшается, потому что записанные байты уже учтены в свободном месте на диске
+type spaceReservation struct {
+	remaining int64
+}
+
+// Write уменьшает резерв на n записанных байт
+func (r *spaceReservation) Write(p []byte) (int, error) {
+	if r != nil && r.remaining > 0 {
+		n := min(int64(len(p)), r.remaining)
+		r.remaining -= n
+		spaceReservations.reserved.Add(-n)
+	}
+	return len(p), nil
+}
+
+// Release возвращает незаписанный остаток резерва, например после ошибки скачивания
+func (r *spaceReservation) Release() {
+	if r != nil && r.remaining > 0 {
+		spaceReservations.reserved.Add(-r.remaining)
+		r.remaining = 0
+	}
+}
+
+// reserveFreeSpace проверяет, что после записи size байт в папку dir на диске останется
+// не меньше minFree байт с учётом места, зарезервированного другими скачиваниями, и
+// резервирует size байт. Неизвестный размер (-1) считается нулевым. Если minFree не
+// задан, возвращает nil без ошибки: методы spaceReservation принимают nil
+func reserveFreeSpace(dir string, size int64, minFree int64) (*spaceReservation, error) {
+	if minFree <= 0 {
+		return nil, nil
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	spaceReservations.mu.Lock()
+	defer spaceReservations.mu.Unlock()
+	free, err := diskFreeSpace(dir)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка определения свободного места в %s: %w", dir, err)
+	}
+	reserved := spaceReservations.reserved.Load()
+	if free-reserved-size < minFree {
+		return nil, fmt.Errorf("%w: свободно %s, из них %s ждут скачивающиеся файлы, файл занимает %s, а должно оставаться не меньше %s (-min-free)",
+			ErrLowDiskSpace, formatSize(free), formatSize(reserved), formatSize(size), formatSize(minFree))
+	}
+	spaceReservations.reserved.Add(size)
+	return &spaceReservation{remaining: size}, nil
+}
+
+// parseByteSize разбирает размер вида 500M, 1G или 1.5GB (множитель 1024); число без
+// суффикса — байты
+func parseByteSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("неверный размер %q, ожидается, например, 500M или 1G", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// formatSize форматирует размер в байтах в виде 12.3 МБ
+func formatSize(size int64) string {
+	units := []string{"Б", "КБ", "МБ", "ГБ", "ТБ"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// TrackState представляет состояние отдельного трека в файле состояния выгрузки
+type TrackState struct {
+	Status    string `json:"status"`              // pending, done, failed, removed или permanently-failed
+	File      string `json:"file,omitempty"`      // Имя файла в папке назначения
+	Error     string `json:"error,omitempty"`     // Текст последней ошибки
+	UpdatedAt string `json:"updatedAt,omitempty"` // Время последнего изменения (RFC 3339)
+	Failures  int    `json:"failures,omitempty"`  // Запусков подряд, в которых трек не скачался
+}
+
+// PlaylistState представляет последнюю синхронизированную ревизию плейлиста
+type PlaylistState struct {
+	Title    string   `json:"title,omitempty"`    // Название плейлиста
+	Revision int      `json:"revision"`           // Ревизия плейлиста при последней полной синхронизации
+	Snapshot int      `json:"snapshot,omitempty"` // Снимок плейлиста при последней полной синхронизации
+	TrackIDs []string `json:"trackIds"`           // ID успешно синхронизированных треков
+	SyncedAt string   `json:"syncedAt,omitempty"` // Время синхронизации (RFC 3339)
+}
+
+// ExportState представляет состояние пакетной выгрузки, позволяющее
+// продолжить прерванный запуск с места остановки
+//
+// Формат рассчитан на общую папку, с которой работают несколько компьютеров: записи
+// треков и плейлистов независимы и сливаются по времени изменения (см. merge), а
+// одновременные запуски исключает файл блокировки (см. acquireExportLock)
+type ExportState struct {
+	Version   int                       `json:"version"`             // Версия формата файла
+	Tracks    map[string]*TrackState    `json:"tracks"`              // Состояния треков по ID
+	Playlists map[string]*PlaylistState `json:"playlists,omitempty"` // Ревизии синхронизированных плейлистов по owner:kind
+
+	path      string
+	mu        sync.Mutex      // Защищает Tracks и запись файла при параллельном скачивании
+	diskSum   [32]byte        // SHA-256 содержимого файла при последнем чтении или записи
+	forgotten map[string]bool // ID треков, удалённых из состояния в этом запуске
+	dirty     int             // Изменений, ещё не записанных на диск
+	savedAt   time.Time       // Время последней записи на диск
+}
+
+// Отметки треков копятся в памяти и записываются на диск пачкой: каждые stateFlushTracks
+// изменений или раз в stateFlushInterval, а также в конце скачивания и при прерывании.
+// Запись после каждого трека переписывала бы весь файл n раз — O(n²) на больших библиотеках
+const (
+	stateFlushTracks   = 50
+	stateFlushInterval = 10 * time.Second
+)
+
+// exportStateVersion — текущая версия формата файла состояния
+const exportStateVersion = 1
+
+// loadExportState загружает файл состояния выгрузки; если файла нет, возвращает пустое состояние
+func loadExportState(path string) (*ExportState, error) {
+	state := &ExportState{
+		Version:   exportStateVersion,
+		Tracks:    make(map[string]*TrackState),
+		Playlists: make(map[string]*PlaylistState),
+		path:      path,
+		forgotten: make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("ошибка чтения файла состояния: %w", err)
+	}
+
+	state.diskSum = sha256.Sum256(data)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования файла состояния %s: %w", path, err)
+	}
+	if state.Version > exportStateVersion {
+		return nil, fmt.Errorf("файл состояния %s записан более новой версией программы (формат %d, поддерживается до %d)", path, state.Version, exportStateVersion)
+	}
+	state.Version = exportStateVersion
+	if state.Tracks == nil {
+		state.Tracks = make(map[string]*TrackState)
+	}
+	if state.Playlists == nil {
+		state.Playlists = make(map[string]*PlaylistState)
+	}
+
+	return state, nil
+}
+
+// Mark обновляет статус трека; на диск состояние записывается пачкой (см. stateFlushTracks)
+func (s *ExportState) Mark(trackID string, status string, fileName string, trackErr error) {
+	entry := &TrackState{
+		Status:    status,
+		File:      fileName,
+		UpdatedAt: time.Now().Format(time.RFC3339),
+	}
+	if trackErr != nil {
+		entry.Error = trackErr.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Tracks[trackID] = entry
+	delete(s.forgotten, trackID)
+	s.changed()
+}
+
+// changed учитывает изменение и записывает состояние, если накопилась пачка или прошло
+// stateFlushInterval с прошлой записи; вызывается под s.mu
+func (s *ExportState) changed() {
+	s.dirty++
+	if s.dirty < stateFlushTracks && time.Since(s.savedAt) < stateFlushInterval {
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Предупреждение: не удалось сохранить состояние выгрузки: %v\n", err)
+	}
+}
+
+// MarkFailed отмечает ошибку трека; состояние записывается пачкой, как в Mark. Ошибки считаются по запускам
+// подряд; когда их становится больше maxRetries (если он задан), трек получает статус
+// permanently-failed, и MarkFailed возвращает true
+func (s *ExportState) MarkFailed(trackID string, fileName string, trackErr error, maxRetries int) bool {
+	entry := &TrackState{
+		Status:    trackStateFailed,
+		File:      fileName,
+		Error:     trackErr.Error(),
+		UpdatedAt: time.Now().Format(time.RFC3339),
+		Failures:  1,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.Tracks[trackID]; ok && (prev.Status == trackStateFailed || prev.Status == trackStatePermanentlyFailed) {
+		entry.Failures = prev.Failures + 1
+	}
+	permanent := maxRetries > 0 && entry.Failures > maxRetries
+	if permanent {
+		entry.Status = trackStatePermanentlyFailed
+	}
+	s.Tracks[trackID] = entry
+	delete(s.forgotten, trackID)
+	s.changed()
+	return permanent
+}
+
+// TrackError возвращает текст последней ошибки трека из состояния
+func (s *ExportState) TrackError(trackID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.Tracks[trackID]; ok {
+		return entry.Error
+	}
+	return ""
+}
+
+// Save атомарно записывает состояние на диск через временный файл
+func (s *ExportState) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+// Forget удаляет трек из состояния; при слиянии с файлом на диске запись не вернётся
+func (s *ExportState) Forget(trackID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Tracks, trackID)
+	s.forgotten[trackID] = true
+}
+
+// merge добавляет в состояние записи из other: отсутствующие берутся как есть, а из
+// двух версий одной записи остаётся более поздняя. Треки, удалённые в этом запуске, не возвращаются
+func (s *ExportState) merge(other *ExportState) {
+	for id, theirs := range other.Tracks {
+		if s.forgotten[id] {
+			continue
+		}
+		if ours, ok := s.Tracks[id]; !ok || laterRFC3339(theirs.UpdatedAt, ours.UpdatedAt) {
+			s.Tracks[id] = theirs
+		}
+	}
+	for key, theirs := range other.Playlists {
+		if ours, ok := s.Playlists[key]; !ok || laterRFC3339(theirs.SyncedAt, ours.SyncedAt) {
+			s.Playlists[key] = theirs
+		}
+	}
+}
+
+// laterRFC3339 сообщает, что время a (RFC 3339) позже времени b; неразборчивое время считается самым ранним
+func laterRFC3339(a, b string) bool {
+	ta, errA := time.Parse(time.RFC3339, a)
+	tb, errB := time.Parse(time.RFC3339, b)
+	if errA != nil {
+		return false
+	}
+	return errB != nil || ta.After(tb)
+}
+
+// save записывает состояние; вызывается под s.mu. Если файл изменился на диске после
+// последнего чтения (его записал другой компьютер, работающий с той же папкой),
+// сначала сливает его записи с текущими, чтобы не затереть чужие изменения. Изменение
+// определяется по содержимому, а не по времени изменения: на NAS и SMB время изменения
+// бывает грубым, и запись другого компьютера в ту же секунду по нему не видна
+func (s *ExportState) save() error {
+	if data, err := os.ReadFile(s.path); err == nil && sha256.Sum256(data) != s.diskSum {
+		if disk, err := loadExportState(s.path); err == nil {
+			s.merge(disk)
+		} else {
+			log.Printf("Предупреждение: файл состояния изменён извне и не читается, он будет перезаписан: %v\n", err)
+		}
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка формирования JSON: %w", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("ошибка записи файла состояния: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("ошибка сохранения файла состояния: %w", err)
+	}
+	s.diskSum = sha256.Sum256(data)
+	s.dirty = 0
+	s.savedAt = time.Now()
+
+	return nil
+}
+
+// Способы использовать файл трека, уже скачанного в другую папку (-link)
+const (
+	dedupLinkHard    = "hard"    // Жёсткая ссылка; если не вышло (другой диск) — копия
+	dedupLinkSymlink = "symlink" // Символическая ссылка на файл в другой папке
+	dedupLinkCopy    = "copy"    // Копия файла
+	dedupLinkSkip    = "skip"    // Трек пропускается, файл в папке не появляется
+)
+
+// DedupIndex — общий для нескольких папок выгрузки индекс (-dedup-index): для каждого ID
+// трека хранится абсолютный путь к уже скачанному файлу. Трек, который есть в индексе,
+// не скачивается заново, а берётся из другой папки согласно -link
+type DedupIndex struct {
+	Tracks map[string]string `json:"tracks"`
+
+	path  string
+	mu    sync.Mutex
+	added map[string]string // Записи этого запуска, которые добавляются к индексу на диске
+}
+
+// LoadDedupIndex загружает индекс из файла; если файла нет, возвращает пустой индекс
+func LoadDedupIndex(path string) (*DedupIndex, error) {
+	index := &DedupIndex{Tracks: make(map[string]string), path: path, added: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения индекса: %w", err)
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("ошибка разбора индекса %s: %w", path, err)
+	}
+	if index.Tracks == nil {
+		index.Tracks = make(map[string]string)
+	}
+	return index, nil
+}
+
+// Lookup возвращает файл трека trackID в другой папке. Файл должен существовать и не
+// совпадать с target — путём, куда трек скачивался бы сейчас
+func (d *DedupIndex) Lookup(trackID string, target string) (string, bool) {
+	d.mu.Lock()
+	source, ok := d.Tracks[trackID]
+	d.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	if absTarget, err := filepath.Abs(target); err == nil && absTarget == source {
+		return "", false
+	}
+	if info, err := os.Stat(source); err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	return source, true
+}
+
+// Record запоминает файл трека, скачанного или уже лежащего в папке выгрузки
+func (d *DedupIndex) Record(trackID string, filePath string) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Tracks[trackID] = absPath
+	d.added[trackID] = absPath
+}
+
+// Save дописывает записи этого запуска в файл индекса. Индекс перечитывается с диска
+// перед записью, чтобы не затереть записи запусков с другими папками
+func (d *DedupIndex) Save() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.added) == 0 {
+		return nil
+	}
+
+	disk, err := LoadDedupIndex(d.path)
+	if err != nil {
+		return err
+	}
+	for id, path := range d.added {
+		disk.Tracks[id] = path
+	}
+	data, err := json.MarshalIndent(disk, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка формирования JSON: %w", err)
+	}
+
+	tmpPath := d.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("ошибка записи индекса: %w", err)
+	}
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		return fmt.Errorf("ошибка сохранения индекса: %w", err)
+	}
+	for id, path := range disk.Tracks {
+		d.Tracks[id] = path
+	}
+	d.added = make(map[string]string)
+	return nil
+}
+
+// dedupLinkOption возвращает значение -link для манифеста: без -dedup-index флаг ни на что не влияет
+func dedupLinkOption(index string, link string) string {
+	if index == "" {
+		return ""
+	}
+	return link
+}
+
+// placeDedupFile создаёт target из файла source другой папки способом mode (hard, symlink
+// или copy). Жёсткая ссылка между разными дисками невозможна — тогда файл копируется
+func placeDedupFile(source string, target string, mode string) error {
+	os.Remove(target)
+	switch mode {
+	case dedupLinkSymlink:
+		return os.Symlink(source, target)
+	case dedupLinkHard:
+		if err := os.Link(source, target); err == nil {
+			return nil
+		}
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	return out.Close()
+}
+
+// Destination — место назначения готовых файлов выгрузки. Файлы всегда скачиваются
+// и тегируются в локальной папке, а назначение решает, где они остаются: локальная
+// папка хранит их на месте, удалённые назначения забирают файл себе
+type Destination interface {
+	// Exists сообщает, есть ли в назначении файл, соответствующий локальному пути
+	Exists(localPath string) (bool, error)
+	// Store передаёт в назначение готовый файл по локальному пути
+	Store(localPath string) error
+	// Restore возвращает из назначения файл по локальному пути, если он там есть
+	// (например, файл состояния прошлого запуска)
+	Restore(localPath string) error
+	// Location возвращает, где файл по локальному пути находится для пользователя: для
+	// локальной папки — сам путь, для WebDAV — адрес на сервере. Используется в отчётах
+	Location(localPath string) string
+}
+
+// localDestination — назначение по умолчанию: файлы остаются в папке -to
+type localDestination struct{}
+
+func (localDestination) Exists(localPath string) (bool, error) {
+	_, err := os.Stat(localPath)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (localDestination) Store(string) error               { return nil }
+func (localDestination) Restore(string) error             { return nil }
+func (localDestination) Location(localPath string) string { return localPath }
+
+// Схемы -to для выгрузки на сервер WebDAV: webdav:// — по HTTPS, webdav+http:// — по HTTP
+const (
+	webdavScheme     = "webdav"
+	webdavHTTPScheme = "webdav+http"
+)
+
+// isWebDAVTarget сообщает, указывает ли -to на сервер WebDAV
+func isWebDAVTarget(target string) bool {
+	return strings.HasPrefix(target, webdavScheme+"://") || strings.HasPrefix(target, webdavHTTPScheme+"://")
+}
+
+// webdavDestination выгружает файлы на сервер WebDAV (например, Nextcloud). Файлы
+// готовятся во временной локальной папке root и после записи тегов отправляются PUT;
+// аудиофайл после отправки удаляется, так что локально одновременно лежат только
+// треки, которые сейчас скачиваются
+type webdavDestination struct {
+	root     string // Локальная временная папка, соответствующая корню base
+	base     *url.URL
+	user     string
+	password string
+	client   *http.Client
+
+	mu      sync.Mutex
+	created map[string]bool // Папки на сервере, которые уже созданы или существуют
+}
+
+// newWebDAVDestination разбирает адрес webdav://[пользователь[:пароль]@]хост/путь и создаёт
+// временную папку для подготовки файлов. Пароль можно передать в WEBDAV_PASSWORD,
+// чтобы он не попадал в историю команд
+func newWebDAVDestination(target string, client *http.Client) (*webdavDestination, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("неверный адрес: %w", err)
+	}
+	switch u.Scheme {
+	case webdavScheme:
+		u.Scheme = "https"
+	case webdavHTTPScheme:
+		u.Scheme = "http"
+	default:
+		return nil, fmt.Errorf("неизвестная схема %q, ожидается %s:// или %s://", u.Scheme, webdavScheme, webdavHTTPScheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("в адресе не указан сервер")
+	}
+	d := &webdavDestination{client: client, created: make(map[string]bool)}
+	if u.User != nil {
+		d.user = u.User.Username()
+		d.password, _ = u.User.Password()
+		u.User = nil
+	}
+	if d.password == "" {
+		d.password = os.Getenv("WEBDAV_PASSWORD")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	d.base = u
+
+	if d.root, err = os.MkdirTemp("", "yandex-music-export-"); err != nil {
+		return nil, fmt.Errorf("ошибка создания временной папки: %w", err)
+	}
+	return d, nil
+}
+
+// String возвращает адрес сервера без учётных данных для вывода пользователю
+func (d *webdavDestination) String() string {
+	return d.base.String()
+}
+
+// remoteURL возвращает адрес на сервере для относительного пути rel (через /)
+func (d *webdavDestination) remoteURL(rel string) string {
+	u := *d.base
+	u.Path = path.Join(u.Path, rel)
+	return u.String()
+}
+
+// relPath переводит локальный путь в путь относительно корня назначения
+func (d *webdavDestination) relPath(localPath string) (string, error) {
+	rel, err := filepath.Rel(d.root, localPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("путь %s вне папки выгрузки", localPath)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Location возвращает адрес файла на сервере без учётных данных
+func (d *webdavDestination) Location(localPath string) string {
+	rel, err := d.relPath(localPath)
+	if err != nil {
+		return localPath
+	}
+	return d.remoteURL(rel)
+}
+
+// do выполняет запрос к серверу WebDAV с авторизацией
+func (d *webdavDestination) do(method string, rel string, body io.Reader, size int64) (*http.Response, error) {
+	return d.doWithHeader(method, rel, body, size, nil)
+}
+
+// doWithHeader выполняет запрос к серверу WebDAV с авторизацией и дополнительными заголовками
+func (d *webdavDestination) doWithHeader(method string, rel string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, d.remoteURL(rel), body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания запроса: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if d.user != "" {
+		req.SetBasicAuth(d.user, d.password)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка запроса %s %s: %w", method, rel, err)
+	}
+	return resp, nil
+}
+
+func (d *webdavDestination) Exists(localPath string) (bool, error) {
+	rel, err := d.relPath(localPath)
+	if err != nil {
+		return false, err
+	}
+	resp, err := d.do("HEAD", rel, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	}
+	return false, fmt.Errorf("WebDAV: HEAD %s: статус %d", rel, resp.StatusCode)
+}
+
+// ensureDir создаёт на сервере папку rel и все её родительские папки (MKCOL)
+func (d *webdavDestination) ensureDir(rel string) error {
+	if rel == "." || rel == "" {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dir := ""
+	for _, part := range strings.Split(rel, "/") {
+		dir = path.Join(dir, part)
+		if d.created[dir] {
+			continue
+		}
+		resp, err := d.do("MKCOL", dir, nil, 0)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		// 405 — папка уже существует
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("WebDAV: не удалось создать папку %s: статус %d", dir, resp.StatusCode)
+		}
+		d.created[dir] = true
+	}
+	return nil
+}
+
+// Store отправляет файл на сервер и удаляет локальную копию
+func (d *webdavDestination) Store(localPath string) error {
+	rel, err := d.relPath(localPath)
+	if err != nil {
+		return err
+	}
+	if err := d.ensureDir(path.Dir(rel)); err != nil {
+		return err
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	resp, err := d.do("PUT", rel, file, info.Size())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("WebDAV: PUT %s: статус %d", rel, resp.StatusCode)
+	}
+	file.Close()
+	return os.Remove(localPath)
+}
+
+func (d *webdavDestination) Restore(localPath string) error {
+	rel, err := d.relPath(localPath)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do("GET", rel, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("WebDAV: GET %s: статус %d", rel, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(localPath, data, 0644)
+}
+
+// Flush отправляет на сервер всё, что осталось во временной папке после команды:
+// файлы состояния, folder.jpg, playlist.json, CUE — и удаляет временную папку
+func (d *webdavDestination) Flush() error {
+	var files []string
+	err := filepath.WalkDir(d.root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range files {
+		if err := d.Store(p); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(d.root)
+}
+
+// Discard удаляет временную папку, не выгружая файлы на сервер. После успешного Flush
+// ничего не делает
+func (d *webdavDestination) Discard() {
+	if err := os.RemoveAll(d.root); err != nil {
+		log.Printf("Предупреждение: не удалось удалить временную папку %s: %v\n", d.root, err)
+	}
+}
+
+// exportLockFileName — имя файла блокировки папки назначения на время запуска
+const exportLockFileName = ".export-state.lock"
+
+// exportLock представляет блокировку папки назначения: пока файл существует, другие
+// запуски (в том числе с других компьютеров через общую папку) с ней не работают
+type exportLock struct {
+	Host      string `json:"host"`
+	PID       int    `json:"pid"`
+	StartedAt string `json:"startedAt"`
+
+	path     string
+	remote   *webdavDestination // Блокировка на сервере WebDAV; nil — файл в локальной папке
+	released sync.Once          // Блокировка снимается один раз, даже если Release вызван повторно
+}
+
+// acquireExportLock создаёт файл блокировки в папке назначения. Если папка уже
+// заблокирована, возвращает ошибку с данными владельца блокировки. Блокировка,
+// оставшаяся от завершившегося процесса на этом же компьютере, снимается
+// автоматически; чужую можно снять принудительно с breakLock (-break-lock)
+func acquireExportLock(folderName string, breakLock bool) (*exportLock, error) {
+	if err := os.MkdirAll(folderName, 0755); err != nil {
+		return nil, fmt.Errorf("ошибка создания папки: %w", err)
+	}
+
+	host, _ := os.Hostname()
+	lock := &exportLock{
+		Host:      host,
+		PID:       os.Getpid(),
+		StartedAt: time.Now().Format(time.RFC3339),
+		path:      filepath.Join(folderName, exportLockFileName),
+	}
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка формирования JSON: %w", err)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(lock.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = file.Write(data)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lock.path)
+				return nil, fmt.Errorf("ошибка записи файла блокировки: %w", err)
+			}
+			return lock, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("ошибка создания файла блокировки: %w", err)
+		}
+
+		var holder exportLock
+		if data, err := os.ReadFile(lock.path); err == nil {
+			json.Unmarshal(data, &holder)
+		}
+		stale := holder.Host == host && holder.PID > 0 && !processAlive(holder.PID)
+		if !breakLock && !stale {
+			return nil, fmt.Errorf("папка %s уже используется: компьютер %q, процесс %d, запущен %s. Если этот запуск аварийно завершился, удалите %s или запустите с -break-lock",
+				folderName, holder.Host, holder.PID, holder.StartedAt, lock.path)
+		}
+		log.Printf("Предупреждение: снимаем блокировку папки %s (компьютер %q, процесс %d, запущен %s)\n", folderName, holder.Host, holder.PID, holder.StartedAt)
+		if err := os.Remove(lock.path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("ошибка удаления файла блокировки: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("не удалось заблокировать папку %s: файл блокировки создан другим запуском", folderName)
+}
+
+// Release снимает блокировку папки назначения
+func (l *exportLock) Release() {
+	if l == nil {
+		return
+	}
+	l.released.Do(func() {
+		if l.remote != nil {
+			l.remote.releaseLock()
+			return
+		}
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Предупреждение: не удалось снять блокировку %s: %v\n", l.path, err)
+		}
+	})
+}
+
+// acquireLock создаёт на сервере файл блокировки .export-state.lock запросом PUT
+// с If-None-Match: *, который сервер выполняет, только если файла ещё нет. Так два
+// запуска с разных компьютеров не выгружают в одну папку и не затирают файл
+// состояния друг друга. Оставшаяся блокировка снимается так же, как у локальной папки
+func (d *webdavDestination) acquireLock(breakLock bool) (*exportLock, error) {
+	host, _ := os.Hostname()
+	lock := &exportLock{
+		Host:      host,
+		PID:       os.Getpid(),
+		StartedAt: time.Now().Format(time.RFC3339),
+		path:      d.remoteURL(exportLockFileName),
+		remote:    d,
+	}
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка формирования JSON: %w", err)
+	}
+	if resp, err := d.do("MKCOL", "", nil, 0); err == nil {
+		resp.Body.Close()
+	}
+
+	header := http.Header{"If-None-Match": {"*"}}
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, err := d.doWithHeader("PUT", exportLockFileName, bytes.NewReader(data), int64(len(data)), header)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания файла блокировки: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return lock, nil
+		}
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			return nil, fmt.Errorf("ошибка создания файла блокировки: WebDAV: PUT %s: статус %d", exportLockFileName, resp.StatusCode)
+		}
+
+		var holder exportLock
+		if resp, err := d.do("GET", exportLockFileName, nil, 0); err == nil {
+			if resp.StatusCode == http.StatusOK {
+				json.NewDecoder(resp.Body).Decode(&holder)
+			}
+			resp.Body.Close()
+		}
+		stale := holder.Host == host && holder.PID > 0 && !processAlive(holder.PID)
+		if !breakLock && !stale {
+			return nil, fmt.Errorf("папка %s уже используется: компьютер %q, процесс %d, запущен %s. Если этот запуск аварийно завершился, удалите %s на сервере или запустите с -break-lock",
+				d, holder.Host, holder.PID, holder.StartedAt, exportLockFileName)
+		}
+		log.Printf("Предупреждение: снимаем блокировку папки %s (компьютер %q, процесс %d, запущен %s)\n", d, holder.Host, holder.PID, holder.StartedAt)
+		if err := d.deleteLock(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("не удалось заблокировать папку %s: файл блокировки создан другим запуском", d)
+}
+
+// deleteLock удаляет файл блокировки на сервере
+func (d *webdavDestination) deleteLock() error {
+	resp, err := d.do("DELETE", exportLockFileName, nil, 0)
+	if err != nil {
+		return fmt.Errorf("ошибка удаления файла блокировки: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		return fmt.Errorf("ошибка удаления файла блокировки: WebDAV: DELETE %s: статус %d", exportLockFileName, resp.StatusCode)
+	}
+	return nil
+}
+
+// releaseLock снимает блокировку на сервере
+func (d *webdavDestination) releaseLock() {
+	if err := d.deleteLock(); err != nil {
+		log.Printf("Предупреждение: не удалось снять блокировку %s: %v\n", d.remoteURL(exportLockFileName), err)
+	}
+}
+
+// processAlive сообщает, работает ли процесс с этим PID на текущем компьютере
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// В Windows FindProcess уже проверяет, что процесс существует, а сигналы не поддерживаются
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
+
+// fileNameRegistry отслеживает, какому треку принадлежит каждое имя файла в папке
+type fileNameRegistry struct {
+	owners map[string]string // Имя файла в нижнем регистре -> ID трека
+	byID   map[string]string // ID трека -> закреплённое имя файла
+}
+
+// newFileNameRegistry создает реестр имён, заполненный именами из файла состояния
+func newFileNameRegistry(state *ExportState) *fileNameRegistry {
+	r := &fileNameRegistry{
+		owners: make(map[string]string),
+		byID:   make(map[string]string),
+	}
+	for id, entry := range state.Tracks {
+		if entry.File != "" {
+			r.owners[strings.ToLower(entry.File)] = id
+			r.byID[id] = entry.File
+		}
+	}
+	return r
+}
+
+// Claim закрепляет имя файла за треком. Если имя уже занято другим треком, применяется
+// стратегия: skip — трек пропускается (ok=false), overwrite — файл перезаписывается
+// (overwrite=true), suffix — к имени добавляется " (2)", " (3)" и т.д.
+func (r *fileNameRegistry) Claim(trackID string, fileName string, strategy string) (name string, overwrite bool, ok bool) {
+	// Для стабильности между запусками используем имя, уже закреплённое за треком,
+	// если оно по-прежнему соответствует раскладке (см. reusableFileName)
+	if prev, found := r.byID[trackID]; found && r.owners[strings.ToLower(prev)] == trackID && reusableFileName(prev, fileName) {
+		return prev, false, true
+	}
+
+	owner, taken := r.owners[strings.ToLower(fileName)]
+	if !taken || owner == trackID {
+		r.claim(trackID, fileName)
+		return fileName, false, true
+	}
+
+	switch strategy {
+	case collisionSkip:
+		return "", false, false
+	case collisionOverwrite:
+		r.claim(trackID, fileName)
+		return fileName, true, true
+	}
+
+	ext := filepath.Ext(fileName)
+	base := strings.TrimSuffix(fileName, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if owner, taken := r.owners[strings.ToLower(candidate)]; !taken || owner == trackID {
+			r.claim(trackID, candidate)
+			return candidate, false, true
+		}
+	}
+}
+
+// reusableFileName сообщает, можно ли оставить треку имя prev из прошлого запуска при
+// имени wanted по текущим флагам: prev должно совпадать с wanted или быть его вариантом
+// с суффиксом " (n)". Расширение может отличаться: файл мог быть переименован под
+// фактический формат (-extension-mismatch=rename)
+func reusableFileName(prev string, wanted string) bool {
+	prevBase := strings.TrimSuffix(prev, filepath.Ext(prev))
+	wantedBase := strings.TrimSuffix(wanted, filepath.Ext(wanted))
+	if prevBase == wantedBase {
+		return true
+	}
+	suffix, found := strings.CutPrefix(prevBase, wantedBase+" (")
+	if !found || !strings.HasSuffix(suffix, ")") {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(suffix, ")"))
+	return err == nil && n >= 2
+}
+
+// release освобождает имя, закреплённое за треком в прошлом запуске, и возвращает его
+func (r *fileNameRegistry) release(trackID string) string {
+	prev, found := r.byID[trackID]
+	if !found {
+		return ""
+	}
+	if r.owners[strings.ToLower(prev)] == trackID {
+		delete(r.owners, strings.ToLower(prev))
+	}
+	delete(r.byID, trackID)
+	return prev
+}
+
+// trackFilePlan — имя файла, закреплённое за треком до начала скачивания
+type trackFilePlan struct {
+	artistStr string // Исполнители для вывода и имени файла
+	wanted    string // Имя по раскладке, до разрешения совпадений
+	fileName  string // Закреплённое имя относительно папки назначения
+	previous  string // Имя из прошлого запуска, которое больше не соответствует раскладке: файл переименовывается
+	overwrite bool   // Имя занято другим треком, и файл будет перезаписан (-on-collision=overwrite)
+	ok        bool   // false — трек пропускается: имя занято (-on-collision=skip)
+}
+
+// planTrackFiles закрепляет имена файлов за треками по порядку: строит путь по раскладке,
+// добавляет позицию для -prepend-index и разрешает совпадения согласно -on-collision.
+// Имена из прошлых запусков, которые больше не соответствуют раскладке (сдвинулась
+// позиция, сменились -layout или -prepend-index), сначала освобождаются, чтобы их могли
+// занять другие треки, а в плане запоминаются для переименования файлов
+func planTrackFiles(tracks []TrackShort, fileNames *fileNameRegistry, opts DownloadOptions) []trackFilePlan {
+	plans := make([]trackFilePlan, len(tracks))
+	for i, trackShort := range tracks {
+		track := trackShort.Track
+		artistStr := track.DisplayArtists(opts.MaxArtists)
+
+		// Формируем путь к файлу относительно папки назначения согласно раскладке
+		wanted := trackRelativePath(track, artistStr, opts.Layout, opts.NameTemplate, opts.MaxTitleLength)
+		if opts.PrependIndex {
+			position, total := i+1, len(tracks)
+			if opts.positions != nil {
+				position, total = opts.positions[track.TrackID()], len(opts.positions)
+			}
+			wanted = prependIndex(wanted, position, total)
+		}
+		plans[i] = trackFilePlan{artistStr: artistStr, wanted: wanted}
+		if prev, found := fileNames.byID[track.TrackID()]; found && !reusableFileName(prev, wanted) {
+			plans[i].previous = fileNames.release(track.TrackID())
+		}
+	}
+
+	for i, trackShort := range tracks {
+		// Разрешаем совпадение имени с файлом другого трека согласно -on-collision
+		plan := &plans[i]
+		plan.fileName, plan.overwrite, plan.ok = fileNames.Claim(trackShort.Track.TrackID(), plan.wanted, opts.OnCollision)
+		if !plan.ok || plan.fileName == plan.previous {
+			plan.previous = ""
+		}
+	}
+	return plans
+}
+
+// renamePlannedFiles переименовывает скачанные в прошлых запусках файлы, имена которых
+// больше не соответствуют раскладке, в имена из плана и записывает новые имена в состояние.
+// Файлы переименовываются в два шага, через временные имена, чтобы треки могли
+// поменяться именами. Переносятся только файлы треков со статусом done, лежащие в
+// локальной папке: остальные треки скачиваются под новым именем как обычно
+func renamePlannedFiles(folderName string, tracks []TrackShort, plans []trackFilePlan, state *ExportState) {
+	type move struct {
+		trackID  string
+		from, to string // Имена относительно folderName
+		tmp      string // Полный временный путь
+	}
+	var moves []move
+	for i, plan := range plans {
+		if plan.previous == "" {
+			continue
+		}
+		trackID := tracks[i].Track.TrackID()
+		entry, known := state.Tracks[trackID]
+		if !known || entry.Status != trackStateDone {
+			continue
+		}
+		from := filepath.Join(folderName, plan.previous)
+		if info, err := os.Lstat(from); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		// Расширение файла сохраняется: оно могло быть исправлено под фактический формат
+		to := strings.TrimSuffix(plan.fileName, filepath.Ext(plan.fileName)) + filepath.Ext(plan.previous)
+		if _, err := os.Lstat(filepath.Join(folderName, to)); err == nil && !strings.EqualFold(to, plan.previous) {
+			log.Printf("Предупреждение: %s не переименован в %s: файл с таким именем уже есть\n", plan.previous, to)
+			continue
+		}
+		tmp := from + "." + sanitizeFileName(trackID) + ".rename.tmp"
+		if err := os.Rename(from, tmp); err != nil {
+			log.Printf("Предупреждение: не удалось переименовать %s: %v\n", plan.previous, err)
+			continue
+		}
+		moves = append(moves, move{trackID: trackID, from: plan.previous, to: to, tmp: tmp})
+	}
+
+	for _, m := range moves {
+		target := filepath.Join(folderName, m.to)
+		err := os.MkdirAll(filepath.Dir(target), 0755)
+		if err == nil {
+			err = os.Rename(m.tmp, target)
+		}
+		if err != nil {
+			log.Printf("Предупреждение: не удалось переименовать %s в %s: %v\n", m.from, m.to, err)
+			if err := os.Rename(m.tmp, filepath.Join(folderName, m.from)); err != nil {
+				log.Printf("Предупреждение: файл %s остался под временным именем %s: %v\n", m.from, m.tmp, err)
+			}
+			continue
+		}
+		log.Printf("Переименован: %s → %s\n", m.from, m.to)
+		state.Mark(m.trackID, trackStateDone, m.to, nil)
 	}
+}
 
-	var response struct {
-		Result struct {
-			Volumes [][]Track `json:"volumes"`
-		} `json:"result"`
+// claim записывает владельца имени файла
+func (r *fileNameRegistry) claim(trackID string, fileName string) {
+	r.owners[strings.ToLower(fileName)] = trackID
+	r.byID[trackID] = fileName
+}
+
+// maxMP3Bitrate — максимальный битрейт MP3 в Яндекс.Музыке, с ним сравниваются треки,
+// если битрейт не запрошен явно через -bitrate
+const maxMP3Bitrate = 320
+
+// BitrateRecord представляет фактический битрейт скачанного трека
+type BitrateRecord struct {
+	TrackID string `json:"trackId"`
+	Title   string `json:"title"`
+	Artist  string `json:"artist"`
+	File    string `json:"file"`
+	Codec   string `json:"codec"`
+	Bitrate int    `json:"bitrate"`
+}
+
+// BitrateReport представляет отчёт о битрейтах скачанных треков
+type BitrateReport struct {
+	Requested int             `json:"requested"`      // Запрошенный битрейт
+	Histogram map[int]int     `json:"histogram"`      // Количество треков по битрейту
+	Below     []BitrateRecord `json:"belowRequested"` // Треки с битрейтом ниже запрошенного
+}
+
+// newBitrateReport строит отчёт о битрейтах; requested=0 означает максимальный битрейт MP3
+func newBitrateReport(records []BitrateRecord, requested int) *BitrateReport {
+	if requested <= 0 {
+		requested = maxMP3Bitrate
 	}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	report := &BitrateReport{
+		Requested: requested,
+		Histogram: make(map[int]int),
+		Below:     []BitrateRecord{},
+	}
+	for _, record := range records {
+		report.Histogram[record.Bitrate]++
+		if record.Bitrate < requested {
+			report.Below = append(report.Below, record)
+		}
 	}
+	return report
+}
 
-	var tracks []Track
-	for _, volume := range response.Result.Volumes {
-		tracks = append(tracks, volume...)
+// Print выводит гистограмму битрейтов и треки ниже запрошенного качества
+func (r *BitrateReport) Print() {
+	bitrates := make([]int, 0, len(r.Histogram))
+	for bitrate := range r.Histogram {
+		bitrates = append(bitrates, bitrate)
 	}
+	sort.Sort(sort.Reverse(sort.IntSlice(bitrates)))
 
-	return tracks, nil
+	fmt.Printf("\nБитрейты скачанных треков:\n")
+	for _, bitrate := range bitrates {
+		fmt.Printf("  %d кбит/с: %d\n", bitrate, r.Histogram[bitrate])
+	}
+	if len(r.Below) > 0 {
+		fmt.Printf("Ниже %d кбит/с: %d\n", r.Requested, len(r.Below))
+		for _, record := range r.Below {
+			fmt.Printf("  %d кбит/с\t%s — %s\t%s\n", record.Bitrate, record.Title, record.Artist, record.File)
+		}
+	}
 }
 
-// GetPlaylistTracks получает список треков плейлиста по ID
-func (c *YandexMusicClient) GetPlaylistTracks(playlistID string) ([]TrackShort, error) {
-	// Получаем userId
-	account, err := c.GetAccountStatus()
+// Save записывает отчёт в JSON-файл
+func (r *BitrateReport) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
 	if err != nil {
-		return nil, fmt.Errorf("ошибка при получении userId: %w", err)
+		return fmt.Errorf("ошибка формирования JSON: %w", err)
 	}
-	userID := account.Result.Account.GetUserID()
-	if userID == "" {
-		return nil, fmt.Errorf("userId пользователя пустой")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("ошибка записи файла %s: %w", path, err)
 	}
+	return nil
+}
 
-	// Парсим playlistID - может быть kind (число) или UUID
-	var kind int
-	if k, err := strconv.Atoi(playlistID); err == nil {
-		kind = k
-	} else {
-		// Если не число, ищем плейлист по UUID
-		playlists, err := c.GetUserPlaylists(userID)
-		if err != nil {
-			return nil, fmt.Errorf("ошибка при получении списка плейлистов: %w", err)
-		}
-		found := false
-		for _, p := range playlists {
-			if p.PlaylistUuid == playlistID || p.PlaylistID == playlistID {
-				kind = p.Kind
-				found = true
-				break
-			}
-		}
-		if !found {
-			return nil, fmt.Errorf("плейлист с ID %s не найден", playlistID)
-		}
+// keyValueFlag представляет повторяемый флаг вида ключ=значение (-query, -api-header, -download-header)
+type keyValueFlag map[string]string
+
+// String возвращает значение флага в виде строки
+func (q keyValueFlag) String() string {
+	pairs := make([]string, 0, len(q))
+	for key, value := range q {
+		pairs = append(pairs, key+"="+value)
 	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
 
-	// Получаем плейлист по kind
-	url := baseURL + fmt.Sprintf(userPlaylistPath, userID, kind)
-	resp, err := c.makeRequest("GET", url)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка при получении плейлиста: %w", err)
+// Set добавляет пару ключ=значение
+func (q keyValueFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("ожидается ключ=значение, получено %q", value)
 	}
-	defer resp.Body.Close()
+	q[key] = val
+	return nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+// headerFlag представляет повторяемый флаг -header вида "Имя: значение", как в curl
+type headerFlag map[string]string
+
+// String возвращает значение флага в виде строки
+func (h headerFlag) String() string {
+	pairs := make([]string, 0, len(h))
+	for key, value := range h {
+		pairs = append(pairs, key+": "+value)
 	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
 
-	var response struct {
-		Result Playlist `json:"result"`
+// Set добавляет заголовок. Authorization через -header не принимается, чтобы общий
+// заголовок не подменил токен незаметно: токен задаётся через -token-file, -keyring или .env
+func (h headerFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("ожидается \"Имя: значение\", получено %q", value)
 	}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("ошибка декодирования ответа: %w", err)
+	key = http.CanonicalHeaderKey(key)
+	if key == "Authorization" {
+		return fmt.Errorf("заголовок Authorization нельзя задать через -header: токен задаётся через -token-file, -keyring или ACCESS_TOKEN")
 	}
+	h[key] = strings.TrimSpace(val)
+	return nil
+}
 
-	return response.Result.Tracks, nil
+// orderedCollector потокобезопасно собирает результаты горутин по исходному индексу
+// и отдаёт их строго по порядку индексов, независимо от порядка завершения
+type orderedCollector[T any] struct {
+	mu    sync.Mutex
+	items []T
+	ready []bool
+	next  int     // Индекс первого ещё не переданного в emit результата
+	emit  func(T) // Вызывается по порядку, как только готов непрерывный префикс результатов
 }
 
-// GetTrackDownloadURL получает ссылку на MP3 для скачивания трека
-func (c *YandexMusicClient) GetTrackDownloadURL(trackID string) (string, error) {
-	url := baseURL + fmt.Sprintf(trackDownloadInfoPath, trackID)
-	resp, err := c.makeRequest("GET", url)
-	if err != nil {
-		return "", err
+// newOrderedCollector создает сборщик на n результатов; emit может быть nil
+func newOrderedCollector[T any](n int, emit func(T)) *orderedCollector[T] {
+	return &orderedCollector[T]{
+		items: make([]T, n),
+		ready: make([]bool, n),
+		emit:  emit,
 	}
-	defer resp.Body.Close()
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("ошибка чтения ответа: %w", err)
-	}
+// Put сохраняет результат с индексом i и передаёт в emit все готовые по порядку результаты
+func (c *orderedCollector[T]) Put(i int, item T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	var response struct {
-		Result []struct {
-			Codec           string `json:"codec"`
-			Bitrate         int    `json:"bitrate"`
-			Gain            bool   `json:"gain"`
-			Preview         bool   `json:"preview"`
-			DownloadInfoURL string `json:"downloadInfoUrl"`
-			Direct          bool   `json:"direct"`
-			Barcode         string `json:"barcode"`
-		} `json:"result"`
-	}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return "", fmt.Errorf("ошибка декодирования ответа: %w", err)
+	c.items[i] = item
+	c.ready[i] = true
+	for c.next < len(c.items) && c.ready[c.next] {
+		if c.emit != nil {
+			c.emit(c.items[c.next])
+		}
+		c.next++
 	}
+}
 
-	if len(response.Result) == 0 {
-		return "", fmt.Errorf("нет доступных ссылок для скачивания")
+// Items возвращает все полученные результаты в исходном порядке
+func (c *orderedCollector[T]) Items() []T {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	items := make([]T, 0, len(c.items))
+	for i, item := range c.items {
+		if c.ready[i] {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	// Берем первую доступную ссылку (обычно лучшего качества)
-	downloadInfoURL := response.Result[0].DownloadInfoURL
-	if downloadInfoURL == "" {
-		return "", fmt.Errorf("ссылка на скачивание не найдена")
+// forEachConcurrently вызывает fn для индексов 0..n-1 не более чем в workers горутинах
+func forEachConcurrently(n int, workers int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
 	}
+	close(indexes)
+	wg.Wait()
+}
 
-	// Получаем прямую ссылку на MP3 с авторизацией
-	downloadReq, err := http.NewRequest("GET", downloadInfoURL, nil)
+// readTokenFile читает токен из файла (например, секрета Docker), отбрасывая пробелы
+// и переводы строк по краям. Отсутствующий или пустой файл — ошибка
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return "", fmt.Errorf("ошибка создания запроса: %w", err)
+		return "", fmt.Errorf("не удалось прочитать файл токена: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("файл токена %s пуст", path)
 	}
-	c.setHeaders(downloadReq)
+	return token, nil
+}
 
-	downloadResp, err := c.client.Do(downloadReq)
-	if err != nil {
-		return "", fmt.Errorf("ошибка получения ссылки на скачивание: %w", err)
+// envToken возвращает токен из окружения: из файла ACCESS_TOKEN_FILE, если переменная
+// задана, иначе из ACCESS_TOKEN. Пустая строка без ошибки — токен не задан
+func envToken() (string, error) {
+	if path := os.Getenv("ACCESS_TOKEN_FILE"); path != "" {
+		token, err := readTokenFile(path)
+		if err != nil {
+			return "", fmt.Errorf("ACCESS_TOKEN_FILE: %w", err)
+		}
+		return token, nil
 	}
-	defer downloadResp.Body.Close()
+	return os.Getenv("ACCESS_TOKEN"), nil
+}
 
-	downloadBody, err := io.ReadAll(downloadResp.Body)
+// reloadEnvToken перечитывает .env и возвращает токен из ACCESS_TOKEN_FILE или ACCESS_TOKEN;
+// используется клиентом, когда текущий токен перестал приниматься API
+func reloadEnvToken() (string, error) {
+	if err := godotenv.Overload(); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("не удалось перечитать .env файл: %w", err)
+	}
+	token, err := envToken()
 	if err != nil {
-		return "", fmt.Errorf("ошибка чтения ответа: %w", err)
+		return "", err
+	}
+	if token == "" {
+		return "", fmt.Errorf("ACCESS_TOKEN не найден в .env файле или переменных окружения")
 	}
+	return token, nil
+}
 
-	var downloadInfo struct {
-		XMLName xml.Name `xml:"download-info"`
-		Host    string   `xml:"host"`
-		Path    string   `xml:"path"`
-		S       string   `xml:"s"`
-		Ts      string   `xml:"ts"`
+// keyringToken читает токен из системного хранилища учётных данных; если записи нет, возвращает пустую строку
+func keyringToken() (string, error) {
+	token, err := keyring.Get(keyringService, keyringUser)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", nil
 	}
-	if err := xml.Unmarshal(downloadBody, &downloadInfo); err != nil {
-		return "", fmt.Errorf("ошибка декодирования информации о скачивании: %w", err)
+	if err != nil {
+		return "", err
 	}
-
-	// Формируем прямую ссылку на MP3
-	mp3URL := fmt.Sprintf("https://%s/get-mp3/%s/%s/%s", downloadInfo.Host, downloadInfo.S, downloadInfo.Ts, downloadInfo.Path)
-	return mp3URL, nil
+	return strings.TrimSpace(token), nil
 }
 
-func main() {
-	// Парсим аргументы командной строки
-	var (
-		command    = flag.String("cmd", "", "Команда: playlist, likes, list-playlists, download-playlist")
-		playlistID = flag.String("id", "", "ID плейлиста для команды playlist или download-playlist")
-		outputFmt  = flag.String("out", "", "Формат вывода: json (по умолчанию - текст)")
-		folderName = flag.String("to", "", "Папка для сохранения (для команды download-playlist)")
-	)
-
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Использование: %s [опции]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Команды:\n")
-		fmt.Fprintf(os.Stderr, "  -cmd=playlist -id=ID [-out=json] Просмотреть список всех песен плейлиста с ссылками на MP3\n")
-		fmt.Fprintf(os.Stderr, "  -cmd=likes [-out=json]           Просмотреть список избранного с ссылками на MP3\n")
-		fmt.Fprintf(os.Stderr, "  -cmd=list-playlists [-out=json]   Просмотреть список всех плейлистов\n")
-		fmt.Fprintf(os.Stderr, "  -cmd=download-playlist -id=ID -to=folder Скачать все песни плейлиста в папку\n\n")
-		fmt.Fprintf(os.Stderr, "Примеры:\n")
-		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=playlist -id=12345\n")
-		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=playlist -id=12345 -out=json\n")
-		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=likes\n")
-		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=list-playlists\n")
-		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=list-playlists -out=json\n")
-		fmt.Fprintf(os.Stderr, "  yandex-music-exporter -cmd=download-playlist -id=12345 -to=./music\n\n")
-		flag.PrintDefaults()
+// reloadKeyringToken заново читает токен из хранилища учётных данных,
+// а если записи там нет — из .env файла и переменных окружения
+func reloadKeyringToken() (string, error) {
+	token, err := keyringToken()
+	if err != nil {
+		return "", fmt.Errorf("не удалось прочитать токен из хранилища учётных данных: %w", err)
 	}
-
-	flag.Parse()
-
-	// Загрузка переменных окружения из .env файла
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Предупреждение: не удалось загрузить .env файл: %v", err)
+	if token != "" {
+		return token, nil
 	}
+	return reloadEnvToken()
+}
 
-	// Получаем токен доступа
-	token := os.Getenv("ACCESS_TOKEN")
-	if token == "" {
-		log.Fatal("Ошибка: ACCESS_TOKEN не найден в .env файле или переменных окружения")
+// handleLogin обрабатывает команду login: читает токен из stdin и сохраняет его
+// в системное хранилище учётных данных, чтобы не держать его в .env и истории команд
+func handleLogin() {
+	if isTerminal(os.Stdin) {
+		fmt.Fprint(os.Stderr, "Введите токен доступа: ")
 	}
-
-	// Создаем клиент
-	client := NewClient(token)
-
-	// Обрабатываем команды
-	if *command == "" {
-		flag.Usage()
-		log.Fatal("Ошибка: необходимо указать команду через флаг -cmd")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fatal("Ошибка чтения токена: %v\n", err)
+	}
+	token := strings.TrimSpace(line)
+	if token == "" {
+		log.Print("Ошибка: пустой токен")
+		exit(exitAuth)
 	}
 
-	switch *command {
-	case "playlist":
-		if *playlistID == "" {
-			log.Fatal("Ошибка: для команды 'playlist' необходимо указать ID плейлиста через флаг -id")
-		}
-		handlePlaylistTracks(client, *playlistID, *outputFmt)
-	case "likes", "favorites":
-		handleLikes(client, *outputFmt)
-	case "list-playlists":
-		handleListPlaylists(client, *outputFmt)
-	case "download-playlist":
-		if *playlistID == "" {
-			log.Fatal("Ошибка: для команды 'download-playlist' необходимо указать ID плейлиста через флаг -id")
-		}
-		if *folderName == "" {
-			log.Fatal("Ошибка: для команды 'download-playlist' необходимо указать папку через флаг -to")
-		}
-		handleDownloadPlaylist(client, *playlistID, *folderName)
-	case "download-likes":
-		if *folderName == "" {
-			log.Fatal("Ошибка: для команды 'download-likes' необходимо указать папку через флаг -to")
-		}
-		handleDownloadLikes(client, *folderName)
-	default:
-		log.Fatalf("Неизвестная команда: %s. Доступные команды: playlist, likes, list-playlists, download-playlist, download-likes", *command)
+	if err := keyring.Set(keyringService, keyringUser, token); err != nil {
+		fatal("Ошибка сохранения токена в хранилище учётных данных: %v\n", err)
 	}
+	fmt.Println("Токен сохранён в системном хранилище учётных данных. Запускайте команды с флагом -keyring")
 }
 
-// handlePlaylistTracks обрабатывает команду playlist
-func handlePlaylistTracks(client *YandexMusicClient, playlistID string, outputFmt string) {
-	tracks, err := client.GetPlaylistTracks(playlistID)
-	if err != nil {
-		log.Fatalf("Ошибка при получении треков плейлиста: %v\n", err)
-	}
+// formatTrackDuration форматирует длительность трека в миллисекундах как м:сс
+func formatTrackDuration(durationMs int) string {
+	seconds := durationMs / 1000
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
 
-	// Подготавливаем данные для вывода
-	type TrackOutput struct {
-		Title  string `json:"title"`
-		Artist string `json:"artist"`
-		Link   string `json:"link"`
+// parseTrackDuration разбирает длительность в формате м:сс, ч:мм:сс или в секундах.
+// Пустая строка означает отсутствие ограничения
+func parseTrackDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
 	}
 
-	var tracksOutput []TrackOutput
-	for _, trackShort := range tracks {
-		track := trackShort.Track
-		artistNames := []string{}
-		for _, artist := range track.Artists {
-			artistNames = append(artistNames, artist.Name)
+	var total int
+	for _, part := range strings.Split(value, ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("ожидается м:сс или число секунд, получено %q", value)
 		}
-		artistStr := strings.Join(artistNames, ", ")
-		if artistStr == "" {
-			artistStr = "Неизвестный исполнитель"
-		}
-
-		trackIDStr := fmt.Sprintf("%v", track.ID)
+		total = total*60 + n
+	}
+	return time.Duration(total) * time.Second, nil
+}
 
-		// Получаем ссылку на MP3
-		mp3URL, err := client.GetTrackDownloadURL(trackIDStr)
-		if err != nil {
-			log.Printf("Ошибка получения ссылки для трека %s: %v\n", track.Title, err)
-			mp3URL = ""
-		}
+// nameTemplatePlaceholders — плейсхолдеры -name-template. {date} и {datetime}
+// подставляются один раз при запуске (см. expandDatePlaceholders), остальные — по треку
+var nameTemplatePlaceholders = map[string]bool{
+	"{artist}": true, "{title}": true, "{album}": true, "{year}": true,
+	"{track}": true, "{id}": true, "{date}": true, "{datetime}": true,
+}
 
-		trackName := fmt.Sprintf("%s — %s", track.Title, artistStr)
-		tracksOutput = append(tracksOutput, TrackOutput{
-			Title:  track.Title,
-			Artist: artistStr,
-			Link:   mp3URL,
-		})
+// nameTemplatePlaceholder находит в шаблоне имени плейсхолдеры вида {имя}
+var nameTemplatePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
 
-		// Вывод в зависимости от формата
-		if outputFmt == "json" {
-			// JSON вывод будет после цикла
-		} else {
-			// Текстовый формат: {trackname} \t {link}
-			fmt.Printf("%s\t%s\n", trackName, mp3URL)
+// parseNameTemplate проверяет шаблон -name-template: известны ли все плейсхолдеры и
+// отличает ли шаблон треки друг от друга ({title} или {id}). Папки в шаблоне не
+// задаются: их определяет -layout
+func parseNameTemplate(template string) error {
+	for _, placeholder := range nameTemplatePlaceholder.FindAllString(template, -1) {
+		if !nameTemplatePlaceholders[placeholder] {
+			return fmt.Errorf("неизвестный плейсхолдер %s, доступные: {artist}, {title}, {album}, {year}, {track}, {id}, {date}, {datetime}", placeholder)
 		}
 	}
+	if strings.ContainsAny(template, `/\`) {
+		return fmt.Errorf("шаблон задаёт только имя файла, папки определяет -layout")
+	}
+	if !strings.Contains(template, "{title}") && !strings.Contains(template, "{id}") {
+		return fmt.Errorf("шаблон должен содержать {title} или {id}, иначе у всех треков будет одно имя")
+	}
+	return nil
+}
 
-	// JSON вывод
-	if outputFmt == "json" {
-		jsonData, err := json.MarshalIndent(tracksOutput, "", "  ")
-		if err != nil {
-			log.Fatalf("Ошибка формирования JSON: %v\n", err)
+// expandNameTemplate подставляет в шаблон имени сведения о треке и добавляет .mp3.
+// Значения очищаются от недопустимых в имени символов
+func expandNameTemplate(template string, track Track, artistStr string, title string) string {
+	album := "Без альбома"
+	trackCount := 0
+	if len(track.Albums) > 0 {
+		if track.Albums[0].Title != "" {
+			album = track.Albums[0].Title
 		}
-		fmt.Println(string(jsonData))
+		trackCount = track.Albums[0].TrackCount
 	}
+	year := ""
+	if track.Year > 0 {
+		year = strconv.Itoa(track.Year)
+	}
+	replacer := strings.NewReplacer(
+		"{artist}", artistStr,
+		"{title}", title,
+		"{album}", album,
+		"{year}", year,
+		"{track}", albumTrackNumber(track.TrackNumber, trackCount),
+		"{id}", track.TrackID(),
+	)
+	return sanitizeFileName(replacer.Replace(template) + ".mp3")
 }
 
-// handleLikes обрабатывает команду likes
-func handleLikes(client *YandexMusicClient, outputFmt string) {
-	likedTracks, err := client.GetLikedTracks("")
-	if err != nil {
-		log.Fatalf("Ошибка при получении избранных треков: %v\n", err)
+// albumTrackNumber возвращает номер трека в альбоме с нулями: две цифры, а для альбомов
+// от 100 треков — по числу цифр в количестве треков. Неизвестный номер — нули
+func albumTrackNumber(number int, trackCount int) string {
+	width := 2
+	if trackCount >= 100 {
+		width = len(strconv.Itoa(trackCount))
 	}
+	return fmt.Sprintf("%0*d", width, number)
+}
 
-	// Подготавливаем данные для вывода
-	type TrackOutput struct {
-		Title  string `json:"title"`
-		Artist string `json:"artist"`
-		Link   string `json:"link"`
+// trackRelativePath формирует путь к файлу трека относительно папки назначения.
+// Название трека в имени файла укорачивается до maxTitleLength символов (0 — без ограничения).
+// flat: {исполнитель}-{название}.mp3; media-server: {исполнитель}/{альбом}/{NN} - {название}.mp3,
+// где исполнитель — первый исполнитель трека, а NN — номер трека в альбоме с нулями.
+// Непустой nameTemplate (-name-template) задаёт имя файла вместо имени по раскладке
+func trackRelativePath(track Track, artistStr string, layout string, nameTemplate string, maxTitleLength int) string {
+	title := truncateTitle(track.Title, maxTitleLength)
+	if layout != layoutMediaServer {
+		if nameTemplate != "" {
+			return expandNameTemplate(nameTemplate, track, artistStr, title)
+		}
+		return sanitizeFileName(fmt.Sprintf("%s-%s.mp3", artistStr, title))
 	}
 
-	var tracksOutput []TrackOutput
-	for _, trackShort := range likedTracks {
-		artistNames := []string{}
-		for _, artist := range trackShort.Track.Artists {
-			artistNames = append(artistNames, artist.Name)
-		}
-		artistStr := strings.Join(artistNames, ", ")
-		if artistStr == "" {
-			artistStr = "Неизвестный исполнитель"
+	albumArtist := "Неизвестный исполнитель"
+	if len(track.Artists) > 0 && track.Artists[0].Name != "" {
+		albumArtist = track.Artists[0].Name
+	}
+	albumTitle := "Без альбома"
+	trackCount := 0
+	if len(track.Albums) > 0 {
+		if track.Albums[0].Title != "" {
+			albumTitle = track.Albums[0].Title
 		}
+		trackCount = track.Albums[0].TrackCount
+	}
 
-		trackIDStr := fmt.Sprintf("%v", trackShort.Track.ID)
+	fileName := title + ".mp3"
+	switch {
+	case nameTemplate != "":
+		fileName = expandNameTemplate(nameTemplate, track, artistStr, title)
+	case track.TrackNumber > 0:
+		fileName = fmt.Sprintf("%s - %s.mp3", albumTrackNumber(track.TrackNumber, trackCount), title)
+	}
 
-		// Получаем ссылку на MP3
-		mp3URL, err := client.GetTrackDownloadURL(trackIDStr)
-		if err != nil {
-			log.Printf("Ошибка получения ссылки для трека %s: %v\n", trackShort.Track.Title, err)
-			mp3URL = ""
-		}
+	return filepath.Join(sanitizeFileName(albumArtist), sanitizeFileName(albumTitle), sanitizeFileName(fileName))
+}
 
-		trackName := fmt.Sprintf("%s — %s", trackShort.Track.Title, artistStr)
-		tracksOutput = append(tracksOutput, TrackOutput{
-			Title:  trackShort.Track.Title,
-			Artist: artistStr,
-			Link:   mp3URL,
-		})
+// detectAudioExtension определяет формат аудиофайла по первым байтам и возвращает
+// подходящее расширение (.mp3, .aac, .flac, .m4a); пустая строка — формат не распознан
+func detectAudioExtension(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
 
-		// Вывод в зависимости от формата
-		if outputFmt == "json" {
-			// JSON вывод будет после цикла
-		} else {
-			// Текстовый формат: {trackname} \t {link}
-			fmt.Printf("%s\t%s\n", trackName, mp3URL)
-		}
+	header := make([]byte, 12)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
 	}
+	if looksLikeText(header[:n]) {
+		return "", ErrNotAudio
+	}
+	return sniffAudioExtension(header[:n]), nil
+}
 
-	// JSON вывод
-	if outputFmt == "json" {
-		jsonData, err := json.MarshalIndent(tracksOutput, "", "  ")
-		if err != nil {
-			log.Fatalf("Ошибка формирования JSON: %v\n", err)
-		}
-		fmt.Println(string(jsonData))
+// ErrNotAudio возвращается detectAudioExtension, когда вместо аудио скачан текстовый
+// ответ: XML download-info, HTML-страница, JSON или HLS-плейлист
+var ErrNotAudio = errors.New("вместо аудио получен текстовый ответ")
+
+// looksLikeText сообщает, начинаются ли данные как разметка или плейлист, а не как аудио
+func looksLikeText(header []byte) bool {
+	start := bytes.TrimLeft(header, " \t\r\n\xef\xbb\xbf")
+	return bytes.HasPrefix(start, []byte("<")) || bytes.HasPrefix(start, []byte("{")) || bytes.HasPrefix(start, []byte("#EXTM3U"))
+}
+
+// sniffAudioExtension распознаёт формат аудио по сигнатуре в начале данных
+func sniffAudioExtension(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return ".flac"
+	case len(header) >= 8 && string(header[4:8]) == "ftyp":
+		// Контейнер MP4 (AAC в .m4a)
+		return ".m4a"
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return ".mp3"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xF6 == 0xF0:
+		// Кадр ADTS: синхрослово 0xFFF и нулевой слой
+		return ".aac"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		// Кадр MPEG audio: синхрослово 0xFFE
+		return ".mp3"
 	}
+	return ""
 }
 
-// handleListPlaylists обрабатывает команду list-playlists
-func handleListPlaylists(client *YandexMusicClient, outputFmt string) {
-	playlists, err := client.GetUserPlaylists("")
-	if err != nil {
-		log.Fatalf("Ошибка при получении списка плейлистов: %v\n", err)
+// prependIndex добавляет к имени файла позицию трека в списке источника, дополненную
+// нулями до числа цифр в total (не меньше двух): 001 - Исполнитель-Название.mp3.
+// Папки в пути (раскладка media-server) не меняются
+func prependIndex(fileName string, position int, total int) string {
+	width := len(strconv.Itoa(total))
+	if width < 2 {
+		width = 2
 	}
+	dir, base := filepath.Split(fileName)
+	return dir + fmt.Sprintf("%0*d - %s", width, position, base)
+}
 
-	// Подготавливаем данные для вывода
-	type PlaylistOutput struct {
-		Title  string `json:"title"`
-		ID     string `json:"id"`
-		UUID   string `json:"uuid,omitempty"`
-		Kind   int    `json:"kind,omitempty"`
-		Tracks int    `json:"tracks,omitempty"`
+// truncateTitle укорачивает название до maxLength символов (не байт) с многоточием в конце.
+// Если рядом с границей есть пробел, обрезает по нему, чтобы не разрывать слово.
+// maxLength <= 0 означает отсутствие ограничения
+func truncateTitle(title string, maxLength int) string {
+	runes := []rune(title)
+	if maxLength <= 0 || len(runes) <= maxLength {
+		return title
+	}
+	if maxLength == 1 {
+		return "…"
 	}
 
-	var playlistsOutput []PlaylistOutput
-	for _, playlist := range playlists {
-		// Определяем ID (приоритет UUID, затем Kind)
-		playlistID := ""
-		if playlist.PlaylistUuid != "" {
-			playlistID = playlist.PlaylistUuid
-		} else if playlist.Kind != 0 {
-			playlistID = fmt.Sprintf("%d", playlist.Kind)
+	// Оставляем место под многоточие
+	cut := runes[:maxLength-1]
+	// Обрезаем по последнему пробелу, если он в последней трети
+	for i := len(cut) - 1; i >= len(cut)*2/3; i-- {
+		if unicode.IsSpace(cut[i]) {
+			cut = cut[:i]
+			break
 		}
+	}
+	// Убираем висящие пробелы и знаки препинания перед многоточием
+	trimmed := strings.TrimRightFunc(string(cut), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r) && r != ')' && r != ']'
+	})
+	if trimmed == "" {
+		trimmed = string(runes[:maxLength-1])
+	}
+	return trimmed + "…"
+}
 
-		playlistsOutput = append(playlistsOutput, PlaylistOutput{
-			Title:  playlist.Title,
-			ID:     playlistID,
-			UUID:   playlist.PlaylistUuid,
-			Kind:   playlist.Kind,
-			Tracks: playlist.TrackCount,
-		})
+// coverURL формирует абсолютную ссылку на обложку заданного размера (например, 400x400 или orig).
+// Принимает URI с шаблоном вида avatars.yandex.net/get-music-content/.../%%, URI с уже
+// подставленным размером (он заменяется на запрошенный) и URI без схемы или с префиксом //.
+// Это единственное место, где строятся ссылки на обложки
+func coverURL(uri string, size string) string {
+	uri = strings.TrimSpace(uri)
+	if uri == "" {
+		return ""
+	}
 
-		// Вывод в зависимости от формата
-		if outputFmt == "json" {
-			// JSON вывод будет после цикла
-		} else {
-			// Текстовый формат: {title} \t {id}
-			fmt.Printf("%s\t%s\n", playlist.Title, playlistID)
-		}
+	result := uri
+	if strings.Contains(result, "%%") {
+		result = strings.ReplaceAll(result, "%%", size)
+	} else {
+		result = coverSizePattern.ReplaceAllString(result, "/"+size)
 	}
 
-	// JSON вывод
-	if outputFmt == "json" {
-		jsonData, err := json.MarshalIndent(playlistsOutput, "", "  ")
-		if err != nil {
-			log.Fatalf("Ошибка формирования JSON: %v\n", err)
-		}
-		fmt.Println(string(jsonData))
+	if !strings.HasPrefix(result, "http://") && !strings.HasPrefix(result, "https://") {
+		result = "https://" + strings.TrimPrefix(result, "//")
 	}
+	return result
 }
 
-// handleDownloadPlaylist обрабатывает команду download-playlist
-func handleDownloadPlaylist(client *YandexMusicClient, playlistID string, folderName string) {
-	tracks, err := client.GetPlaylistTracks(playlistID)
+// fetchCover скачивает обложку по ссылке и проверяет, что сервер вернул изображение.
+// Ошибку выводит вызывающий код
+func (c *YandexMusicClient) fetchCover(url string) ([]byte, error) {
+	resp, err := c.client.Get(url)
 	if err != nil {
-		log.Fatalf("Ошибка при получении треков плейлиста: %v\n", err)
+		return nil, fmt.Errorf("ошибка выполнения запроса: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ошибка HTTP: статус %d", resp.StatusCode)
 	}
 
-	fmt.Printf("Найдено треков в плейлисте: %d\n", len(tracks))
-	downloadTracks(client, tracks, folderName)
-}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("по ссылке %s вернулось не изображение (Content-Type: %q)", url, contentType)
+	}
 
-// handleDownloadLikes обрабатывает команду download-likes
-func handleDownloadLikes(client *YandexMusicClient, folderName string) {
-	tracks, err := client.GetLikedTracks("")
+	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalf("Ошибка при получении лайкнутых треков: %v\n", err)
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
 	}
+	return data, nil
+}
 
-	fmt.Printf("Найдено лайкнутых треков: %d\n", len(tracks))
-	downloadTracks(client, tracks, folderName)
+// trackAlbumID возвращает ID первого альбома трека или пустую строку, если альбома нет
+func trackAlbumID(track Track) string {
+	if len(track.Albums) == 0 {
+		return ""
+	}
+	return formatID(track.Albums[0].ID)
 }
 
-// downloadTracks скачивает список треков в указанную папку
-func downloadTracks(client *YandexMusicClient, tracks []TrackShort, folderName string) {
-	// Создаем папку, если её нет
-	if err := os.MkdirAll(folderName, 0755); err != nil {
-		log.Fatalf("Ошибка создания папки %s: %v\n", folderName, err)
+// trackCoverURI возвращает URI обложки трека: трека, альтернативный, затем альбома
+func trackCoverURI(track Track) string {
+	if track.CoverUri != "" {
+		return track.CoverUri
+	}
+	if track.OgImage != "" {
+		return track.OgImage
 	}
+	if len(track.Albums) > 0 {
+		return track.Albums[0].CoverUri
+	}
+	return ""
+}
 
-	fmt.Printf("Папка для сохранения: %s\n\n", folderName)
+// Имена файлов с обложкой и описанием плейлиста (-playlist-meta)
+const (
+	playlistCoverFileName = "playlist.jpg"
+	playlistMetaFileName  = "playlist.json"
+)
 
-	downloaded := 0
-	skipped := 0
-	failed := 0
+// PlaylistMeta представляет описание плейлиста в playlist.json
+type PlaylistMeta struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Owner       struct {
+		UserID int64  `json:"uid"`
+		Login  string `json:"login,omitempty"`
+		Name   string `json:"name,omitempty"`
+	} `json:"owner"`
+	Kind       int    `json:"kind"`
+	UUID       string `json:"uuid,omitempty"`
+	Revision   int    `json:"revision"`
+	TrackCount int    `json:"trackCount"`
+	Cover      string `json:"cover,omitempty"` // Ссылка на обложку 1000x1000
+	ExportedAt string `json:"exportedAt"`
+}
 
-	for i, trackShort := range tracks {
-		track := trackShort.Track
-		artistNames := []string{}
-		for _, artist := range track.Artists {
-			artistNames = append(artistNames, artist.Name)
-		}
-		artistStr := strings.Join(artistNames, ", ")
-		if artistStr == "" {
-			artistStr = "Неизвестный исполнитель"
-		}
+// savePlaylistMetaIfRequested сохраняет описание и обложку плейлиста, если задан -playlist-meta.
+// Ошибки не прерывают скачивание треков и выводятся как предупреждения
+func savePlaylistMetaIfRequested(client *YandexMusicClient, folderName string, playlist *Playlist, opts DownloadOptions) {
+	if !opts.PlaylistMeta {
+		return
+	}
+	if err := client.savePlaylistMeta(folderName, playlist); err != nil {
+		log.Printf("Предупреждение: не удалось сохранить описание плейлиста: %v\n", err)
+	}
+}
 
-		// Формируем имя файла: {исполнитель}-{песня}.mp3
-		// Очищаем от недопустимых символов для имени файла
-		fileName := sanitizeFileName(fmt.Sprintf("%s-%s.mp3", artistStr, track.Title))
-		filePath := filepath.Join(folderName, fileName)
+// savePlaylistMeta записывает playlist.json с названием, описанием, владельцем и числом
+// треков плейлиста и скачивает его обложку в playlist.jpg. Оба файла перезаписываются,
+// чтобы отражать текущее состояние плейлиста
+func (c *YandexMusicClient) savePlaylistMeta(folderName string, playlist *Playlist) error {
+	if err := os.MkdirAll(folderName, 0755); err != nil {
+		return fmt.Errorf("ошибка создания папки: %w", err)
+	}
 
-		// Проверяем, существует ли файл
-		if _, err := os.Stat(filePath); err == nil {
-			fmt.Printf("[%d/%d] Пропущено (уже существует): %s — %s\n", i+1, len(tracks), track.Title, artistStr)
-			skipped++
-			continue
-		}
+	meta := PlaylistMeta{
+		Title:       playlist.Title,
+		Description: playlist.Description,
+		Kind:        playlist.Kind,
+		UUID:        playlist.PlaylistUuid,
+		Revision:    playlist.Revision,
+		TrackCount:  playlist.TrackCount,
+		Cover:       coverURL(playlist.CoverURI(), folderCoverSize),
+		ExportedAt:  time.Now().Format(time.RFC3339),
+	}
+	meta.Owner.UserID = playlist.Owner.UserID
+	meta.Owner.Login = playlist.Owner.Login
+	meta.Owner.Name = playlist.Owner.Name
+	if meta.TrackCount == 0 {
+		meta.TrackCount = len(playlist.Tracks)
+	}
 
-		// Получаем ссылку на MP3
-		trackIDStr := fmt.Sprintf("%v", track.ID)
-		mp3URL, err := client.GetTrackDownloadURL(trackIDStr)
-		if err != nil {
-			fmt.Printf("[%d/%d] Ошибка получения ссылки: %s — %s (%v)\n", i+1, len(tracks), track.Title, artistStr, err)
-			failed++
-			continue
-		}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка формирования JSON: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(folderName, playlistMetaFileName), data, 0644); err != nil {
+		return fmt.Errorf("ошибка записи %s: %w", playlistMetaFileName, err)
+	}
 
-		// Скачиваем файл
-		lastProgress := -1.0
-		progressPrefix := fmt.Sprintf("[%d/%d] Скачивание: %s — %s", i+1, len(tracks), track.Title, artistStr)
-		if err := downloadFileWithProgress(mp3URL, filePath, client.token, func(progress float64) {
-			// Обновляем прогресс только если изменился на 0.5% или больше
-			if progress-lastProgress >= 0.5 || progress >= 100.0 {
-				// Используем ANSI escape-код для очистки до конца строки и \r для возврата каретки
-				fmt.Fprintf(os.Stdout, "\r\033[K%s %.1f%%", progressPrefix, progress)
-				os.Stdout.Sync() // Принудительно выводим буфер
-				lastProgress = progress
-			}
-		}); err != nil {
-			// Очищаем строку перед выводом ошибки
-			fmt.Fprintf(os.Stdout, "\r\033[K")
-			fmt.Printf("[%d/%d] ✗ Ошибка скачивания: %s — %s (%v)\n", i+1, len(tracks), track.Title, artistStr, err)
-			failed++
-			continue
-		}
+	if meta.Cover == "" {
+		return nil
+	}
+	cover, err := c.fetchCover(meta.Cover)
+	if err != nil {
+		return fmt.Errorf("ошибка скачивания обложки: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(folderName, playlistCoverFileName), cover, 0644); err != nil {
+		return fmt.Errorf("ошибка записи %s: %w", playlistCoverFileName, err)
+	}
+	return nil
+}
 
-		// Записываем ID3 теги
-		if err := writeID3Tags(filePath, track); err != nil {
-			fmt.Printf("[%d/%d] Предупреждение: не удалось записать ID3 теги для %s — %s (%v)\n", i+1, len(tracks), track.Title, artistStr, err)
-		}
+// saveFolderCover скачивает обложку альбома в folder.jpg, если её ещё нет в папке
+func (c *YandexMusicClient) saveFolderCover(dir string, track Track) error {
+	coverPath := filepath.Join(dir, folderCoverFileName)
+	if _, err := os.Stat(coverPath); err == nil {
+		return nil
+	}
 
-		// Очищаем строку и выводим результат
-		fmt.Fprintf(os.Stdout, "\r\033[K")
-		fmt.Printf("[%d/%d] ✓ Сохранено: %s\n", i+1, len(tracks), fileName)
-		downloaded++
+	url := coverURL(trackCoverURI(track), folderCoverSize)
+	if url == "" {
+		return fmt.Errorf("у трека нет обложки")
 	}
 
-	fmt.Printf("\nГотово!\n")
-	fmt.Printf("Скачано: %d\n", downloaded)
-	fmt.Printf("Пропущено: %d\n", skipped)
-	fmt.Printf("Ошибок: %d\n", failed)
+	data, err := c.fetchCover(url)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(coverPath, data, 0644); err != nil {
+		return fmt.Errorf("ошибка записи файла: %w", err)
+	}
+	return nil
+}
+
+// isTerminal проверяет, подключен ли файл к терминалу
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
 
 // sanitizeFileName очищает имя файла от недопустимых символов
@@ -841,35 +9698,64 @@ func sanitizeFileName(name string) string {
 	for strings.Contains(result, "__") {
 		result = strings.ReplaceAll(result, "__", "_")
 	}
-	return result
+	// Приводим к NFC: в macOS имена с кириллицей бывают в NFD («й» как «и» + кратка),
+	// и без нормализации один и тот же трек получал бы на разных системах разные имена
+	return norm.NFC.String(result)
+}
+
+// adoptDecomposedFile переименовывает файл, имя которого записано в NFD (например,
+// скопированный с macOS), в NFC-имя filePath, если файла с NFC-именем ещё нет.
+// Так проверка существования находит уже скачанный трек и не качает его заново
+func adoptDecomposedFile(filePath string) {
+	dir, base := filepath.Split(filePath)
+	decomposed := dir + norm.NFD.String(base)
+	if decomposed == filePath {
+		return
+	}
+	if _, err := os.Lstat(filePath); err == nil {
+		return
+	}
+	if _, err := os.Lstat(decomposed); err == nil {
+		if err := os.Rename(decomposed, filePath); err != nil {
+			log.Printf("Предупреждение: не удалось привести имя файла %s к NFC: %v\n", decomposed, err)
+		}
+	}
 }
 
 // downloadFile скачивает файл по URL и сохраняет его
-func downloadFile(url string, filePath string, token string) error {
-	return downloadFileWithProgress(url, filePath, token, nil)
+func downloadFile(client *http.Client, url string, filePath string, header http.Header) error {
+	return downloadFileWithProgress(client, url, filePath, header, 0, nil, nil)
 }
 
 // downloadFileWithProgress скачивает файл по URL с отображением прогресса
-func downloadFileWithProgress(url string, filePath string, token string, progressCallback func(float64)) error {
+// transferred, если не nil, увеличивается на каждый записанный байт. Если minFree больше
+// нуля, файл не создаётся, когда после него на диске осталось бы меньше minFree байт
+func downloadFileWithProgress(client *http.Client, url string, filePath string, header http.Header, minFree int64, progressCallback func(float64), transferred *atomic.Int64) error {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return fmt.Errorf("ошибка создания запроса: %w", err)
 	}
+	req.Header = header.Clone()
 
-	req.Header.Set("Authorization", "OAuth "+token)
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
-
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("ошибка выполнения запроса: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("ошибка HTTP: статус %d: %w", resp.StatusCode, ErrStaleDownloadURL)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("ошибка HTTP: статус %d", resp.StatusCode)
 	}
 
+	reservation, err := reserveFreeSpace(filepath.Dir(filePath), resp.ContentLength, minFree)
+	if err != nil {
+		return err
+	}
+	defer reservation.Release()
+
 	// Создаем файл
 	outFile, err := os.Create(filePath)
 	if err != nil {
@@ -877,6 +9763,16 @@ func downloadFileWithProgress(url string, filePath string, token string, progres
 	}
 	defer outFile.Close()
 
+	var out io.Writer = outFile
+	if reservation != nil {
+		out = io.MultiWriter(outFile, reservation)
+	}
+	return copyWithProgress(out, resp, progressCallback, transferred)
+}
+
+// copyWithProgress копирует тело ответа в out, сообщая прогресс в процентах,
+// если известен размер ответа. transferred, если не nil, считает записанные байты
+func copyWithProgress(outFile io.Writer, resp *http.Response, progressCallback func(float64), transferred *atomic.Int64) error {
 	// Получаем размер файла
 	totalSize := resp.ContentLength
 	var downloaded int64
@@ -894,6 +9790,9 @@ func downloadFileWithProgress(url string, filePath string, token string, progres
 				}
 			}
 			downloaded += int64(nw)
+			if transferred != nil {
+				transferred.Add(int64(nw))
+			}
 			if ew != nil {
 				return fmt.Errorf("ошибка записи файла: %w", ew)
 			}
@@ -923,8 +9822,98 @@ func downloadFileWithProgress(url string, filePath string, token string, progres
 	return nil
 }
 
-// writeID3Tags записывает ID3 теги в MP3 файл
-func writeID3Tags(filePath string, track Track) error {
+// expandCommentTemplate подставляет в шаблон комментария сведения о выгрузке трека
+func expandCommentTemplate(template string, opts DownloadOptions, info DownloadInfo) string {
+	replacer := strings.NewReplacer(
+		"{date}", opts.ExportDate,
+		"{datetime}", opts.ExportDateTime,
+		"{playlist}", opts.PlaylistTitle,
+		"{source}", opts.Source,
+		"{quality}", info.Quality(),
+	)
+	return replacer.Replace(template)
+}
+
+// defaultDateFormat — формат {date} по умолчанию (-date-format)
+const defaultDateFormat = "YYYY-MM-DD"
+
+// dateFormatTokens сопоставляет элементы -date-format с элементами макета time.Format.
+// Длинные элементы идут раньше коротких, чтобы YYYY не разобрался как два YY
+var dateFormatTokens = []struct{ token, layout string }{
+	{"YYYY", "2006"},
+	{"YY", "06"},
+	{"MM", "01"},
+	{"DD", "02"},
+	{"hh", "15"},
+	{"mm", "04"},
+	{"ss", "05"},
+}
+
+// parseDateFormat переводит значение -date-format (например, YYYY-MM-DD или YYYY/MM)
+// в макет time.Format. Кроме элементов YYYY, YY, MM, DD, hh, mm, ss допускаются только
+// разделители - _ . / и пробел: любая другая буква или цифра в макете Go имела бы особый смысл
+func parseDateFormat(value string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("пустой формат")
+	}
+	var layout strings.Builder
+	for rest := value; rest != ""; {
+		matched := false
+		for _, t := range dateFormatTokens {
+			if strings.HasPrefix(rest, t.token) {
+				layout.WriteString(t.layout)
+				rest = rest[len(t.token):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		switch rest[0] {
+		case '-', '_', '.', '/', ' ':
+			layout.WriteByte(rest[0])
+			rest = rest[1:]
+		default:
+			return "", fmt.Errorf("недопустимый символ %q в %q: используйте YYYY, YY, MM, DD, hh, mm, ss и разделители - _ . /", rest[0], value)
+		}
+	}
+	return layout.String(), nil
+}
+
+// dateFormatOption возвращает -date-format для манифеста: пусто, если формат по умолчанию
+func dateFormatOption(format string) string {
+	if format == defaultDateFormat {
+		return ""
+	}
+	return format
+}
+
+// expandDatePlaceholders подставляет в строку {date} и {datetime}
+func expandDatePlaceholders(s string, date string, datetime string) string {
+	return strings.NewReplacer("{date}", date, "{datetime}", datetime).Replace(s)
+}
+
+// defaultID3Version — версия ID3v2 по умолчанию: v2.3 читают почти все устройства
+const defaultID3Version = 3
+
+// parseID3Version разбирает значение -id3-version: 2.3 или 2.4
+func parseID3Version(value string) (byte, error) {
+	switch value {
+	case "2.3":
+		return 3, nil
+	case "2.4":
+		return 4, nil
+	default:
+		return 0, fmt.Errorf("неизвестная версия %q, доступные: 2.3, 2.4", value)
+	}
+}
+
+// writeID3Tags записывает ID3 теги в MP3 файл. Версия тега задаётся opts.Version:
+// в v2.3 год пишется во фрейм TYER, текст — в UTF-16, а несколько исполнителей
+// объединяются через запятую; в v2.4 год пишется в TDRC, текст — в UTF-8,
+// а исполнители — отдельными значениями фрейма TPE1
+func writeID3Tags(filePath string, track Track, opts TagOptions) error {
 	// Открываем файл для записи тегов
 	tag, err := id3v2.Open(filePath, id3v2.Options{Parse: true})
 	if err != nil {
@@ -932,6 +9921,17 @@ func writeID3Tags(filePath string, track Track) error {
 	}
 	defer tag.Close()
 
+	// Версию задаём до записи фреймов: от неё зависят ID фреймов и кодировка по умолчанию
+	version := opts.Version
+	if version == 0 {
+		version = defaultID3Version
+	}
+	tag.SetVersion(version)
+	if version == 3 {
+		// По умолчанию для v2.3 библиотека пишет ISO-8859-1, в которой нет кириллицы
+		tag.SetDefaultEncoding(id3v2.EncodingUTF16)
+	}
+
 	// Записываем название трека
 	if track.Title != "" {
 		tag.SetTitle(track.Title)
@@ -945,7 +9945,12 @@ func writeID3Tags(filePath string, track Track) error {
 		}
 	}
 	if len(artistNames) > 0 {
-		tag.SetArtist(strings.Join(artistNames, ", "))
+		separator := ", "
+		if version == 4 {
+			// В v2.4 значения текстового фрейма разделяются нулевым байтом
+			separator = "\x00"
+		}
+		tag.SetArtist(strings.Join(artistNames, separator))
 	}
 
 	// Записываем альбом (берем первый альбом, если есть)
@@ -959,7 +9964,17 @@ func writeID3Tags(filePath string, track Track) error {
 		year = track.Albums[0].Year
 	}
 	if year > 0 {
-		tag.SetYear(strconv.Itoa(year))
+		// Убираем год, записанный тегом другой версии, чтобы не осталось двух разных фреймов
+		tag.DeleteFrames("TYER")
+		tag.DeleteFrames("TDRC")
+		recordingTime := strconv.Itoa(year)
+		// В ID3v2.4 TDRC хранит полную дату; в TYER версии 2.3 помещается только год
+		if version == 4 && len(track.Albums) > 0 {
+			if date := albumReleaseDate(track.Albums[0]); strings.HasPrefix(date, recordingTime+"-") {
+				recordingTime = date
+			}
+		}
+		tag.SetYear(recordingTime)
 	}
 
 	// Записываем номер трека в альбоме
@@ -986,28 +10001,60 @@ func writeID3Tags(filePath string, track Track) error {
 	}
 
 	// Записываем URI обложки альбома в пользовательский текстовый фрейм (TXXX)
-	coverURI := track.CoverUri
-	if coverURI == "" {
-		coverURI = track.OgImage
-	}
-	if coverURI == "" && len(track.Albums) > 0 {
-		coverURI = track.Albums[0].CoverUri
-	}
-	if coverURI != "" {
-		// Формируем полный URL обложки (если это относительный путь)
-		coverURL := coverURI
-		if !strings.HasPrefix(coverURI, "http://") && !strings.HasPrefix(coverURI, "https://") {
-			coverURL = "https://" + strings.TrimPrefix(coverURI, "//")
-		}
-		// Записываем URI в пользовательский текстовый фрейм
+	if coverLink := coverURL(trackCoverURI(track), tagCoverSize); coverLink != "" {
 		urlFrame := id3v2.UserDefinedTextFrame{
 			Encoding:    tag.DefaultEncoding(),
 			Description: "Cover Art URL",
-			Value:       coverURL,
+			Value:       coverLink,
 		}
 		tag.AddFrame("TXXX", urlFrame)
 	}
 
+	// ID трека в Яндекс.Музыке позволяет потом найти трек для файла независимо от его имени (см. retag)
+	if trackID := formatID(track.ID); trackID != "" {
+		tag.AddFrame("TXXX", id3v2.UserDefinedTextFrame{
+			Encoding:    tag.DefaultEncoding(),
+			Description: trackIDFrameDescription,
+			Value:       trackID,
+		})
+	}
+
+	// Встраиваем обложку, заменяя уже записанную
+	if opts.Cover != nil {
+		tag.DeleteFrames(tag.CommonID("Attached picture"))
+		tag.AddAttachedPicture(id3v2.PictureFrame{
+			Encoding:    id3v2.EncodingISO,
+			MimeType:    opts.Cover.MimeType,
+			PictureType: id3v2.PTFrontCover,
+			Description: "Front cover",
+			Picture:     opts.Cover.Data,
+		})
+	}
+
+	// Записываем ISRC и темп, если они запрошены и есть в ответе API
+	if opts.ISRC && track.ISRC != "" {
+		tag.AddFrame("TSRC", id3v2.TextFrame{
+			Encoding: tag.DefaultEncoding(),
+			Text:     track.ISRC,
+		})
+	}
+	if opts.BPM && track.BPM > 0 {
+		tag.AddFrame("TBPM", id3v2.TextFrame{
+			Encoding: tag.DefaultEncoding(),
+			Text:     strconv.Itoa(int(math.Round(track.BPM))),
+		})
+	}
+
+	// Записываем комментарий по шаблону -comment-template
+	if opts.Comment != "" {
+		tag.AddCommentFrame(id3v2.CommentFrame{
+			Encoding:    tag.DefaultEncoding(),
+			Language:    "eng",
+			Description: "",
+			Text:        opts.Comment,
+		})
+	}
+
 	// Сохраняем изменения
 	if err := tag.Save(); err != nil {
 		return fmt.Errorf("ошибка сохранения тегов: %v", err)
@@ -1015,3 +10062,191 @@ func writeID3Tags(filePath string, track Track) error {
 
 	return nil
 }
+
+// CatalogEntry представляет трек для записи в SQLite-каталог
+type CatalogEntry struct {
+	Track     Track  // Метаданные трека
+	LocalPath string // Путь к скачанному файлу (пусто, если трек не скачивался)
+	Checksum  string // SHA-256 скачанного файла (пусто, если не считалась)
+}
+
+// Catalog представляет SQLite-каталог выгруженной библиотеки
+type Catalog struct {
+	db *sql.DB
+}
+
+// catalogSchema создает таблицы каталога, если их еще нет
+const catalogSchema = `
+CREATE TABLE IF NOT EXISTS albums (
+	id          TEXT PRIMARY KEY,
+	title       TEXT NOT NULL,
+	year        INTEGER,
+	genre       TEXT,
+	track_count INTEGER,
+	cover_uri   TEXT,
+	updated_at  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tracks (
+	id          TEXT PRIMARY KEY,
+	title       TEXT NOT NULL,
+	artists     TEXT NOT NULL,
+	album_id    TEXT REFERENCES albums(id),
+	album       TEXT,
+	year        INTEGER,
+	genre       TEXT,
+	duration_ms INTEGER,
+	local_path  TEXT,
+	checksum    TEXT,
+	updated_at  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS tracks_album_id ON tracks(album_id);
+`
+
+// OpenCatalog открывает (или создает) SQLite-каталог и схему в нём
+func OpenCatalog(path string) (*Catalog, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия базы: %w", err)
+	}
+	if _, err := db.Exec(catalogSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ошибка создания схемы каталога: %w", err)
+	}
+	return &Catalog{db: db}, nil
+}
+
+// Close закрывает базу каталога
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+// SaveTrackShorts записывает в каталог метаданные треков без локальных файлов
+func (c *Catalog) SaveTrackShorts(tracks []TrackShort) error {
+	entries := make([]CatalogEntry, 0, len(tracks))
+	for _, trackShort := range tracks {
+		entries = append(entries, CatalogEntry{Track: trackShort.Track})
+	}
+	for start := 0; start < len(entries); start += catalogBatchSize {
+		end := start + catalogBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		if err := c.SaveTracks(entries[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveTracks добавляет или обновляет треки и их альбомы одной транзакцией.
+// Пустые путь и контрольная сумма не затирают значения, записанные ранее
+func (c *Catalog) SaveTracks(entries []CatalogEntry) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	albumStmt, err := tx.Prepare(`
+INSERT INTO albums (id, title, year, genre, track_count, cover_uri, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+	title = excluded.title,
+	year = excluded.year,
+	genre = excluded.genre,
+	track_count = excluded.track_count,
+	cover_uri = excluded.cover_uri,
+	updated_at = excluded.updated_at`)
+	if err != nil {
+		return fmt.Errorf("ошибка подготовки запроса: %w", err)
+	}
+	defer albumStmt.Close()
+
+	trackStmt, err := tx.Prepare(`
+INSERT INTO tracks (id, title, artists, album_id, album, year, genre, duration_ms, local_path, checksum, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+	title = excluded.title,
+	artists = excluded.artists,
+	album_id = excluded.album_id,
+	album = excluded.album,
+	year = excluded.year,
+	genre = excluded.genre,
+	duration_ms = excluded.duration_ms,
+	local_path = COALESCE(NULLIF(excluded.local_path, ''), tracks.local_path),
+	checksum = COALESCE(NULLIF(excluded.checksum, ''), tracks.checksum),
+	updated_at = excluded.updated_at`)
+	if err != nil {
+		return fmt.Errorf("ошибка подготовки запроса: %w", err)
+	}
+	defer trackStmt.Close()
+
+	now := time.Now().Format(time.RFC3339)
+	for _, entry := range entries {
+		track := entry.Track
+
+		artistNames := []string{}
+		for _, artist := range track.Artists {
+			artistNames = append(artistNames, artist.Name)
+		}
+
+		var albumID, albumTitle sql.NullString
+		year := track.Year
+		genre := track.Genre
+		if len(track.Albums) > 0 {
+			album := track.Albums[0]
+			albumID = sql.NullString{String: formatID(album.ID), Valid: true}
+			albumTitle = sql.NullString{String: album.Title, Valid: true}
+			if year == 0 {
+				year = album.Year
+			}
+			if genre == "" {
+				genre = album.Genre
+			}
+			if _, err := albumStmt.Exec(albumID.String, album.Title, album.Year, album.Genre, album.TrackCount, album.CoverUri, now); err != nil {
+				return fmt.Errorf("ошибка записи альбома %s: %w", albumID.String, err)
+			}
+		}
+
+		trackID := track.TrackID()
+		if _, err := trackStmt.Exec(trackID, track.Title, strings.Join(artistNames, ", "), albumID, albumTitle,
+			year, genre, track.DurationMs, entry.LocalPath, entry.Checksum, now); err != nil {
+			return fmt.Errorf("ошибка записи трека %s: %w", trackID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка фиксации транзакции: %w", err)
+	}
+	return nil
+}
+
+// formatID приводит ID из ответа API (строку или число) к строке
+func formatID(id interface{}) string {
+	switch v := id.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		// Числа из JSON декодируются как float64; %v вывел бы их в экспоненциальной записи
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// fileChecksum считает SHA-256 файла
+func fileChecksum(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock — управляемые часы для тестов: время стоит на месте, а Sleep только
+// запоминает запрошенные паузы
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+// newTestClient создаёт клиент, который обращается к тестовому серверу вместо API
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*YandexMusicClient, *fakeClock) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	client := NewClient("token", ClientOptions{APIHosts: []string{server.URL}, Clock: clock})
+	return client, clock
+}
+
+func TestThrottleRetryDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		attempt int
+		delay   time.Duration
+		ok      bool
+	}{
+		{"429 без Retry-After, первая попытка", &APIError{StatusCode: http.StatusTooManyRequests}, 0, 2 * time.Second, true},
+		{"429 без Retry-After, вторая попытка", &APIError{StatusCode: http.StatusTooManyRequests}, 1, 4 * time.Second, true},
+		{"503 без Retry-After, третья попытка", &APIError{StatusCode: http.StatusServiceUnavailable}, 2, 8 * time.Second, true},
+		{"Retry-After важнее удвоения", &APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Second}, 2, 5 * time.Second, true},
+		{"слишком долгий Retry-After", &APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 2 * time.Minute}, 0, 0, false},
+		{"404 не повторяется", &APIError{StatusCode: http.StatusNotFound}, 0, 0, false},
+		{"ошибка сети не повторяется", errors.New("connection reset"), 0, 0, false},
+		{"обёрнутая ошибка API", fmt.Errorf("пачка: %w", &APIError{StatusCode: http.StatusBadGateway}), 0, 2 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, ok := throttleRetryDelay(tt.err, tt.attempt)
+			if delay != tt.delay || ok != tt.ok {
+				t.Errorf("throttleRetryDelay() = %v, %v; ожидалось %v, %v", delay, ok, tt.delay, tt.ok)
+			}
+		})
+	}
+}
+
+func TestResolveTrackBatchBacksOff(t *testing.T) {
+	var requests atomic.Int32
+	client, clock := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, `{"result":[{"id":"1","title":"Первый"},{"id":"2","title":"Второй"}]}`)
+		}
+	})
+
+	tracks, err := client.resolveTrackBatch([]string{"1", "2"})
+	if err != nil {
+		t.Fatalf("resolveTrackBatch() вернул ошибку: %v", err)
+	}
+	if len(tracks) != 2 || tracks[0].Title != "Первый" || tracks[1].Title != "Второй" {
+		t.Fatalf("resolveTrackBatch() вернул неожиданные треки: %+v", tracks)
+	}
+	if want := []time.Duration{2 * time.Second, 7 * time.Second}; !reflect.DeepEqual(clock.sleeps, want) {
+		t.Errorf("паузы %v, ожидалось %v", clock.sleeps, want)
+	}
+	stats := client.ThrottleStats()
+	if stats.Retries != 2 || stats.RetriesSucceeded != 1 || stats.Throttled != 1 {
+		t.Errorf("статистика %+v: ожидалось 2 повтора, 1 удачный и 1 ответ 429", stats)
+	}
+}
+
+func TestResolveTrackBatchGivesUp(t *testing.T) {
+	var requests atomic.Int32
+	client, clock := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	if _, err := client.resolveTrackBatch([]string{"1"}); err == nil {
+		t.Fatal("resolveTrackBatch() не вернул ошибку после всех повторов")
+	}
+	if want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second}; !reflect.DeepEqual(clock.sleeps, want) {
+		t.Errorf("паузы %v, ожидалось %v", clock.sleeps, want)
+	}
+	// Пачка не заменяется одиночными запросами: только первый запрос и повторы
+	if got := requests.Load(); got != batchRetryAttempts+1 {
+		t.Errorf("запросов к API: %d, ожидалось %d", got, batchRetryAttempts+1)
+	}
+	if stats := client.ThrottleStats(); stats.RetriesGaveUp != 1 {
+		t.Errorf("безуспешных повторов: %d, ожидался 1", stats.RetriesGaveUp)
+	}
+}
+
+func TestResolveTrackBatchDoesNotWaitTooLong(t *testing.T) {
+	client, clock := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	if _, err := client.resolveTrackBatch([]string{"1"}); err == nil {
+		t.Fatal("resolveTrackBatch() не вернул ошибку")
+	}
+	if len(clock.sleeps) != 0 {
+		t.Errorf("паузы %v, ожидалось без пауз: Retry-After больше %v", clock.sleeps, batchRetryMaxDelay)
+	}
+}
+
+func TestReusableFileName(t *testing.T) {
+	tests := []struct {
+		prev, wanted string
+		want         bool
+	}{
+		{"01 - A.mp3", "01 - A.mp3", true},
+		{"01 - A (2).mp3", "01 - A.mp3", true},
+		{"01 - A.flac", "01 - A.mp3", true},
+		{"01 - A.mp3", "02 - A.mp3", false},
+		{"01 - A (x).mp3", "01 - A.mp3", false},
+		{"01 - A (1).mp3", "01 - A.mp3", false},
+		{"Artist/Album/01 - A.mp3", "01 - A.mp3", false},
+	}
+	for _, tt := range tests {
+		if got := reusableFileName(tt.prev, tt.wanted); got != tt.want {
+			t.Errorf("reusableFileName(%q, %q) = %v, ожидалось %v", tt.prev, tt.wanted, got, tt.want)
+		}
+	}
+}
+
+// testTrack создаёт трек с ID и названием для тестов раскладки
+func testTrack(id string, title string) TrackShort {
+	return TrackShort{Track: Track{ID: id, Title: title}}
+}
+
+func TestPlanTrackFilesRenamesShiftedTracks(t *testing.T) {
+	folder := t.TempDir()
+	state, err := loadExportState(filepath.Join(folder, exportStateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DownloadOptions{Layout: layoutFlat, OnCollision: collisionSuffix, PrependIndex: true}
+
+	// Прошлый запуск: в плейлисте были A и C
+	first := []TrackShort{testTrack("1", "A"), testTrack("3", "C")}
+	for i, plan := range planTrackFiles(first, newFileNameRegistry(state), opts) {
+		if err := os.WriteFile(filepath.Join(folder, plan.fileName), []byte(plan.fileName), 0644); err != nil {
+			t.Fatal(err)
+		}
+		state.Mark(first[i].Track.TrackID(), trackStateDone, plan.fileName, nil)
+	}
+	oldA, oldC := state.Tracks["1"].File, state.Tracks["3"].File
+
+	// В начало плейлиста добавлен B: A и C сдвигаются на одну позицию
+	second := []TrackShort{testTrack("2", "B"), testTrack("1", "A"), testTrack("3", "C")}
+	plans := planTrackFiles(second, newFileNameRegistry(state), opts)
+	if plans[1].previous != oldA || plans[2].previous != oldC {
+		t.Fatalf("в плане не отмечены переименования: %+v", plans)
+	}
+	renamePlannedFiles(folder, second, plans, state)
+
+	for i, id := range []string{"1", "3"} {
+		plan := plans[i+1]
+		if got := state.Tracks[id].File; got != plan.fileName {
+			t.Errorf("в состоянии трека %s имя %q, ожидалось %q", id, got, plan.fileName)
+		}
+		data, err := os.ReadFile(filepath.Join(folder, plan.fileName))
+		if err != nil {
+			t.Errorf("файл %s не переименован: %v", plan.fileName, err)
+			continue
+		}
+		if string(data) != plan.previous {
+			t.Errorf("в %s содержимое %q, ожидалось содержимое %q", plan.fileName, data, plan.previous)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(folder, oldA)); err == nil && oldA != plans[2].fileName {
+		t.Errorf("старый файл %s остался на месте", oldA)
+	}
+
+	// Повторный запуск с тем же порядком ничего не переименовывает
+	for _, plan := range planTrackFiles(second, newFileNameRegistry(state), opts) {
+		if plan.previous != "" {
+			t.Errorf("повторное переименование %s → %s", plan.previous, plan.fileName)
+		}
+	}
+}
+
+// newTestWebDAV запускает сервер WebDAV, который хранит файлы в памяти и понимает
+// If-None-Match: * у PUT
+func newTestWebDAV(t *testing.T) (*webdavDestination, map[string][]byte) {
+	t.Helper()
+	var mu sync.Mutex
+	files := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		data, exists := files[r.URL.Path]
+		switch r.Method {
+		case "MKCOL":
+			w.WriteHeader(http.StatusCreated)
+		case "PUT":
+			if exists && r.Header.Get("If-None-Match") == "*" {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			files[r.URL.Path] = body
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case "DELETE":
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(files, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(server.Close)
+	d, err := newWebDAVDestination(strings.Replace(server.URL, "http://", webdavHTTPScheme+"://", 1)+"/music", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Discard)
+	return d, files
+}
+
+func TestWebDAVLock(t *testing.T) {
+	d, files := newTestWebDAV(t)
+	lock, err := d.acquireLock(false)
+	if err != nil {
+		t.Fatalf("acquireLock() вернул ошибку: %v", err)
+	}
+	if _, ok := files["/music/"+exportLockFileName]; !ok {
+		t.Fatal("файл блокировки не создан на сервере")
+	}
+
+	// Второй запуск с другого компьютера не получает блокировку
+	files["/music/"+exportLockFileName] = []byte(`{"host":"nas-client","pid":42,"startedAt":"2024-05-01T12:00:00Z"}`)
+	if _, err := d.acquireLock(false); err == nil || !strings.Contains(err.Error(), "nas-client") {
+		t.Fatalf("acquireLock() при чужой блокировке: %v", err)
+	}
+	// С -break-lock чужая блокировка снимается
+	if _, err := d.acquireLock(true); err != nil {
+		t.Fatalf("acquireLock(breakLock) вернул ошибку: %v", err)
+	}
+
+	lock.Release()
+	if _, ok := files["/music/"+exportLockFileName]; ok {
+		t.Error("файл блокировки остался после Release")
+	}
+}
+
+func TestParseNameTemplate(t *testing.T) {
+	valid := []string{"{track} - {artist} - {title}", "{id}", "{year} {album} — {title}", "{date} {title}"}
+	for _, template := range valid {
+		if err := parseNameTemplate(template); err != nil {
+			t.Errorf("parseNameTemplate(%q) вернул ошибку: %v", template, err)
+		}
+	}
+	invalid := []string{"{artist}", "{title} {genre}", "{artist}/{title}", ""}
+	for _, template := range invalid {
+		if err := parseNameTemplate(template); err == nil {
+			t.Errorf("parseNameTemplate(%q) не вернул ошибку", template)
+		}
+	}
+}
+
+func TestTrackRelativePathNameTemplate(t *testing.T) {
+	track := Track{ID: "42", Title: "Song: Live", Year: 1999, TrackNumber: 3, Albums: []Album{{ID: 7}}}
+	tests := []struct {
+		layout, template, want string
+	}{
+		{layoutFlat, "{track} - {artist} - {title}", "03 - Artist - Song_ Live.mp3"},
+		{layoutFlat, "{year} {id}", "1999 42.mp3"},
+		{layoutMediaServer, "{title} ({year})", filepath.Join("Неизвестный исполнитель", "Без альбома", "Song_ Live (1999).mp3")},
+		{layoutFlat, "", "Artist-Song_ Live.mp3"},
+		{layoutFlat, expandDatePlaceholders("{date} {title}", "2024/05/01", ""), "2024_05_01 Song_ Live.mp3"},
+	}
+	for _, tt := range tests {
+		if got := trackRelativePath(track, "Artist", tt.layout, tt.template, 0); got != tt.want {
+			t.Errorf("trackRelativePath(%s, %q) = %q, ожидалось %q", tt.layout, tt.template, got, tt.want)
+		}
+	}
+}